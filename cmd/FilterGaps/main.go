@@ -39,6 +39,7 @@ func main() {
 	cutoff := app.Flag("cutoff", "cutoff percentage; default is 10%").Default("10").Int()
 	fillgaps := app.Flag("fill-gaps", "fill gene sequences that didn't make the cutoff with dashes as a placeholder").Default("False").Bool()
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	prov := newProvenance(app, "")
 	if *ncpu == 0 {
 		*ncpu = runtime.NumCPU()
 	}
@@ -51,7 +52,8 @@ func main() {
 	//cutoff := 99
 	//timer
 	start := time.Now()
-	makeFilteredMSA(*outdir, *alnFile, *cutoff)
+	MSA := makeFilteredMSA(*outdir, *alnFile, *cutoff)
+	prov.Set("input-sha256", hashFiles(*alnFile))
 	done := make(chan struct{})
 	//read in alignments
 	alignments, errc := readAlignments(done, *alnFile)
@@ -79,6 +81,7 @@ func main() {
 		panic(err)
 	}
 	//add the number of core and flex to the bottom of the spreadsheet
+	prov.WriteSidecar(MSA)
 
 	duration := time.Since(start)
 	fmt.Println("Time to filter gapped alignments:", duration)
@@ -195,8 +198,9 @@ func gapFiller(s seq.Sequence) {
 	return
 }
 
-//makeFilteredMSA makes the outdir and initializes the MSA files for core and flexible genomes
-func makeFilteredMSA(outdir string, alnFile string, cutoff int) {
+//makeFilteredMSA makes the outdir and initializes the MSA files for core and flexible genomes,
+//and returns the path of the filtered MSA
+func makeFilteredMSA(outdir string, alnFile string, cutoff int) string {
 	if _, err := os.Stat(outdir); os.IsNotExist(err) {
 		os.Mkdir(outdir, 0755)
 	}
@@ -222,6 +226,7 @@ func makeFilteredMSA(outdir string, alnFile string, cutoff int) {
 	f, err = os.Create(MSA)
 	check(err)
 	f.Close()
+	return MSA
 }
 
 //check for errors
@@ -15,13 +15,12 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/kussell-lab/biogo/seq"
 	"github.com/kussell-lab/mcorr"
 	"github.com/kussell-lab/ncbiftp/taxonomy"
 	"gopkg.in/cheggaaa/pb.v2"
-	"os"
-	"strings"
 	"sync"
 )
 
@@ -37,9 +36,12 @@ func calcKsAll(seqMap map[string][]Codon, seqpairs [][]string, codonOffset, codo
 	}
 	done := make(chan struct{})
 
-	pairChan := makeSeqPairChan(done, seqMap, seqpairs)
+	//results are written in the order of the pair list, with a few pairs in flight per worker
+	ow := newOrderedWriter(outFile, 2*numDigesters)
+	defer ow.Close()
+	pairChan := makeSeqPairChan(done, seqMap, seqpairs, ow)
 	//start a fixed number of go routines
-	c := make(chan map[string]mcorr.CorrResult)
+	c := make(chan pairResult)
 	var wg sync.WaitGroup
 	for i := 0; i < numDigesters; i++ {
 		wg.Add(1)
@@ -50,28 +52,24 @@ func calcKsAll(seqMap map[string][]Codon, seqpairs [][]string, codonOffset, codo
 		wg.Wait()
 		close(c)
 	}()
-	//end of pipeline; write files ...
+	//end of pipeline; write files in order ...
 	for res := range c {
-		writeCsvOut(outFile, res)
+		ow.Write(res)
 	}
 
 }
 
-//writeCsvOut writes results to the output csv
-func writeCsvOut(outFile string, results map[string]mcorr.CorrResult) {
-	f, err := os.OpenFile(outFile, os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-	for pairID, res := range results {
-		f.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n",
+//writeCsvRows writes results to the output csv
+func writeCsvRows(w *bufio.Writer, results map[string]mcorr.CorrResult) {
+	for _, pairID := range sortedPairIDs(results) {
+		res := results[pairID]
+		w.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n",
 			res.Lag, res.Mean, res.Variance, res.N, res.Type, pairID))
 	}
 }
 
 //calcQs calculates Qs for a given lag across all initial positions
-func calcKsPair(done <-chan struct{}, pairChan <-chan SeqPair, resChan chan<- map[string]mcorr.CorrResult,
+func calcKsPair(done <-chan struct{}, pairChan <-chan SeqPair, resChan chan<- pairResult,
 	synonymous bool, codingTable *taxonomy.GeneticCode, codonPosition int, id int, bar *pb.ProgressBar, wg *sync.WaitGroup) {
 	defer wg.Done()
 	//fmt.Printf("Worker %d starting\n", id)
@@ -80,7 +78,7 @@ func calcKsPair(done <-chan struct{}, pairChan <-chan SeqPair, resChan chan<- ma
 		//fmt.Printf("lag %d starting \n", l)
 		KsResMap := mapKsRes(seqPair, synonymous, codingTable, codonPosition)
 		select {
-		case resChan <- KsResMap:
+		case resChan <- pairResult{seqPair.index, KsResMap}:
 			//lag := 3 * l
 			//fmt.Printf("\rlag %d done", lag)
 			if bar != nil {
@@ -165,20 +163,27 @@ func extractCodons(s seq.Sequence, offset int) (codons []Codon) {
 }
 
 //makeSeqPairChan returns a channel of sequence pairs
-func makeSeqPairChan(done <-chan struct{}, seqMap map[string][]Codon, seqpairs [][]string) <-chan SeqPair {
+func makeSeqPairChan(done <-chan struct{}, seqMap map[string][]Codon, seqpairs [][]string, ow *orderedWriter) <-chan SeqPair {
 	SeqPairChan := make(chan SeqPair)
 	go func() {
 		defer close(SeqPairChan)
-		for _, seqpair := range seqpairs {
+		for index, seqpair := range seqpairs {
 			seqName1 := seqpair[0]
 			seqName2 := seqpair[1]
 			seq1 := seqMap[seqName1]
 			seq2 := seqMap[seqName2]
-			pairSeqs := SeqPair{seqName1, seq1,
+			pairSeqs := SeqPair{index, seqName1, seq1,
 				seqName2, seq2}
+			//wait for a free slot in the writer
+			select {
+			case ow.slots <- struct{}{}:
+			case <-done:
+				return
+			}
 			select {
 			case SeqPairChan <- pairSeqs:
 			case <-done:
+				return
 			}
 
 		}
@@ -188,19 +193,15 @@ func makeSeqPairChan(done <-chan struct{}, seqMap map[string][]Codon, seqpairs [
 
 //SeqPair pair of sequences to be analyzed
 type SeqPair struct {
+	index       int // position in the pair list
 	genomeName1 string
 	genome1     []Codon
 	genomeName2 string
 	genome2     []Codon
 }
 
+//getNames reads the gene and strain names from a sequence header (see --header-format)
 func getNames(s string) (geneName, genomeName string) {
-	terms := strings.Split(s, " ")
-	//this is for the helicobacter test files
-	//geneName = terms[0]
-	//genomeName = terms[1]
-	//this is the genomeName for the MSA files assembled from ReferenceAlignmentGenerator
-	geneName = terms[0]
-	genomeName = terms[2]
-	return
+	header := headers.parse(s)
+	return header.gene, header.strain
 }
@@ -0,0 +1,184 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/kussell-lab/biogo/seq"
+	"log"
+	"sort"
+	"strings"
+)
+
+// policies for a strain name which appears more than once in the alignment of a CDS region:
+// rename the copies in the order they appear (<name>, <name>_1, <name>_2, ...), stop with an error,
+// or keep only the first copy or the one with the most A, C, G and T over the whole genome.
+// Copies are told apart only by the order they appear in each CDS region, so renaming (and keeping
+// the longest) assumes every CDS region lists the copies of a strain in the same order.
+var duplicatePolicies = []string{"rename", "error", "keep-first", "keep-longest"}
+
+// longestCopies holds the copy (counting from 0) of each duplicated strain name to keep in every
+// CDS region with keep-longest, as chosen by chooseLongestCopies.
+var longestCopies map[string]int
+
+// strainDuplicate is a strain name which appears more than once in the alignment of a CDS region.
+type strainDuplicate struct {
+	Gene   string `json:"gene"`
+	Name   string `json:"name"`
+	Copies int    `json:"copies"`
+	Action string `json:"action"` // what was done with the copies
+}
+
+func (d strainDuplicate) String() string {
+	return fmt.Sprintf("%s in %s: %d copies, %s", d.Name, d.Gene, d.Copies, d.Action)
+}
+
+// uniqueStrains applies the duplicate-name policy to the sequences of the alignment a, and returns
+// the sequences to keep along with their strain names, in the order of the alignment.
+func uniqueStrains(a Alignment, policy string) (seqs []seq.Sequence, names []string, dups []strainDuplicate) {
+	copies := make(map[string][]int)
+	var order []string
+	for j, s := range a.Sequences {
+		_, name := getNames(s.Id)
+		if copies[name] == nil {
+			order = append(order, name)
+		}
+		copies[name] = append(copies[name], j)
+	}
+	for _, name := range order {
+		idx := copies[name]
+		if len(idx) == 1 {
+			seqs = append(seqs, a.Sequences[idx[0]])
+			names = append(names, name)
+			continue
+		}
+		d := strainDuplicate{Gene: a.ID, Name: name, Copies: len(idx)}
+		switch policy {
+		case "error":
+			log.Fatalf("strain %s appears %d times in the alignment of %s (see --duplicate-names)", name, len(idx), a.ID)
+		case "keep-first":
+			seqs = append(seqs, a.Sequences[idx[0]])
+			names = append(names, name)
+			d.Action = "kept the first"
+		case "keep-longest":
+			best, found := longestCopies[name]
+			if !found || best >= len(idx) {
+				log.Fatalf("no copy of strain %s was chosen for the alignment of %s", name, a.ID)
+			}
+			seqs = append(seqs, a.Sequences[idx[best]])
+			names = append(names, name)
+			d.Action = fmt.Sprintf("kept copy %d (the longest over the genome)", best+1)
+		default:
+			var renamed []string
+			for k, j := range idx {
+				newName := name
+				if k > 0 {
+					newName = fmt.Sprintf("%s_%d", name, k)
+					if copies[newName] != nil {
+						log.Fatalf("renaming copy %d of strain %s in %s to %s would clash with the strain of that name (see --duplicate-names)",
+							k+1, name, a.ID, newName)
+					}
+				}
+				seqs = append(seqs, a.Sequences[j])
+				names = append(names, newName)
+				renamed = append(renamed, newName)
+			}
+			d.Action = "renamed " + strings.Join(renamed, ", ")
+		}
+		dups = append(dups, d)
+	}
+	return
+}
+
+// chooseLongestCopies picks the copy of each duplicated strain name to keep with keep-longest: the copy with
+// the most A, C, G and T summed over all the CDS regions of the alignment files, so that every CDS region keeps
+// the same genome. The CDS regions at the same start in each file are taken together, as in combinedSeqMap.
+// A strain with a different number of copies in two CDS regions cannot be matched up, and stops the run.
+func chooseLongestCopies(policy string, files ...string) {
+	longestCopies = nil
+	if policy != "keep-longest" {
+		return
+	}
+	//the bases of each copy of each strain in each CDS region, by start position
+	bases := make(map[int]map[string][]int)
+	genes := make(map[int]string)
+	for _, file := range files {
+		for a := range readAlignments(file) {
+			if bases[a.start] == nil {
+				bases[a.start] = make(map[string][]int)
+				genes[a.start] = a.ID
+			}
+			for _, s := range a.Sequences {
+				_, name := getNames(s.Id)
+				bases[a.start][name] = append(bases[a.start][name], countBases(s.Seq))
+			}
+		}
+	}
+	var starts []int
+	for start := range bases {
+		starts = append(starts, start)
+	}
+	sort.Ints(starts)
+	totals := make(map[string][]int)
+	seenIn := make(map[string]string)
+	for _, start := range starts {
+		for name, counts := range bases[start] {
+			total, found := totals[name]
+			if !found {
+				totals[name] = append([]int(nil), counts...)
+				seenIn[name] = genes[start]
+				continue
+			}
+			if len(total) != len(counts) {
+				log.Fatalf("strain %s has %d copies in %s but %d in %s, so its copies cannot be matched up between "+
+					"CDS regions for keep-longest (see --duplicate-names)", name, len(total), seenIn[name], len(counts), genes[start])
+			}
+			for k, n := range counts {
+				total[k] += n
+			}
+		}
+	}
+	longestCopies = make(map[string]int)
+	for name, total := range totals {
+		if len(total) < 2 {
+			continue
+		}
+		best := 0
+		for k, n := range total {
+			if n > total[best] {
+				best = k
+			}
+		}
+		longestCopies[name] = best
+	}
+}
+
+// countBases counts the A, C, G and T in a sequence.
+func countBases(s []byte) (n int) {
+	for _, b := range s {
+		switch b {
+		case 'A', 'C', 'G', 'T', 'a', 'c', 'g', 't':
+			n++
+		}
+	}
+	return
+}
+
+// reportDuplicates prints the duplicate strain names of a CDS region.
+func reportDuplicates(dups []strainDuplicate) {
+	for _, d := range dups {
+		fmt.Printf("duplicate strain name %s\n", d)
+	}
+}
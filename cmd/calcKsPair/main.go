@@ -27,8 +27,6 @@ import (
 	"os"
 	"runtime"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -40,12 +38,16 @@ func main() {
 
 	alnFile := app.Arg("in", "Alignment file in XMFA format.").Required().String()
 	outPrefix := app.Arg("out", "Output prefix.").Required().String()
+	duplicateNames := app.Flag("duplicate-names", "what to do with a strain name which appears more than once in a CDS region: rename the copies in order (<name>_1, ...), error, keep-first or keep-longest").Default("rename").Enum(duplicatePolicies...)
+	headerFormat := app.Flag("header-format", "format of the XMFA sequence headers: a template of {gene}, {start}, {stop}, {strain} and {_} (any text), or a regular expression with those named groups").Default(defaultHeaderFormat).String()
 	ncpu := app.Flag("num-cpu", "Number of CPUs (default: using all available cores)").Default("0").Int()
 	//numBoot := app.Flag("num-boot", "Number of bootstrapping on genes").Default("1000").Int()
 	numDigesters := app.Flag("num-threads", "number of threads").Default("8").Int()
 	showProgress := app.Flag("show-progress", "Show progress").Bool()
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	headers = newHeaderFormat(*headerFormat)
+	prov := newProvenance(app, "")
 
 	if *ncpu <= 0 {
 		*ncpu = runtime.NumCPU()
@@ -78,21 +80,23 @@ func main() {
 	}
 	//sort the slice numerically
 	sort.Ints(startSlice)
-	//initialize output csv
-	outFile := *outPrefix + ".csv"
-	initCsvOut(outFile)
-
 	// now go through and make a map of codon sequences
 	// where we add on codons to the end of each strain sequence
 	fmt.Print("fetching CDS regions\n")
 	//the keys are the strain names and the values are the codon sequences for each
 	//var seqMap map[string][]Codon
-	seqMap := makeSeqMap(startSlice, *alnFile, codonOffset)
+	seqMap := makeSeqMap(startSlice, *alnFile, codonOffset, *duplicateNames)
 
-	//make a map of all sequence names and get all pairs
+	//make a map of all sequence names in sorted order and get all pairs,
+	//so that the pairs come out in the same order every run
+	var seqNames []string
+	for seqName := range seqMap {
+		seqNames = append(seqNames, seqName)
+	}
+	sort.Strings(seqNames)
 	seqNameMap := make(map[int]string)
 	i := 0
-	for seqName, _ := range seqMap {
+	for _, seqName := range seqNames {
 		seqNameMap[i] = seqName
 		i = i + 1
 	}
@@ -112,6 +116,15 @@ func main() {
 	//fmt.Println(testpairs)
 	//seqpairs := Combinations(seqNames, 2)
 
+	//initialize output csv
+	outFile := *outPrefix + ".csv"
+	prov.Set("genetic-code", "11")
+	prov.Set("synonymous", synonymous)
+	prov.Set("codon-position", codonPos)
+	prov.Set("num-strains", numSeqs)
+	prov.Set("input-sha256", hashFiles(*alnFile))
+	initCsvOut(outFile, prov)
+
 	numpairs := len(pairList)
 	fmt.Println(numpairs, "of pairwise distances to compute")
 	// show progress bar
@@ -137,10 +150,8 @@ func readAlignments(file string) (alnChan chan Alignment) {
 
 		c := readXMFA(file)
 		for alignment := range c {
-			header := strings.Split(alignment[0].Id, " ")
-			alnID := header[0]
-			genomePos := header[1]
-			alnChan <- Alignment{ID: alnID, genePos: genomePos, Sequences: alignment}
+			header := headers.parse(alignment[0].Id)
+			alnChan <- Alignment{ID: header.gene, start: header.start, stop: header.stop, Sequences: alignment}
 		}
 	}()
 
@@ -198,25 +209,28 @@ func mustOpen(file string) (f *os.File) {
 // Alignment is an array of mutliple sequences with same length.
 type Alignment struct {
 	ID        string //gene ID
-	genePos   string // position of gene on the genome
+	start     int    // position of gene on the genome
+	stop      int
 	Sequences []seq.Sequence
 }
 
 //initCsvOut initializes the output csv
-func initCsvOut(outFile string) {
+func initCsvOut(outFile string, prov *provenance) {
 	w, err := os.Create(outFile)
 	if err != nil {
 		panic(err)
 	}
+	prov.WriteHeader(w)
 	w.WriteString("l,m,v,n,t,b\n")
 	w.Close()
 }
 
-func makeSeqMap(startSlice []int, alnFile string, codonOffset int) (seqMap map[string][]Codon) {
+func makeSeqMap(startSlice []int, alnFile string, codonOffset int, policy string) (seqMap map[string][]Codon) {
 	seqMap = make(map[string][]Codon)
+	chooseLongestCopies(policy, alnFile)
 	for _, i := range startSlice {
 		a := getGene(alnFile, i)
-		addCodons(a, seqMap, codonOffset)
+		addCodons(a, seqMap, codonOffset, policy)
 	}
 	return seqMap
 }
@@ -233,46 +247,32 @@ func getGene(alnFile string, startCodon int) (gene Alignment) {
 	return gene
 }
 
-//addCodons adds codons to each strain sequence in the sequence map
-func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int) {
+//addCodons adds codons to each strain sequence in the sequence map, keeping or renaming strains
+//which appear more than once according to the duplicate-name policy, and returns those duplicates
+func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int, policy string) []strainDuplicate {
+	seqs, names, dups := uniqueStrains(a, policy)
+	reportDuplicates(dups)
 	//add codons to the map for each sequence
 	var wg sync.WaitGroup
 	//tell wg how many threads will be running concurrently
-	wg.Add(len(a.Sequences))
+	wg.Add(len(seqs))
 	//mutex lock for safe access to seqMap
 	var mutex = &sync.Mutex{}
-	alnSeqs := a.Sequences
-	//give duplicate strain names a suffix to differentiate
-	duplicates := make(map[string]int)
-	for j := 0; j < len(alnSeqs); j++ {
+	for j := 0; j < len(seqs); j++ {
 		go func(j int) {
 			defer wg.Done()
-			s := alnSeqs[j]
-			codons := extractCodons(s, codonOffset)
-			_, seqName := getNames(s.Id)
-			//check if the strain name has been done ...
-			mutex.Lock()
-			i, found := duplicates[seqName]
-			//update the count for the strain
-			duplicates[seqName]++
-			mutex.Unlock()
-			if found {
-				id := strconv.Itoa(i)
-				seqName = seqName + "_" + id
-			}
+			codons := extractCodons(seqs[j], codonOffset)
 			mutex.Lock()
-			seqMap[seqName] = append(seqMap[seqName], codons...)
+			seqMap[names[j]] = append(seqMap[names[j]], codons...)
 			mutex.Unlock()
 		}(j)
 	}
 	wg.Wait()
+	return dups
 }
 
 func getStartPos(aln Alignment) int {
-	genomePos := aln.genePos
-	terms := strings.Split(genomePos, "+")
-	startPos, _ := strconv.Atoi(terms[0])
-	return startPos
+	return aln.start
 }
 
 //// Combinations returns combinations of n elements for a given string array.
@@ -0,0 +1,287 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// a codon store is a single boltdb file with the codons of all CDS regions.
+// the "codons" bucket is keyed by the position of the codon in the concatenated CDS regions,
+// as a big-endian uint32 so that keys sort in order of position, and each value holds
+// that codon for every strain, in the order of the strain list.
+// the "meta" bucket holds the StoreMeta as json under the key "meta".
+var (
+	codonBucket = []byte("codons")
+	storeBucket = []byte("meta")
+	storeKey    = []byte("meta")
+)
+
+// GeneRegion is the position of a CDS region in the genome and in the codon store.
+type GeneRegion struct {
+	ID         string   `json:"id"`
+	Start      int      `json:"start"` // genome position from the XMFA header
+	Stop       int      `json:"stop"`
+	StartCodon int      `json:"start_codon"` // first codon of the gene in the store
+	NumCodons  int      `json:"num_codons"`
+	GapFilled  []string `json:"gap_filled,omitempty"` // strains with no sequence in the gene, filled with gaps
+}
+
+// ReportGapFilled prints the strains with no sequence in the CDS region, which the store fills with gaps.
+func (g GeneRegion) ReportGapFilled() {
+	if len(g.GapFilled) > 0 {
+		fmt.Printf("%d strains have no sequence in %s and are filled with gaps: %s\n",
+			len(g.GapFilled), g.ID, strings.Join(g.GapFilled, ", "))
+	}
+}
+
+// StoreMeta describes the contents of a codon store.
+type StoreMeta struct {
+	Strains      []string     `json:"strains"`
+	NumCodons    int          `json:"num_codons"`
+	Genes        []GeneRegion `json:"genes"`
+	GeneticCode  string       `json:"genetic_code"`
+	SourceSHA256 string       `json:"source_sha256"`
+	Provenance   []string     `json:"provenance,omitempty"` // "key=value" pairs from the run of makeGeneDB
+}
+
+// Manifest is the description of a codon store written as json next to the store,
+// so that it can be read without opening the store.
+type Manifest struct {
+	Store string `json:"store"`
+	StoreMeta
+}
+
+// Gene returns the CDS region with the given name.
+func (m *StoreMeta) Gene(name string) (GeneRegion, bool) {
+	for _, g := range m.Genes {
+		if g.ID == name {
+			return g, true
+		}
+	}
+	return GeneRegion{}, false
+}
+
+// CodonStore is a codon store along with its description.
+type CodonStore struct {
+	db   *bolt.DB
+	Meta StoreMeta
+}
+
+// createCodonStore creates a new codon store, overwriting any previous one.
+func createCodonStore(file string) *CodonStore {
+	os.Remove(file)
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{codonBucket, storeBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &CodonStore{db: db}
+}
+
+// openCodonStore opens a codon store for reading.
+func openCodonStore(file string) *CodonStore {
+	if _, err := os.Stat(file); err != nil {
+		log.Fatalf("Error when reading codon store %s: %v", file, err)
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &CodonStore{db: db}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storeBucket)
+		if b == nil || b.Get(storeKey) == nil {
+			return fmt.Errorf("%s is not a codon store; rebuild it with makeGeneDB", file)
+		}
+		return json.Unmarshal(b.Get(storeKey), &s.Meta)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+// openCodonInput opens a codon store, given either the store or its manifest,
+// and returns the store file along with the store.
+func openCodonInput(file string) (string, *CodonStore) {
+	if filepath.Ext(file) != ".json" {
+		return file, openCodonStore(file)
+	}
+	v, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(v, &m); err != nil {
+		log.Fatalf("Error when reading manifest %s: %v", file, err)
+	}
+	storeFile := m.Store
+	if !filepath.IsAbs(storeFile) {
+		storeFile = filepath.Join(filepath.Dir(file), storeFile)
+	}
+	s := openCodonStore(storeFile)
+	if s.Meta.SourceSHA256 != m.SourceSHA256 || s.Meta.NumCodons != m.NumCodons {
+		log.Fatalf("%s does not describe %s; rerun makeGeneDB", file, storeFile)
+	}
+	return storeFile, s
+}
+
+// Close closes the codon store.
+func (s *CodonStore) Close() {
+	s.db.Close()
+}
+
+// WriteMeta stores the description of the codon store.
+func (s *CodonStore) WriteMeta() {
+	v, err := json.Marshal(s.Meta)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeBucket).Put(storeKey, v)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// manifestFile returns the name of the manifest of a codon store.
+func manifestFile(storeFile string) string {
+	return strings.TrimSuffix(storeFile, filepath.Ext(storeFile)) + ".manifest.json"
+}
+
+// WriteManifest writes the description of the codon store to file;
+// the store is named relative to the manifest so that the two can be moved together.
+func (s *CodonStore) WriteManifest(file string) {
+	storeFile, err := filepath.Abs(s.db.Path())
+	if err != nil {
+		log.Fatal(err)
+	}
+	manifestDir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rel, err := filepath.Rel(manifestDir, storeFile); err == nil {
+		storeFile = rel
+	}
+	v, err := json.MarshalIndent(Manifest{Store: storeFile, StoreMeta: s.Meta}, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, append(v, '\n'), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// PutCodons stores a block of codon columns, starting at codon position startCodon,
+// where each column holds the codon of every strain.
+func (s *CodonStore) PutCodons(startCodon int, columns [][]Codon) {
+	fn := func(tx *bolt.Tx) error {
+		b := tx.Bucket(codonBucket)
+		//keys are written in order, so pack the pages
+		b.FillPercent = 1.0
+		for k, column := range columns {
+			err := b.Put(codonKey(startCodon+k), CodonstoBytes(column, 0))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := s.db.Update(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ReadRange returns the codon columns at positions from (inclusive) to to (exclusive)
+// in a single transaction.
+func (s *CodonStore) ReadRange(from, to int) (columns [][]Codon) {
+	columns = make([][]Codon, to-from)
+	fn := func(tx *bolt.Tx) error {
+		c := tx.Bucket(codonBucket).Cursor()
+		for k, v := c.Seek(codonKey(from)); k != nil; k, v = c.Next() {
+			pos := int(binary.BigEndian.Uint32(k))
+			if pos >= to {
+				break
+			}
+			//values are only valid during the transaction
+			b := make([]byte, len(v))
+			copy(b, v)
+			columns[pos-from] = BytestoCodons(b, 0)
+		}
+		return nil
+	}
+
+	err := s.db.View(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return
+}
+
+func codonKey(pos int) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, uint32(pos))
+	return k
+}
+
+// BytestoCodons convert bytes back to codons
+func BytestoCodons(s []byte, offset int) (codons []Codon) {
+	for i := offset; i+3 <= len(s); i += 3 {
+		c := s[i:(i + 3)]
+		codons = append(codons, c)
+	}
+	return
+}
+
+// CodonstoBytes convert codons to bytes
+func CodonstoBytes(codons []Codon, offset int) (s []byte) {
+	for _, cc := range codons {
+		s = append(s, cc...)
+	}
+	return
+}
+
+// addSourceProvenance adds the provenance of a codon store to that of a run, with a "source-" prefix.
+func addSourceProvenance(prov *provenance, lines []string) {
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			prov.Set("source-"+kv[0], kv[1])
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultHeaderFormat fits the XMFA files made by ReferenceAlignmentGenerator,
+// whose sequence headers look like "orf1 1+90 strain0".
+const defaultHeaderFormat = "{gene} {start}+{stop} {strain}"
+
+// headerFields are the fields a header template can hold; {_} skips over any text.
+// The gene and strain names hold no spaces, so that fields after the template are left out.
+var headerFields = map[string]string{
+	"gene":   `(?P<gene>\S+?)`,
+	"start":  `(?P<start>\d+)`,
+	"stop":   `(?P<stop>\d+)`,
+	"strain": `(?P<strain>\S+?)`,
+	"_":      `.*?`,
+}
+
+// headers reads the sequence headers of the XMFA files; set from --header-format.
+var headers = newHeaderFormat(defaultHeaderFormat)
+
+// headerFormat reads the gene, its position on the genome and the strain from a sequence header.
+type headerFormat struct {
+	format string
+	re     *regexp.Regexp
+}
+
+// seqHeader is a parsed sequence header; stop is 0 if the format has no stop.
+type seqHeader struct {
+	gene   string
+	start  int
+	stop   int
+	strain string
+}
+
+// newHeaderFormat compiles a header template such as "{gene} {start}+{stop} {strain}", or a regular
+// expression with the named groups gene, start, stop and strain, which must hold gene, start and strain
+// along with any other required fields.
+func newHeaderFormat(format string, required ...string) *headerFormat {
+	expr := format
+	if !strings.Contains(format, "(?P<") {
+		var b strings.Builder
+		b.WriteString("^")
+		rest := format
+		for {
+			i := strings.Index(rest, "{")
+			if i < 0 {
+				b.WriteString(regexp.QuoteMeta(rest))
+				break
+			}
+			j := strings.Index(rest[i:], "}")
+			if j < 0 {
+				log.Fatalf("header format %q has an unclosed {", format)
+			}
+			field := rest[i+1 : i+j]
+			group, found := headerFields[field]
+			if !found {
+				log.Fatalf("header format %q has an unknown field {%s}; use {gene}, {start}, {stop}, {strain} or {_}", format, field)
+			}
+			b.WriteString(regexp.QuoteMeta(rest[:i]))
+			b.WriteString(group)
+			rest = rest[i+j+1:]
+		}
+		//any further fields after a space are left out, as in "orf1 1+90 strain0 len=300"
+		b.WriteString(`(?:\s.*)?$`)
+		expr = b.String()
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.Fatalf("header format %q is not a valid regular expression: %v", format, err)
+	}
+	for _, field := range append([]string{"gene", "start", "strain"}, required...) {
+		if re.SubexpIndex(field) < 0 {
+			log.Fatalf("header format %q has no {%s}", format, field)
+		}
+	}
+	return &headerFormat{format: format, re: re}
+}
+
+// parse reads a sequence header, stopping with an error if it does not fit the format.
+func (h *headerFormat) parse(id string) (hd seqHeader) {
+	m := h.re.FindStringSubmatch(id)
+	if m == nil {
+		log.Fatalf("sequence header %q does not fit the header format %q (see --header-format)", id, h.format)
+	}
+	field := func(name string) string {
+		if i := h.re.SubexpIndex(name); i >= 0 {
+			return m[i]
+		}
+		return ""
+	}
+	position := func(name string) int {
+		s := field(name)
+		if s == "" {
+			return 0
+		}
+		pos, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("sequence header %q has %s %q, which is not a position on the genome", id, name, s)
+		}
+		return pos
+	}
+	hd.gene = field("gene")
+	hd.start = position("start")
+	hd.stop = position("stop")
+	hd.strain = field("strain")
+	if hd.gene == "" || hd.strain == "" {
+		log.Fatalf("sequence header %q has no gene or strain name in the header format %q", id, h.format)
+	}
+	return
+}
@@ -17,38 +17,44 @@ package main
 //script written by Asher Preska Steinberg (apsteinberg@nyu.edu)
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/kussell-lab/biogo/seq"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
 
 // global variables.
 func main() {
-	app := kingpin.New("makeGeneDB", "Convert XMFA file into boltdb files for each gene.")
+	app := kingpin.New("makeGeneDB", "Convert XMFA file into a single boltdb codon store.")
 	app.Version("v20211003")
 
 	alnFile := app.Arg("aln", "Alignment file in XMFA format.").Required().String()
+	outDir := app.Flag("out-dir", "Directory to write the codon store and manifest to.").Default(".").String()
+	prefix := app.Flag("prefix", "Name of the codon store (written as <out-dir>/<prefix>.db).").Default("codon_store").String()
+	manifest := app.Flag("manifest", "Manifest path (default: <out-dir>/<prefix>.manifest.json).").Default("").String()
 	//outPrefix := app.Arg("out", "Output prefix.").Required().String()
 	//minl := app.Flag("min-corr-length", "min distance of correlation (base pairs)").Default("0").Int()
 	//maxl := app.Flag("max-corr-length", "Max distance of correlation (base pairs)").Default("0").Int()
 	//mateAln := app.Flag("mate-aln", "Second alignment for calculating between clades").Default("").String()
+	duplicateNames := app.Flag("duplicate-names", "what to do with a strain name which appears more than once in a CDS region: rename the copies in order (<name>_1, ...), error, keep-first or keep-longest").Default("rename").Enum(duplicatePolicies...)
+	headerFormat := app.Flag("header-format", "format of the XMFA sequence headers: a template of {gene}, {start}, {stop}, {strain} and {_} (any text), or a regular expression with those named groups").Default(defaultHeaderFormat).String()
 	ncpu := app.Flag("num-cpu", "Number of CPUs (default: using all available cores)").Default("0").Int()
 	//mates := app.Flag("between-clades", "just calculate correlations between pairs from different xmfa files").Default("false").Bool()
 	//numDigesters := app.Flag("num-threads", "number of threads").Default("50").Int()
 	//showProgress := app.Flag("show-progress", "Show progress").Bool()
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	headers = newHeaderFormat(*headerFormat, "stop")
 
 	if *ncpu <= 0 {
 		*ncpu = runtime.NumCPU()
@@ -68,6 +74,14 @@ func main() {
 	//codonPos := 3
 	codonOffset := 0
 
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	storeFile := filepath.Join(*outDir, *prefix+".db")
+	if *manifest == "" {
+		*manifest = manifestFile(storeFile)
+	}
+
 	// make a list of starting positions so we know how to order things and
 	// dump the alignments into a map with starting positions as keys
 	var startSlice []int
@@ -77,42 +91,49 @@ func main() {
 		startPos, _ := getStartStop(a)
 		startSlice = append(startSlice, startPos)
 	}
-	//make the codon databases ...
-
 	//sort the slice numerically
 	sort.Ints(startSlice)
-	print(startSlice)
-	//get the number of codons ....
 
-	// now go through and make a map of codon sequences
-	// where we add on codons to the end of each strain sequence
+	// now go through each gene and add its codons onto the end of the store
 	fmt.Print("fetching CDS regions\n")
-	//make codon databases
-	numSeqs, numCodons, startCodons, _ := makeCodonDB(startSlice, *alnFile, codonOffset)
+	store := createCodonStore(storeFile)
+	defer store.Close()
+	loadCodonStore(store, startSlice, *alnFile, codonOffset, *duplicateNames)
+	store.Meta.GeneticCode = "11"
+	store.Meta.SourceSHA256 = hashFiles(*alnFile)
+	prov := newProvenance(app, "")
+	prov.Set("genetic-code", store.Meta.GeneticCode)
+	prov.Set("num-strains", len(store.Meta.Strains))
+	prov.Set("num-codons", store.Meta.NumCodons)
+	prov.Set("input-sha256", store.Meta.SourceSHA256)
+	store.Meta.Provenance = prov.Lines()
+	store.WriteMeta()
+	store.WriteManifest(*manifest)
 
 	fmt.Print("done fetching CDS regions\n")
 
-	writeCodonStartList(startCodons)
-
-	fmt.Printf("total number of strains: %d\n", numSeqs)
+	fmt.Printf("total number of strains: %d\n", len(store.Meta.Strains))
 
-	fmt.Printf("total number of codons: %d\n", numCodons)
+	fmt.Printf("total number of codons: %d\n", store.Meta.NumCodons)
+	fmt.Printf("wrote %s and %s\n", storeFile, *manifest)
 
 	duration := time.Since(start)
 	fmt.Println("Time to make gene db files:", duration)
 }
 
-func makeSeqMap(startSlice []int, alnFile string, codonOffset int) (seqMap map[string][]Codon) {
+func makeSeqMap(startSlice []int, alnFile string, codonOffset int, policy string) (seqMap map[string][]Codon) {
 	seqMap = make(map[string][]Codon)
+	chooseLongestCopies(policy, alnFile)
 	for _, i := range startSlice {
 		a, _ := getGene(alnFile, i)
-		addCodons(a, seqMap, codonOffset)
+		addCodons(a, seqMap, codonOffset, policy)
 	}
 	return seqMap
 }
 
-func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int) (seqMap map[string][]Codon) {
+func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int, policy string) (seqMap map[string][]Codon) {
 	seqMap = make(map[string][]Codon)
+	chooseLongestCopies(policy, alnFile, mateAln)
 	for _, i := range startSlice {
 		// get the gene alignment from the first file
 		aln1, _ := getGene(alnFile, i)
@@ -120,7 +141,7 @@ func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int)
 		aln2, _ := getGene(mateAln, i)
 		// add on the alignment 2 sequences onto alignment 1
 		aln1.Sequences = append(aln1.Sequences, aln2.Sequences...)
-		addCodons(aln1, seqMap, codonOffset)
+		addCodons(aln1, seqMap, codonOffset, policy)
 	}
 	return seqMap
 }
@@ -141,17 +162,14 @@ func getGene(alnFile string, startCodon int) (gene Alignment, stopPos int) {
 
 // getStartStop get start/stop positions for each gene
 func getStartStop(aln Alignment) (int, int) {
-	genomePos := aln.genePos
-	terms := strings.Split(genomePos, "+")
-	startPos, _ := strconv.Atoi(terms[0])
-	stopPos, _ := strconv.Atoi(terms[1])
-	return startPos, stopPos
+	return aln.start, aln.stop
 }
 
 // Alignment is an array of mutliple sequences with same length.
 type Alignment struct {
 	ID        string //gene ID
-	genePos   string // position of gene on the genome
+	start     int    // position of gene on the genome
+	stop      int
 	Sequences []seq.Sequence
 }
 
@@ -173,10 +191,8 @@ func readAlignments(file string) (alnChan chan Alignment) {
 
 		c := readXMFA(file)
 		for alignment := range c {
-			header := strings.Split(alignment[0].Id, " ")
-			alnID := header[0]
-			genomePos := header[1]
-			alnChan <- Alignment{ID: alnID, genePos: genomePos, Sequences: alignment}
+			header := headers.parse(alignment[0].Id)
+			alnChan <- Alignment{ID: header.gene, start: header.start, stop: header.stop, Sequences: alignment}
 		}
 	}()
 
@@ -232,242 +248,110 @@ func mustOpen(file string) (f *os.File) {
 	return
 }
 
+//getNames reads the gene and strain names from a sequence header (see --header-format)
 func getNames(s string) (geneName, genomeName string) {
-	terms := strings.Split(s, " ")
-	//this is the genomeName for the MSA files assembled from ReferenceAlignmentGenerator
-	geneName = terms[0]
-	genomeName = terms[2]
-	return
+	header := headers.parse(s)
+	return header.gene, header.strain
 }
 
-//addCodons adds codons to each strain sequence in the sequence map
-func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int) {
+//addCodons adds codons to each strain sequence in the sequence map, keeping or renaming strains
+//which appear more than once according to the duplicate-name policy, and returns those duplicates
+func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int, policy string) []strainDuplicate {
+	seqs, names, dups := uniqueStrains(a, policy)
+	reportDuplicates(dups)
 	//add codons to the map for each sequence
 	var wg sync.WaitGroup
 	//tell wg how many threads will be running concurrently
-	wg.Add(len(a.Sequences))
+	wg.Add(len(seqs))
 	//mutex lock for safe access to seqMap
 	var mutex = &sync.Mutex{}
-	alnSeqs := a.Sequences
-	//give duplicate strain names a suffix to differentiate
-	duplicates := make(map[string]int)
-	for j := 0; j < len(alnSeqs); j++ {
+	for j := 0; j < len(seqs); j++ {
 		go func(j int) {
 			defer wg.Done()
-			s := alnSeqs[j]
-			codons := extractCodons(s, codonOffset)
-			_, seqName := getNames(s.Id)
-			//check if the strain name has been done ...
-			mutex.Lock()
-			i, found := duplicates[seqName]
-			//update the count for the strain
-			duplicates[seqName]++
-			mutex.Unlock()
-			if found {
-				id := strconv.Itoa(i)
-				seqName = seqName + "_" + id
-			}
+			codons := extractCodons(seqs[j], codonOffset)
 			mutex.Lock()
-			seqMap[seqName] = append(seqMap[seqName], codons...)
+			seqMap[names[j]] = append(seqMap[names[j]], codons...)
 			mutex.Unlock()
 		}(j)
 	}
 	wg.Wait()
+	return dups
 }
 
-//makeStrainMap maps codons to strains
-func makeStrainMap(a Alignment, codonOffset int) (strainMap map[string][]Codon) {
-	strainMap = make(map[string][]Codon)
-	//add codons to the map for each sequence
-	var wg sync.WaitGroup
-	//tell wg how many threads will be running concurrently
-	wg.Add(len(a.Sequences))
-	//mutex lock for safe access to seqMap
-	var mutex = &sync.Mutex{}
-	alnSeqs := a.Sequences
-	//give duplicate strain names a suffix to differentiate
-	duplicates := make(map[string]int)
-	for j := 0; j < len(alnSeqs); j++ {
-		go func(j int) {
-			defer wg.Done()
-			s := alnSeqs[j]
-			codons := extractCodons(s, codonOffset)
-			_, seqName := getNames(s.Id)
-			//check if the strain name has been done ...
-			mutex.Lock()
-			i, found := duplicates[seqName]
-			//update the count for the strain
-			duplicates[seqName]++
-			mutex.Unlock()
-			if found {
-				id := strconv.Itoa(i)
-				seqName = seqName + "_" + id
+// loadCodonStore adds the codons of each gene to the codon store, with one column
+// per codon position holding the codons of all strains in a fixed strain order.
+// The strain list is every strain in any gene; strains missing from a gene are filled in with gaps
+// so that the columns stay aligned, and are listed with the gene in the manifest.
+func loadCodonStore(store *CodonStore, startSlice []int, alnFile string, codonOffset int, policy string) {
+	chooseLongestCopies(policy, alnFile)
+	//the strain list holds every strain in any CDS region, after the duplicate-name policy
+	known := make(map[string]bool)
+	var strainList []string
+	for a := range readAlignments(alnFile) {
+		_, names, _ := uniqueStrains(a, policy)
+		for _, strain := range names {
+			if !known[strain] {
+				known[strain] = true
+				strainList = append(strainList, strain)
 			}
-			mutex.Lock()
-			strainMap[seqName] = append(strainMap[seqName], codons...)
-			mutex.Unlock()
-		}(j)
-	}
-	wg.Wait()
-	return
-}
-
-// makeCodonMap assembles the codons of each gene into a map where keys are codon positions
-// and the values are all of the codons for each sequence
-// in the order defined by strain list
-func makeCodonMap(strainMap map[string][]Codon, startCodon int, strainList []string) (codonMap map[int][]Codon) {
-	//add codons for each sequences to a map where the keys are codon positions and the values
-	// are the codon sequence for each position
-	codonMap = make(map[int][]Codon)
-	for _, strain := range strainList {
-		codonSeq := strainMap[strain]
-		for k, cc := range codonSeq {
-			codonPos := startCodon + k
-			codonMap[codonPos] = append(codonMap[codonPos], cc)
 		}
 	}
-	return
-}
-
-// makeCodonDB makes a keymap database for each codon position
-//and return a list of databases ...
-func makeCodonDB(startSlice []int, alnFile string, codonOffset int) (numSeqs int, numCodons int, startCodons []int, dbMap map[int]*bolt.DB) {
+	sort.Strings(strainList)
 	startCodon := 0
-	var codonMap map[int][]Codon
-	dbMap = make(map[int]*bolt.DB)
-	var strainList []string
 	for _, startPos := range startSlice {
 		a, stopPos := getGene(alnFile, startPos)
-		strainMap := makeStrainMap(a, codonOffset)
-		if startCodon == 0 {
-			for strain, _ := range strainMap {
-				strainList = append(strainList, strain)
+		strainMap := make(map[string][]Codon)
+		addCodons(a, strainMap, codonOffset, policy)
+		//get the length of the cds in codons ...
+		cdslen := 0
+		for _, codons := range strainMap {
+			if len(codons) > cdslen {
+				cdslen = len(codons)
 			}
 		}
-		codonMap = makeCodonMap(strainMap, startCodon, strainList)
-		//make the name of the database
-		dbName := strconv.Itoa(startCodon)
-		db := createDB(dbName + ".db")
-		createBucket(db, "codons")
-		loadCodons(db, "codons", codonMap)
-		dbMap[startCodon] = db
-		db.Close()
-		//add to start codon slice
-		startCodons = append(startCodons, startCodon)
-		//calculate the first codon position in the next db
-		//get the length of the cds in codons ...
-		cdslen := (stopPos - startPos + 1) / 3
-		startCodon = startCodon + cdslen
-		//fmt.Print(strconv.Itoa(startCodon)+"\n")
-
-	}
-	//startCodons = append(startCodons, startCodon)
-	for _, v := range codonMap {
-		numSeqs = len(v)
-	}
-	numCodons = startCodon
-	return
-}
-
-type codonDB struct {
-	db         *bolt.DB
-	startCodon int
-}
-
-// createDB creates a bolt db.
-func createDB(dbFile string) *bolt.DB {
-	db, err := bolt.Open(dbFile, 0600, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return db
-}
-
-// createBucket creates a bucket.
-func createBucket(db *bolt.DB, bucketName string) {
-	fn := func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		return err
-	}
-
-	err := db.Update(fn)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func loadCodons(db *bolt.DB, bucketName string, codonMap map[int][]Codon) {
-	fn := func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		for pos, codon := range codonMap {
-			//codon position
-			codonPos := strconv.Itoa(pos)
-			//if pos == 5000 {
-			//	print("mammajamma")
-			//}
-			//all of the alleles of the codon for that position
-			codonBytes := CodonstoBytes(codon, 0)
-			err := b.Put([]byte(codonPos), codonBytes)
-			if err != nil {
-				return err
+		gap := Codon("---")
+		columns := make([][]Codon, cdslen)
+		var gapFilled []string
+		for _, strain := range strainList {
+			codonSeq, found := strainMap[strain]
+			if !found {
+				gapFilled = append(gapFilled, strain)
+			}
+			for k := 0; k < cdslen; k++ {
+				if k < len(codonSeq) {
+					columns[k] = append(columns[k], codonSeq[k])
+				} else {
+					columns[k] = append(columns[k], gap)
+				}
 			}
 		}
-
-		return nil
-	}
-
-	err := db.Update(fn)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func getCodons(db *bolt.DB, pos int) (codons []Codon) {
-	fn := func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("codons"))
-		codonPos := strconv.Itoa(pos)
-		v := b.Get([]byte(codonPos))
-		codons = BytestoCodons(v, 0)
-
-		return nil
-	}
-
-	db.View(fn)
-
-	return
-}
-
-// BytestoCodons convert bytes back to codons
-func BytestoCodons(s []byte, offset int) (codons []Codon) {
-	for i := offset; i+3 <= len(s); i += 3 {
-		c := s[i:(i + 3)]
-		codons = append(codons, c)
-	}
-	return
-}
-
-// CodonstoBytes convert codons to bytes
-func CodonstoBytes(codons []Codon, offset int) (s []byte) {
-	for _, cc := range codons {
-		s = append(s, cc...)
+		store.PutCodons(startCodon, columns)
+		g := GeneRegion{
+			ID:         a.ID,
+			Start:      startPos,
+			Stop:       stopPos,
+			StartCodon: startCodon,
+			NumCodons:  cdslen,
+			GapFilled:  gapFilled,
+		}
+		g.ReportGapFilled()
+		store.Meta.Genes = append(store.Meta.Genes, g)
+		//calculate the first codon position in the next gene
+		startCodon = startCodon + cdslen
 	}
-	return
+	store.Meta.Strains = strainList
+	store.Meta.NumCodons = startCodon
 }
 
-//writeCodonStartList writes codon starts to a list so we know the names of the boltdb files
-func writeCodonStartList(sampledata []int) {
-	file, err := os.Create("gene_boltdb_list.txt")
-
-	if err != nil {
-		log.Fatalf("failed creating file: %s", err)
-	}
-
-	datawriter := bufio.NewWriter(file)
-
-	for _, data := range sampledata {
-		_, _ = datawriter.WriteString(strconv.Itoa(data) + "\n")
+// hashFiles returns the sha256 checksum of the input files.
+func hashFiles(files ...string) string {
+	h := sha256.New()
+	for _, file := range files {
+		f := mustOpen(file)
+		if _, err := io.Copy(h, f); err != nil {
+			log.Fatalf("Error when reading file %s: %v", file, err)
+		}
+		f.Close()
 	}
-
-	datawriter.Flush()
-	file.Close()
+	return hex.EncodeToString(h.Sum(nil))
 }
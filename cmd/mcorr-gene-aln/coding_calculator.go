@@ -31,17 +31,19 @@ type Calculator interface {
 // CodingCalculator for calculating coding sequences.
 type CodingCalculator struct {
 	CodingTable   *taxonomy.GeneticCode
-	MaxCodonLen   int
+	Lags          lagSet
 	CodonOffset   int
 	CodonPosition int
 	Synonymous    bool
+	Genes         []geneBounds   // genes within the alignment, to split each profile into its intragenic and intergenic parts
+	Split         *splitProfiles // collects the split profiles, if there are genes
 }
 
 // NewCodingCalculator return a CodingCalculator
-func NewCodingCalculator(codingTable *taxonomy.GeneticCode, maxCodonLen, codonOffset int, codonPosition int, synonymous bool) *CodingCalculator {
+func NewCodingCalculator(codingTable *taxonomy.GeneticCode, lags lagSet, codonOffset int, codonPosition int, synonymous bool) *CodingCalculator {
 	return &CodingCalculator{
 		CodingTable:   codingTable,
-		MaxCodonLen:   maxCodonLen,
+		Lags:          lags,
 		CodonOffset:   codonOffset,
 		CodonPosition: codonPosition,
 		Synonymous:    synonymous,
@@ -50,49 +52,74 @@ func NewCodingCalculator(codingTable *taxonomy.GeneticCode, maxCodonLen, codonOf
 
 // CalcP2 calculate P2
 func (cc *CodingCalculator) CalcP2(a Alignment, others ...Alignment) mcorr.CorrResults {
-	results := calcP2Coding(a, cc.CodonOffset, cc.CodonPosition, cc.MaxCodonLen, cc.CodingTable, cc.Synonymous)
+	var geneIdx []int
+	if cc.Split != nil {
+		geneIdx = geneIndex(cc.Genes, len(a.Sequences[0].Seq)/3, cc.CodonOffset, cc.CodonPosition)
+	}
+	results, intragenic, intergenic := calcP2Coding(a, cc.CodonOffset, cc.CodonPosition, cc.Lags, cc.CodingTable, cc.Synonymous, geneIdx)
+	if cc.Split != nil {
+		cc.Split.add(a.ID, splitProfile{results, intragenic, intergenic})
+	}
 	return mcorr.CorrResults{ID: a.ID, Results: results}
 }
 
-func calcP2Coding(aln Alignment, codonOffset, codonPosition, maxCodonLen int, codingTable *taxonomy.GeneticCode, synonymous bool) (results []mcorr.CorrResult) {
+// calcP2Coding calculates the profile of the alignment, along with its intragenic and intergenic
+// parts if geneIdx gives the gene of each codon; site pairs with a site outside the genes are in neither part.
+// The site pairs of each pool of lags are summed up into one result, at the first lag of the pool.
+func calcP2Coding(aln Alignment, codonOffset, codonPosition int, lags lagSet, codingTable *taxonomy.GeneticCode, synonymous bool,
+	geneIdx []int) (results, intragenic, intergenic []mcorr.CorrResult) {
 	codonSequences := [][]Codon{}
 	for _, s := range aln.Sequences {
 		codons := extractCodons(s, codonOffset)
 		codonSequences = append(codonSequences, codons)
 	}
+	qs := func(l int, xy float64, n int) mcorr.CorrResult {
+		return mcorr.CorrResult{Lag: l * 3, Mean: xy / float64(n), N: n, Type: "P2"}
+	}
 	//ks := 1.0
 	//nn := 0
-	for l := 0; l < maxCodonLen; l++ {
+	for _, label := range lags.labels {
 		totalP2 := 0.0
 		totaln := 0
+		var intraP2, interP2 float64
+		var intran, intern int
 		// while this speeds up the code slightly, causes a minor bug when there
 		//are identical sequences loaded
 		//if l > 0 && ks == 0.0 {
 		//	totalP2 = 0.0
 		//	totaln = nn
 		//} else {
-		for i := 0; i+l < len(codonSequences[0]); i++ {
-			codonPairs := []CodonPair{}
-			j := i + l
-			for _, cc := range codonSequences {
-				if i+l < len(cc) {
-					codonPairs = append(codonPairs, CodonPair{A: cc[i], B: cc[j]})
+		for _, l := range lags.pools[label] {
+			for i := 0; i+l < len(codonSequences[0]); i++ {
+				codonPairs := []CodonPair{}
+				j := i + l
+				for _, cc := range codonSequences {
+					if i+l < len(cc) {
+						codonPairs = append(codonPairs, CodonPair{A: cc[i], B: cc[j]})
+					}
 				}
-			}
-
-			multiCodonPairs := [][]CodonPair{}
-			if synonymous {
-				multiCodonPairs = synonymousSplit(codonPairs, codingTable)
-			} else {
-				multiCodonPairs = append(multiCodonPairs, codonPairs)
-			}
-			for _, codonPairs := range multiCodonPairs {
-				if len(codonPairs) >= 2 {
-					nc := doubleCodons(codonPairs, codonPosition)
-					xy, n := nc.P11(0)
-					totalP2 += xy
-					totaln += n
 
+				multiCodonPairs := [][]CodonPair{}
+				if synonymous {
+					multiCodonPairs = synonymousSplit(codonPairs, codingTable)
+				} else {
+					multiCodonPairs = append(multiCodonPairs, codonPairs)
+				}
+				for _, codonPairs := range multiCodonPairs {
+					if len(codonPairs) >= 2 {
+						nc := doubleCodons(codonPairs, codonPosition)
+						xy, n := nc.P11(0)
+						totalP2 += xy
+						totaln += n
+						if geneIdx != nil && geneIdx[i] >= 0 && geneIdx[i] == geneIdx[j] {
+							intraP2 += xy
+							intran += n
+						} else if geneIdx != nil && geneIdx[i] >= 0 && geneIdx[j] >= 0 {
+							interP2 += xy
+							intern += n
+						}
+
+					}
 				}
 			}
 		}
@@ -104,13 +131,19 @@ func calcP2Coding(aln Alignment, codonOffset, codonPosition, maxCodonLen int, co
 		//}
 		if totaln > 0 {
 			res1 := mcorr.CorrResult{
-				Lag:  l * 3,
+				Lag:  label * 3,
 				Mean: totalP2 / float64(totaln),
 				N:    totaln,
 				Type: "P2",
 			}
 			results = append(results, res1)
 		}
+		if intran > 0 {
+			intragenic = append(intragenic, qs(label, intraP2, intran))
+		}
+		if intern > 0 {
+			intergenic = append(intergenic, qs(label, interP2, intern))
+		}
 	}
 
 	return
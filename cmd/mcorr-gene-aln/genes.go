@@ -0,0 +1,174 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kussell-lab/mcorr"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// geneBounds is a gene within the alignment, from start to stop (1-based, inclusive).
+type geneBounds struct {
+	ID          string
+	start, stop int
+}
+
+// readGenes reads the genes from a .csv file with the columns gene, start and stop
+// (such as the .genes.csv output of mcorrViralGenome); lines starting with # are skipped.
+func readGenes(file string) (genes []geneBounds) {
+	f := mustOpen(file)
+	defer f.Close()
+	var cols map[string]int
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if cols == nil {
+			cols = make(map[string]int)
+			for i, name := range fields {
+				cols[strings.TrimSpace(name)] = i
+			}
+			for _, name := range []string{"gene", "start", "stop"} {
+				if _, found := cols[name]; !found {
+					log.Fatalf("%s has no column %s", file, name)
+				}
+			}
+			continue
+		}
+		field := func(name string) string {
+			if cols[name] >= len(fields) {
+				log.Fatalf("line %d of %s has no %s", line, file, name)
+			}
+			return strings.TrimSpace(fields[cols[name]])
+		}
+		start, err1 := strconv.Atoi(field("start"))
+		stop, err2 := strconv.Atoi(field("stop"))
+		if err1 != nil || err2 != nil || start < 1 || stop < start {
+			log.Fatalf("line %d of %s does not give a gene's start and stop positions", line, file)
+		}
+		genes = append(genes, geneBounds{ID: field("gene"), start: start, stop: stop})
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Error when reading %s: %v", file, err)
+	}
+	if len(genes) == 0 {
+		log.Fatalf("%s has no genes", file)
+	}
+	return
+}
+
+// geneIndex returns the index in genes of the gene holding each of numCodons codons, placed by the
+// nucleotide at codonPosition, or -1 outside the genes; a codon in overlapping genes is in the first one.
+func geneIndex(genes []geneBounds, numCodons, codonOffset, codonPosition int) []int {
+	index := make([]int, numCodons)
+	for k := range index {
+		index[k] = -1
+		pos := codonOffset + 3*k + codonPosition + 1
+		for g, gene := range genes {
+			if pos >= gene.start && pos <= gene.stop {
+				index[k] = g
+				break
+			}
+		}
+	}
+	return index
+}
+
+// splitProfile is the profile of an alignment along with its intragenic part, from site pairs
+// within one gene, and its intergenic part, from site pairs across two genes.
+type splitProfile struct {
+	all, intragenic, intergenic []mcorr.CorrResult
+}
+
+// splitProfiles collects the split profile of each alignment, as they are calculated in parallel.
+type splitProfiles struct {
+	mu       sync.Mutex
+	profiles map[string]splitProfile
+}
+
+func newSplitProfiles() *splitProfiles {
+	return &splitProfiles{profiles: make(map[string]splitProfile)}
+}
+
+func (s *splitProfiles) add(id string, p splitProfile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles[id] = p
+}
+
+// Write writes the split profiles to a .csv file in long format, one row per part, lag and bootstrap,
+// starting with all alignments; the P2 of all parts are divided by the d_sample of the whole alignment.
+func (s *splitProfiles) Write(outFile string, prov *provenance) {
+	w, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	prov.WriteHeader(w)
+	w.WriteString("# part: all site pairs, or those within one gene (intragenic) or across two genes (intergenic)\n")
+	w.WriteString("# l: the distance between two genomic positions\n")
+	w.WriteString("# m: the mean value of correlation profile\n")
+	w.WriteString("# v: the variance of correlation profile\n")
+	w.WriteString("# n: the total number of codon pairs used for calculation\n")
+	w.WriteString("# t: the type of result: Ks is for d_sample, and P2 is for correlation profile\n")
+	w.WriteString("# b: the bootstrap number (all means used all alignments).\n")
+	w.WriteString("part,l,m,v,n,t,b\n")
+
+	var ids []string
+	for id := range s.profiles {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bootOrder(ids[i]) < bootOrder(ids[j]) })
+	for _, id := range ids {
+		p := s.profiles[id]
+		var ds float64
+		for _, res := range p.all {
+			if res.Lag == 0 {
+				ds = res.Mean
+			}
+		}
+		for _, part := range []struct {
+			name    string
+			results []mcorr.CorrResult
+		}{{"all", p.all}, {"intragenic", p.intragenic}, {"intergenic", p.intergenic}} {
+			for _, res := range part.results {
+				m, t := res.Mean, "Ks"
+				if res.Lag > 0 {
+					m, t = m/ds, "P2"
+				}
+				w.WriteString(fmt.Sprintf("%s,%d,%g,%g,%d,%s,%s\n", part.name, res.Lag, m, res.Variance, res.N, t, id))
+			}
+		}
+	}
+}
+
+// bootOrder puts all alignments before the bootstraps, which are in order of number.
+func bootOrder(id string) int {
+	if n, err := strconv.Atoi(strings.TrimPrefix(id, "boot_")); err == nil && strings.HasPrefix(id, "boot_") {
+		return n
+	}
+	return -1
+}
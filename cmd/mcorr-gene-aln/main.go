@@ -39,11 +39,15 @@ func main() {
 	outPrefix := app.Arg("out", "Output prefix.").Required().String()
 
 	maxl := app.Flag("max-corr-length", "Maximum distance of correlation (nucleotides)").Default("300").Int()
+	lagSpec := app.Flag("lags", "lags to calculate (nucleotides) instead of 0 to --max-corr-length: a comma-separated list of lags, ranges <min>:<max>[:<step>] and log:<min>:<max>:<n> (n lags evenly spaced on a log scale)").Default("").String()
+	lagBin := app.Flag("lag-bin", "pool the lags into bins of this width (nucleotides), giving one result per bin with the pooled n (0: no pooling)").Default("0").Int()
 	ncpu := app.Flag("num-cpu", "Number of CPUs (default: using all available cores)").Default("0").Int()
 	numBoot := app.Flag("num-boot", "Number of bootstrapping on genomes").Default("1000").Int()
 	showProgress := app.Flag("show-progress", "Show progress").Bool()
+	genesFile := app.Flag("genes", ".csv file of the genes within the alignment (columns gene, start and stop; 1-based positions), to split the profile into its intragenic and intergenic parts in <out>.split.csv").Default("").String()
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	prov := newProvenance(app, "")
 
 	//start timer
 
@@ -71,6 +75,10 @@ func main() {
 	synonymous := true
 	codonPos := 3
 	codonOffset := 0
+	prov.Set("genetic-code", "11")
+	prov.Set("synonymous", synonymous)
+	prov.Set("codon-position", codonPos)
+	prov.Set("input-sha256", hashFiles(*alnFile))
 
 	var alnChan chan Alignment
 	if bar == nil {
@@ -88,12 +96,22 @@ func main() {
 			}
 		}()
 	}
-	calculator = NewCodingCalculator(codingTable, maxCodonLen, codonOffset, codonPos-1, synonymous)
+	lags := newLagSet(*lagSpec, 0, maxCodonLen, *lagBin/3)
+	cc := NewCodingCalculator(codingTable, lags, codonOffset, codonPos-1, synonymous)
+	if *genesFile != "" {
+		cc.Genes = readGenes(*genesFile)
+		cc.Split = newSplitProfiles()
+	}
+	calculator = cc
 	corrResChan := calcSingleClade(alnChan, calculator)
 	//what's in the json is actually Qs NOT P2!
 	resChan := mcorr.PipeOutCorrResults(corrResChan, *outPrefix+".json")
 	//division by d_sample or P2 is not until here!!!
-	WriteResults(resChan, *outPrefix+".csv")
+	WriteResults(resChan, *outPrefix+".csv", prov)
+	prov.WriteSidecar(*outPrefix + ".json")
+	if cc.Split != nil {
+		cc.Split.Write(*outPrefix+".split.csv", prov)
+	}
 
 	//total time to complete ...
 	duration := time.Since(start)
@@ -242,7 +260,7 @@ func mustOpen(file string) (f *os.File) {
 }
 
 // WriteResults writes correlation results of the original sample and the bootstraps to a .csv file
-func WriteResults(corrResChan chan mcorr.CorrResults, outFile string) {
+func WriteResults(corrResChan chan mcorr.CorrResults, outFile string, prov *provenance) {
 
 	w, err := os.Create(outFile)
 	if err != nil {
@@ -250,6 +268,8 @@ func WriteResults(corrResChan chan mcorr.CorrResults, outFile string) {
 	}
 	defer w.Close()
 
+	prov.WriteHeader(w)
+
 	w.WriteString("# l: the distance between two genomic positions\n")
 	w.WriteString("# m: the mean value of correlation profile\n")
 	w.WriteString("# v: the variance of correlation profile\n")
@@ -16,26 +16,27 @@ package main
 
 import (
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/kussell-lab/mcorr"
 	"github.com/kussell-lab/ncbiftp/taxonomy"
 	"gopkg.in/cheggaaa/pb.v2"
 	"os"
-	"strconv"
 	"sync"
 )
 
+//codonBlockSize is the number of initial positions read from the codon store at once
+const codonBlockSize = 1024
+
 //calcQsAll calculates all lags in a multithreaded fashion, good for large datasets ...
-func calcQsAll(db *bolt.DB, codonOffset, codonPosition, maxCodonLen, numCodons int,
+func calcQsAll(store *CodonStore, firstCodon, codonOffset, codonPosition int, lags lagSet, numCodons int,
 	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, numDigesters int, bar *pb.ProgressBar) {
 	done := make(chan struct{})
-	lagChan := makeLagChan(done, maxCodonLen)
+	lagChan := makeLagChan(done, lags)
 
 	c := make(chan mcorr.CorrResult)
 	var wg sync.WaitGroup
 	for i := 0; i < numDigesters; i++ {
 		wg.Add(1)
-		go calcQs(done, lagChan, c, db, synonymous, codingTable,
+		go calcQs(done, lagChan, c, store, firstCodon, lags, synonymous, codingTable,
 			codonPosition, numCodons, i, bar, &wg)
 	}
 
@@ -50,16 +51,16 @@ func calcQsAll(db *bolt.DB, codonOffset, codonPosition, maxCodonLen, numCodons i
 		resMap[res.Lag] = res
 	}
 	//now write to a csv file ....
-	writeCsvOut(outFile, resMap, maxCodonLen)
+	writeCsvOut(outFile, resMap, lags)
 
 }
 
-//makeLagChan returns a channel of lags
-func makeLagChan(done <-chan struct{}, maxCodonLen int) <-chan int {
+//makeLagChan returns a channel of lags (the first lag of each pool)
+func makeLagChan(done <-chan struct{}, lags lagSet) <-chan int {
 	lagChan := make(chan int)
 	go func() {
 		defer close(lagChan)
-		for l := 0; l < maxCodonLen; l++ {
+		for _, l := range lags.labels {
 			select {
 			case lagChan <- l:
 			case <-done:
@@ -71,11 +72,14 @@ func makeLagChan(done <-chan struct{}, maxCodonLen int) <-chan int {
 
 //calcQs calculates Qs for a given lag across all positions
 func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- mcorr.CorrResult,
-	db *bolt.DB, synonymous bool, codingTable *taxonomy.GeneticCode, codonPosition, numCodons int,
+	store *CodonStore, firstCodon int, lags lagSet, synonymous bool, codingTable *taxonomy.GeneticCode, codonPosition, numCodons int,
 	id int, bar *pb.ProgressBar, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for l := range lagChan {
-		corrRes := calcCorrRes(db, codonPosition, l, numCodons, codingTable, synonymous)
+		corrRes := calcCorrRes(store, firstCodon, codonPosition, l, numCodons, codingTable, synonymous)
+		for _, pooled := range lags.pools[l][1:] {
+			corrRes = poolCorrRes(corrRes, calcCorrRes(store, firstCodon, codonPosition, pooled, numCodons, codingTable, synonymous))
+		}
 		select {
 		case resChan <- corrRes:
 			if bar != nil {
@@ -87,19 +91,29 @@ func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- mcorr.CorrR
 	}
 }
 
-func calcCorrRes(db *bolt.DB, codonPosition, lag int, numCodons int,
+//calcCorrRes calculates P2 at a lag for the numCodons codons of the store starting at firstCodon
+func calcCorrRes(store *CodonStore, firstCodon, codonPosition, lag int, numCodons int,
 	codingTable *taxonomy.GeneticCode, synonymous bool) (corrRes mcorr.CorrResult) {
 	//l is lag
 	l := lag
 	totalP2 := 0.0
 	totaln := 0
+	//read the codons at both sites in blocks of initial positions
+	var blockA, blockB [][]Codon
+	blockStart := 0
 	for i := 0; i+l < numCodons; i++ {
+		if i == blockStart+len(blockA) {
+			blockStart = i
+			blockEnd := blockStart + codonBlockSize
+			if blockEnd+l > numCodons {
+				blockEnd = numCodons - l
+			}
+			blockA = store.ReadRange(firstCodon+blockStart, firstCodon+blockEnd)
+			blockB = store.ReadRange(firstCodon+blockStart+l, firstCodon+blockEnd+l)
+		}
 		codonPairs := []CodonPair{}
-		j := i + l
-		var codonsA []Codon
-		var codonsB []Codon
-		codonsA = getCodons(db, i)
-		codonsB = getCodons(db, j)
+		codonsA := blockA[i-blockStart]
+		codonsB := blockB[i-blockStart]
 
 		for p, codonA := range codonsA {
 			codonPairs = append(codonPairs, CodonPair{A: codonA, B: codonsB[p]})
@@ -153,36 +167,28 @@ func calcCorrRes(db *bolt.DB, codonPosition, lag int, numCodons int,
 	return corrRes
 }
 
-func getCodons(db *bolt.DB, pos int) (codons []Codon) {
-	fn := func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("codons"))
-		codonPos := strconv.Itoa(pos)
-		v := b.Get([]byte(codonPos))
-		codons = BytestoCodons(v, 0)
-
-		return nil
+//poolCorrRes adds the result of another lag to the result of a pool of lags, weighting the means by n
+func poolCorrRes(pool, other mcorr.CorrResult) mcorr.CorrResult {
+	if other.N == 0 {
+		return pool
 	}
-
-	db.View(fn)
-
-	return
-}
-
-// BytestoCodons convert bytes back to codons
-func BytestoCodons(s []byte, offset int) (codons []Codon) {
-	for i := offset; i+3 <= len(s); i += 3 {
-		c := s[i:(i + 3)]
-		codons = append(codons, c)
+	if pool.N == 0 {
+		other.Lag = pool.Lag
+		return other
 	}
-	return
+	n := pool.N + other.N
+	pool.Mean = (pool.Mean*float64(pool.N) + other.Mean*float64(other.N)) / float64(n)
+	pool.N = n
+	return pool
 }
 
-//initCsvOut initializes the output csv
-func initCsvOut(outFile string) {
+//initCsvOut initializes the output csv, starting with the provenance of the run
+func initCsvOut(outFile string, prov *provenance) {
 	w, err := os.Create(outFile)
 	if err != nil {
 		panic(err)
 	}
+	prov.WriteHeader(w)
 	w.WriteString("# l: the distance between two genomic positions\n")
 	w.WriteString("# m: the mean value of the correlation profile\n")
 	w.WriteString("# v: the variance of the correlation profile\n")
@@ -195,7 +201,7 @@ func initCsvOut(outFile string) {
 }
 
 //writeCsvOut writes results to the output csv
-func writeCsvOut(outFile string, results map[int]mcorr.CorrResult, maxCodonLen int) {
+func writeCsvOut(outFile string, results map[int]mcorr.CorrResult, lags lagSet) {
 	f, err := os.OpenFile(outFile, os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
 		panic(err)
@@ -205,8 +211,8 @@ func writeCsvOut(outFile string, results map[int]mcorr.CorrResult, maxCodonLen i
 	dsRes := results[0]
 	ds := dsRes.Mean
 	var Pab float64
-	i := 0
-	for i < maxCodonLen*3 {
+	for _, l := range lags.labels {
+		i := l * 3
 		res := results[i]
 		if i != 0 {
 			Pab = res.Mean / ds
@@ -216,6 +222,5 @@ func writeCsvOut(outFile string, results map[int]mcorr.CorrResult, maxCodonLen i
 
 		f.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n",
 			res.Lag, Pab, res.Variance, res.N, res.Type, "all"))
-		i = i + 3
 	}
 }
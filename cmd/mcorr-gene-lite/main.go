@@ -17,7 +17,6 @@ package main
 // script written by Asher Preska Steinberg (apsteinberg@nyu.edu)
 import (
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/kussell-lab/biogo/seq"
 	"github.com/kussell-lab/mcorr"
 	"github.com/kussell-lab/ncbiftp/taxonomy"
@@ -34,19 +33,22 @@ import (
 
 // global variables.
 func main() {
-	app := kingpin.New("mcorr-gene-lite", "Calculate mutation correlation from bacterial single gene alignments stored as boltdb files.")
+	app := kingpin.New("mcorr-gene-lite", "Calculate mutation correlation from bacterial single gene alignments stored as a codon store.")
 	app.Version("v20211015")
 
-	dbFile := app.Arg("in", "Alignment stored as boltdb file.").Required().String()
+	storeFile := app.Arg("in", "Alignment stored as a codon store (made by makeGeneDB), or its manifest.").Required().String()
 	outPrefix := app.Arg("out", "Output prefix.").Required().String()
 
-	maxl := app.Flag("max-corr-length", "Maximum distance of correlation (base pairs)").Default("300").Int()
+	geneName := app.Flag("gene", "CDS region in the store to use (default: the only one)").Default("").String()
+	maxl := app.Flag("max-corr-length", "Maximum distance of correlation (base pairs; default: the length of the gene)").Default("0").Int()
+	lagSpec := app.Flag("lags", "lags to calculate (base pairs) instead of 0 to --max-corr-length: a comma-separated list of lags, ranges <min>:<max>[:<step>] and log:<min>:<max>:<n> (n lags evenly spaced on a log scale)").Default("").String()
+	lagBin := app.Flag("lag-bin", "pool the lags into bins of this width (base pairs), writing one row per bin with the pooled n (0: no pooling)").Default("0").Int()
 	ncpu := app.Flag("num-cpu", "Number of CPUs (default: using all available cores)").Default("0").Int()
 	//numBoot := app.Flag("num-boot", "Number of bootstrapping on alleles").Default("0").Int()
 	numDigesters := app.Flag("num-threads", "number of threads").Default("8").Int()
 	showProgress := app.Flag("show-progress", "Show progress").Bool()
 
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	//start timer
 
@@ -57,47 +59,55 @@ func main() {
 	}
 	runtime.GOMAXPROCS(*ncpu)
 
-	codingTable := taxonomy.GeneticCodes()["11"]
-	maxCodonLen := *maxl / 3
-
-	// show progress bar?
-	var bar *pb.ProgressBar
-	if *showProgress {
-		//max := getNumberOfAlignments(*alnFile)
-		bar = pb.StartNew(maxCodonLen)
-		defer bar.Finish()
-	}
-
 	synonymous := true
 	codonPos := 3
 	codonOffset := 0
 
+	//open the codon store, and find the codons of the gene
+	_, store := openCodonInput(*storeFile)
+	defer store.Close()
+	gene := pickGene(store.Meta, *geneName, *storeFile)
+	gene.ReportGapFilled()
+	numCodons := gene.NumCodons
+	fmt.Printf("Total number of codons in %s: %d\n", gene.ID, numCodons)
+	codingTable, found := taxonomy.GeneticCodes()[store.Meta.GeneticCode]
+	if !found {
+		log.Fatalf("%s was made with unknown genetic code %q", *storeFile, store.Meta.GeneticCode)
+	}
+	if *maxl == 0 {
+		*maxl = numCodons * 3
+	}
+	maxCodonLen := *maxl / 3
+	if maxCodonLen > numCodons {
+		log.Fatalf("--max-corr-length %d is longer than the %d bp of %s", *maxl, numCodons*3, gene.ID)
+	}
+	lags := newLagSet(*lagSpec, 0, maxCodonLen, *lagBin/3)
+	if _, maxlag := lags.span(); maxlag > numCodons {
+		log.Fatalf("--lags %s goes beyond the %d bp of %s", *lagSpec, numCodons*3, gene.ID)
+	}
+
 	//initialize output csv
+	prov := newProvenance(app, command)
+	prov.Set("gene", gene.ID)
+	prov.Set("genetic-code", store.Meta.GeneticCode)
+	prov.Set("synonymous", synonymous)
+	prov.Set("codon-position", codonPos)
+	prov.Set("num-strains", len(store.Meta.Strains))
+	prov.Set("num-codons", numCodons)
+	prov.Set("input-sha256", store.Meta.SourceSHA256)
+	addSourceProvenance(prov, store.Meta.Provenance)
 	outFile := *outPrefix + ".csv"
-	initCsvOut(outFile)
+	initCsvOut(outFile, prov)
 
-	//open the database for usage, and determine the number of codons which are stored in there
-	db, err := bolt.Open(*dbFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		log.Fatal(err)
+	// show progress bar?
+	var bar *pb.ProgressBar
+	if *showProgress {
+		//max := getNumberOfAlignments(*alnFile)
+		bar = pb.StartNew(len(lags.labels))
+		defer bar.Finish()
 	}
-	defer db.Close()
-	//count of codons
-	numCodons := 0
-	db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
-		b := tx.Bucket([]byte("codons"))
-
-		c := b.Cursor()
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			//fmt.Printf("key=%s, value=%s\n", k, v)
-			numCodons++
-		}
 
-		return nil
-	})
-	fmt.Printf("Total number of codons: %d\n", numCodons)
-	calcQsAll(db, codonOffset, codonPos-1, maxCodonLen, numCodons,
+	calcQsAll(store, gene.StartCodon, codonOffset, codonPos-1, lags, numCodons,
 		codingTable, synonymous, outFile, *numDigesters, bar)
 
 	//total time to complete ...
@@ -105,6 +115,26 @@ func main() {
 	fmt.Println("Time to calculate correlation profiles:", duration)
 }
 
+// pickGene returns the CDS region called name in the store,
+// or the only CDS region if no name is given.
+func pickGene(meta StoreMeta, name, storeFile string) GeneRegion {
+	if name != "" {
+		gene, found := meta.Gene(name)
+		if !found {
+			log.Fatalf("%s has no CDS region called %s", storeFile, name)
+		}
+		return gene
+	}
+	if len(meta.Genes) != 1 {
+		var names []string
+		for _, g := range meta.Genes {
+			names = append(names, g.ID)
+		}
+		log.Fatalf("%s has %d CDS regions; pick one with --gene (%s)", storeFile, len(meta.Genes), strings.Join(names, ", "))
+	}
+	return meta.Genes[0]
+}
+
 // Alignment is an array of mutliple sequences with same length.
 type Alignment struct {
 	ID        string
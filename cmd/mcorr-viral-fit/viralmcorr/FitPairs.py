@@ -78,7 +78,7 @@ def main():
     # title=""
     # calculate the pair averaged correlation profile and add it to the corr file ....
     # may take this bit out ...
-    corrdat = pd.read_csv(corr_file)
+    corrdat = pd.read_csv(corr_file, comment='#')
     corrdat = corrdat[corrdat["b"] != "all"].copy()
     grouped = corrdat.groupby('l').mean()
     meancorr = grouped.reset_index()
@@ -0,0 +1,51 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	file, outFile := filepath.Join(dir, "out.checkpoint"), filepath.Join(dir, "out.csv")
+	params := []string{"program=test", "max-corr-length=9"}
+	if err := os.WriteFile(outFile, []byte("header\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ckpt := newCheckpoint(file, outFile, params)
+	ckpt.Done(0, 66)
+	ckpt.Done(2, 45)
+	ckpt.Close()
+
+	resumed := resumeCheckpoint(file, outFile, params, func(string) { t.Error("output started again") })
+	defer resumed.Close()
+	if resumed.NumCompleted() != 2 || !resumed.Completed(0) || resumed.Completed(1) || !resumed.Completed(2) {
+		t.Errorf("resumed lags 0 %t, 1 %t, 2 %t, want lags 0 and 2",
+			resumed.Completed(0), resumed.Completed(1), resumed.Completed(2))
+	}
+	//the pairs of the lags done before are carried over to the run summary
+	if got, want := resumed.Pairs(), map[int]int{0: 66, 2: 45}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pairs() = %v, want %v", got, want)
+	}
+	var none *Checkpoint
+	if got := none.Pairs(); len(got) != 0 {
+		t.Errorf("Pairs() without a checkpoint = %v, want none", got)
+	}
+}
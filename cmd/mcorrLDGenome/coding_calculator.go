@@ -127,11 +127,12 @@ type CorrResult struct {
 	P11      float64
 	totalP11 float64 //will remove later
 	N        int
-	P1a      float64 //probability of difference at site a
-	Na       int     //number of site As
-	P1b      float64 //probability of difference at site
-	Nb       int     // number of site Bs
+	P1a      float64    //probability of difference at site a
+	Na       int        //number of site As
+	P1b      float64    //probability of difference at site
+	Nb       int        // number of site Bs
 	Type     string
+	hap      haplotypes //haplotypes of the major and minor bases at sites a and b
 }
 
 // CorrResults stores a list of CorrResult with an gene ID.
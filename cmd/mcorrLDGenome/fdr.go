@@ -0,0 +1,232 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// testLDCsv tests every site pair of an LD csv written with --ld-stats for linkage, with Fisher's exact
+// test on its haplotype counts, and writes the rows to outFile with the p-value and the Benjamini-Hochberg
+// q-value across all pairs tested. Site pairs at lag 0, and those with a monomorphic site, are not tested.
+// If qMax is above 0, only the rows with a q-value of at most qMax are written.
+// The provenance of the csv is added to that of the run with a "source-" prefix.
+func testLDCsv(file, outFile string, qMax float64, prov *provenance) {
+	//first pass: the p-value of each row
+	var pValues []float64
+	var comments []string
+	var header string
+	readLDCsv(file, prov, func(line string) {
+		comments = append(comments, line)
+	}, func(h string) {
+		header = h
+	}, func(cols ldCsvColumns, fields []string) {
+		pValues = append(pValues, cols.pValue(fields))
+	})
+	qValues := benjaminiHochberg(pValues)
+
+	//second pass: write the rows with their p- and q-values
+	out, err := os.Create(outFile)
+	if err != nil {
+		log.Fatalf("failed creating %s: %v", outFile, err)
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	prov.WriteHeader(w)
+	for _, line := range comments {
+		w.WriteString(line + "\n")
+	}
+	w.WriteString("# p: two-sided p-value of Fisher's exact test on n_AB, n_Ab, n_aB and n_ab (NaN if not tested).\n")
+	w.WriteString("# q: Benjamini-Hochberg q-value of p across all site pairs tested.\n")
+	w.WriteString(header + ",p,q\n")
+	row, count := 0, 0
+	readLDCsv(file, nil, nil, nil, func(cols ldCsvColumns, fields []string) {
+		p, q := pValues[row], qValues[row]
+		row++
+		if qMax > 0 && !(q <= qMax) {
+			return
+		}
+		w.WriteString(fmt.Sprintf("%s,%g,%g\n", strings.Join(fields, ","), p, q))
+		count++
+	})
+	if err := w.Flush(); err != nil {
+		log.Fatalf("failed writing %s: %v", outFile, err)
+	}
+	tested := 0
+	for _, p := range pValues {
+		if !math.IsNaN(p) {
+			tested++
+		}
+	}
+	fmt.Printf("tested %d of %d site pairs, wrote %d to %s\n", tested, len(pValues), count, outFile)
+}
+
+// ldCsvColumns holds the indices of the columns of an LD csv needed for testing.
+type ldCsvColumns struct {
+	lag int
+	hap [4]int
+}
+
+// readLDCsv reads an LD csv, calling comment with each comment line which is not provenance,
+// header with the header and row with the fields of each row. The "key=value" provenance
+// lines are added to prov with a "source-" prefix, if prov is not nil.
+func readLDCsv(file string, prov *provenance, comment, header func(string), row func(ldCsvColumns, []string)) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("failed opening %s: %v", file, err)
+	}
+	defer f.Close()
+	var cols *ldCsvColumns
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			kv := strings.SplitN(strings.TrimPrefix(line, "# "), "=", 2)
+			if len(kv) == 2 && !strings.ContainsAny(kv[0], " :") {
+				if prov != nil {
+					prov.Set("source-"+kv[0], kv[1])
+				}
+			} else if comment != nil {
+				comment(line)
+			}
+		case cols == nil:
+			cols = newLDCsvColumns(file, line)
+			if header != nil {
+				header(line)
+			}
+		default:
+			row(*cols, strings.Split(line, ","))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Error when reading %s: %v", file, err)
+	}
+	if cols == nil {
+		log.Fatalf("%s has no header", file)
+	}
+}
+
+// newLDCsvColumns finds the lag and haplotype counts in the header of an LD csv.
+func newLDCsvColumns(file, header string) *ldCsvColumns {
+	index := make(map[string]int)
+	for i, name := range strings.Split(header, ",") {
+		index[name] = i
+	}
+	cols := &ldCsvColumns{}
+	var found bool
+	if cols.lag, found = index["l"]; !found {
+		log.Fatalf("%s has no column l: is it an LD csv?", file)
+	}
+	for k, name := range strings.Split(ldStatsHeader, ",")[:4] {
+		if cols.hap[k], found = index[name]; !found {
+			log.Fatalf("%s has no haplotype counts (%s): calculate it with --ld-stats", file, name)
+		}
+	}
+	return cols
+}
+
+// pValue returns the p-value of Fisher's exact test on the haplotypes of a row,
+// or NaN if the row is at lag 0 or a site is monomorphic.
+func (cols ldCsvColumns) pValue(fields []string) float64 {
+	if l, err := strconv.Atoi(fields[cols.lag]); err != nil || l == 0 {
+		return math.NaN()
+	}
+	var h haplotypes
+	for k, i := range cols.hap {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			log.Fatalf("bad haplotype count %q in row %s", fields[i], strings.Join(fields, ","))
+		}
+		h[k] = n
+	}
+	return h.fisherExact()
+}
+
+// fisherExact returns the two-sided p-value of Fisher's exact test on the haplotypes:
+// the probability, given the base counts at each site, of a table no more likely than this one.
+// It is NaN when either site is monomorphic.
+func (h haplotypes) fisherExact() float64 {
+	n := h[0] + h[1] + h[2] + h[3]
+	nA, nB := h[0]+h[1], h[0]+h[2]
+	if nA == 0 || nA == n || nB == 0 || nB == n {
+		return math.NaN()
+	}
+	//log probability of a table with k AB haplotypes (hypergeometric)
+	logP := func(k int) float64 {
+		return logChoose(nA, k) + logChoose(n-nA, nB-k) - logChoose(n, nB)
+	}
+	observed := logP(h[0])
+	p := 0.0
+	for k := maxInt(0, nA+nB-n); k <= minInt(nA, nB); k++ {
+		if lp := logP(k); lp <= observed+1e-7 {
+			p += math.Exp(lp)
+		}
+	}
+	return math.Min(p, 1)
+}
+
+// logChoose returns the log of n choose k.
+func logChoose(n, k int) float64 {
+	a, _ := math.Lgamma(float64(n + 1))
+	b, _ := math.Lgamma(float64(k + 1))
+	c, _ := math.Lgamma(float64(n - k + 1))
+	return a - b - c
+}
+
+// benjaminiHochberg returns the Benjamini-Hochberg q-values of pValues,
+// skipping (and giving NaN to) the NaN p-values of pairs which were not tested.
+func benjaminiHochberg(pValues []float64) []float64 {
+	qValues := make([]float64, len(pValues))
+	var tested []int
+	for i, p := range pValues {
+		qValues[i] = math.NaN()
+		if !math.IsNaN(p) {
+			tested = append(tested, i)
+		}
+	}
+	sort.SliceStable(tested, func(a, b int) bool { return pValues[tested[a]] < pValues[tested[b]] })
+	m := float64(len(tested))
+	q := 1.0
+	for rank := len(tested); rank >= 1; rank-- {
+		i := tested[rank-1]
+		q = math.Min(q, pValues[i]*m/float64(rank))
+		qValues[i] = q
+	}
+	return qValues
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestFisherExact(t *testing.T) {
+	tests := []struct {
+		h    haplotypes
+		want float64
+	}{
+		// Fisher's lady tasting tea: 34/70
+		{haplotypes{3, 1, 1, 3}, 34.0 / 70},
+		{haplotypes{8, 2, 1, 5}, 0.03496503496503495},
+		{haplotypes{7, 1, 0, 1}, 8.0 / 36},
+		// the two most extreme tables of 20, each 1/C(20, 10)
+		{haplotypes{10, 0, 0, 10}, 2.0 / 184756},
+		{haplotypes{0, 10, 10, 0}, 2.0 / 184756},
+		{haplotypes{5, 5, 5, 5}, 1},
+		// tables with 0, 1 and 2 AB haplotypes have probabilities 10/36, 20/36 and 6/36,
+		// so both tails count, but the tail is not simply doubled
+		{haplotypes{0, 4, 2, 3}, 16.0 / 36},
+		{haplotypes{5, 5, 0, 0}, math.NaN()},
+		{haplotypes{}, math.NaN()},
+	}
+	for _, tt := range tests {
+		if got := tt.h.fisherExact(); !closeTo(got, tt.want) {
+			t.Errorf("%v.fisherExact() = %g, want %g", tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestBenjaminiHochberg(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		p, want []float64
+	}{
+		{[]float64{0.01, 0.04, 0.03, 0.005}, []float64{0.02, 0.04, 0.04, 0.02}},
+		// 0.04*3/2 = 0.06 is lowered to the q-value of the next larger p-value
+		{[]float64{0.04, 0.041, 0.01}, []float64{0.041, 0.041, 0.03}},
+		// untested pairs do not count towards the number of tests
+		{[]float64{nan, 0.02, nan, 0.01}, []float64{nan, 0.02, nan, 0.02}},
+		{[]float64{0.9, 0.6}, []float64{0.9, 0.9}},
+		{[]float64{0.5, 0.5}, []float64{0.5, 0.5}},
+		{nil, []float64{}},
+	}
+	for _, tt := range tests {
+		got := benjaminiHochberg(tt.p)
+		if len(got) != len(tt.want) {
+			t.Fatalf("benjaminiHochberg(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+		for i := range got {
+			if !closeTo(got[i], tt.want[i]) {
+				t.Errorf("benjaminiHochberg(%v) = %v, want %v", tt.p, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTestLDCsv(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.csv")
+	rows := []string{
+		"0,0,0.1,0.1,0.1,20,ds,S,3,3,10,0,0,10,0.25,1,1",
+		"0,3,0.1,0.1,0.1,20,Qs,S,3,6,10,0,0,10,0.25,1,1",
+		"3,3,0.1,0.1,0.1,20,Qs,S,6,9,5,5,5,5,0,0,0",
+		"6,3,0.1,0.1,0.1,20,Qs,S,9,12,10,10,0,0,0,NaN,NaN",
+	}
+	csv := "# program=mcorrLDGenome\n# x: the initial position of the probability\n" +
+		"x,l,P11,P1a,P1b,n,t,g,pos,pos_b," + ldStatsHeader + "\n" + strings.Join(rows, "\n") + "\n"
+	if err := ioutil.WriteFile(in, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := kingpin.New("mcorrLDGenome", "")
+	read := func(qMax float64) (comments, data []string) {
+		out := filepath.Join(dir, "out.csv")
+		testLDCsv(in, out, qMax, newProvenance(app, ""))
+		b, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			if strings.HasPrefix(line, "#") {
+				comments = append(comments, line)
+			} else {
+				data = append(data, line)
+			}
+		}
+		return
+	}
+
+	comments, data := read(0)
+	if !strings.Contains(strings.Join(comments, "\n"), "# source-program=mcorrLDGenome") {
+		t.Errorf("the provenance of the input is missing: %v", comments)
+	}
+	//the first Qs row is tested against one other, so q = 2p
+	p := 2.0 / 184756
+	header := "x,l,P11,P1a,P1b,n,t,g,pos,pos_b," + ldStatsHeader + ",p,q"
+	nan := math.NaN()
+	want := []struct {
+		row  string
+		p, q float64
+	}{
+		{rows[0], nan, nan},
+		{rows[1], p, 2 * p},
+		{rows[2], 1, 1},
+		{rows[3], nan, nan},
+	}
+	check := func(qMax float64, data []string, rows ...int) {
+		if len(data) != len(rows)+1 || data[0] != header {
+			t.Fatalf("--q-value %g wrote\n%s\nwant rows %v", qMax, strings.Join(data, "\n"), rows)
+		}
+		for k, r := range rows {
+			line := data[k+1]
+			i := strings.LastIndex(line[:strings.LastIndex(line, ",")], ",")
+			var gotP, gotQ float64
+			fmt.Sscanf(strings.Replace(line[i+1:], ",", " ", 1), "%g %g", &gotP, &gotQ)
+			if line[:i] != want[r].row || !closeTo(gotP, want[r].p) || !closeTo(gotQ, want[r].q) {
+				t.Errorf("--q-value %g wrote %s, want %s,%g,%g", qMax, line, want[r].row, want[r].p, want[r].q)
+			}
+		}
+	}
+	check(0, data, 0, 1, 2, 3)
+	_, data = read(0.05)
+	check(0.05, data, 1)
+}
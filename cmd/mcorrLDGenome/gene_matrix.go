@@ -0,0 +1,117 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// geneMatrix sums up the site pairs with the first site in CDS region a and the second in CDS region b,
+// for every ordered pair of CDS regions, in bins of lags; lag 0 (a site paired with itself) is left out.
+type geneMatrix struct {
+	sites  *siteMap
+	binLen int // in codons; 0 for a single bin of all lags
+	cells  map[geneCell]*geneSum
+}
+
+// geneCell is a pair of CDS regions (indices in the site map) and a bin of lags.
+type geneCell struct {
+	a, b, bin int
+}
+
+// geneSum holds the summed P11 numerator and number of sequence pairs of a cell.
+type geneSum struct {
+	xy float64
+	n  int
+}
+
+func newGeneMatrix(sites *siteMap, binLen int) *geneMatrix {
+	return &geneMatrix{sites: sites, binLen: binLen, cells: make(map[geneCell]*geneSum)}
+}
+
+// add adds the site pairs of a lag.
+func (gm *geneMatrix) add(res lagResult) {
+	if res.lag == 0 {
+		return
+	}
+	bin := 0
+	if gm.binLen > 0 {
+		bin = res.lag / gm.binLen
+	}
+	for k, r := range res.results {
+		if r.N == 0 {
+			continue
+		}
+		cell := geneCell{gm.sites.gene[k.pos_x], gm.sites.gene[k.lag], bin}
+		sum := gm.cells[cell]
+		if sum == nil {
+			sum = &geneSum{}
+			gm.cells[cell] = sum
+		}
+		sum.xy += r.totalP11
+		sum.n += r.N
+	}
+}
+
+// Write writes the matrix to a .csv file in long format, one row per ordered pair of CDS regions
+// and bin of lags with any site pairs, giving the lags of the bin (from minlag up to, not including, maxlag).
+func (gm *geneMatrix) Write(outFile string, minlag, maxlag int, prov *provenance) {
+	w, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	prov.WriteHeader(w)
+	w.WriteString("# gene_a, gene_b: the CDS regions of the first and second site of the site pairs\n")
+	w.WriteString("# l_min, l_max: the smallest and largest distance between the two sites in the bin\n")
+	w.WriteString("# xy: the summed P11 numerator (Qs) of the site pairs\n")
+	w.WriteString("# n: the total number of codon pairs used for calculation\n")
+	w.WriteString("# m: xy divided by n\n")
+	w.WriteString("gene_a,gene_b,l_min,l_max,xy,n,m\n")
+
+	cells := make([]geneCell, 0, len(gm.cells))
+	for cell := range gm.cells {
+		cells = append(cells, cell)
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].a != cells[j].a {
+			return cells[i].a < cells[j].a
+		}
+		if cells[i].b != cells[j].b {
+			return cells[i].b < cells[j].b
+		}
+		return cells[i].bin < cells[j].bin
+	})
+	if minlag < 1 {
+		minlag = 1
+	}
+	for _, cell := range cells {
+		lo, hi := minlag, maxlag-1
+		if gm.binLen > 0 {
+			if lo < cell.bin*gm.binLen {
+				lo = cell.bin * gm.binLen
+			}
+			if hi > (cell.bin+1)*gm.binLen-1 {
+				hi = (cell.bin+1)*gm.binLen - 1
+			}
+		}
+		sum := gm.cells[cell]
+		w.WriteString(fmt.Sprintf("%s,%s,%d,%d,%g,%d,%g\n", gm.sites.genes[cell.a], gm.sites.genes[cell.b],
+			3*lo, 3*hi, sum.xy, sum.n, sum.xy/float64(sum.n)))
+	}
+}
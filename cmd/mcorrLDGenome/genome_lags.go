@@ -0,0 +1,109 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// sitePair is a pair of codons of the concatenated sequences, i being the first on the genome.
+type sitePair struct {
+	i, j int
+}
+
+// useGenomicLags makes lag l hold the pairs of codons whose sites are 3l to 3l+2 nucleotides apart
+// on the genome, rather than l codons apart in the concatenated sequences, so that the gaps between
+// CDS regions count; lag 0 holds each codon paired with itself, and codons at reference gaps are left out.
+// It returns maxCodonLen or, if that is 0, the number of lags spanning the genome.
+func (m *siteMap) useGenomicLags(maxCodonLen int) int {
+	for i, pos := range m.pos {
+		if pos != refGap {
+			m.byPos = append(m.byPos, i)
+		}
+	}
+	if len(m.byPos) == 0 {
+		log.Fatal("no codons are placed on the genome, so there are no genomic lags")
+	}
+	sort.SliceStable(m.byPos, func(a, b int) bool { return m.pos[m.byPos[a]] < m.pos[m.byPos[b]] })
+	for _, i := range m.byPos {
+		m.sorted = append(m.sorted, m.pos[i])
+	}
+	if maxCodonLen == 0 {
+		return (m.sorted[len(m.sorted)-1]-m.sorted[0])/3 + 1
+	}
+	return maxCodonLen
+}
+
+// pairs returns the pairs of codons at lag l among the numCodons codons of the loaded sequences,
+// leaving out those outside the regions. The first sites are taken from --region, if given.
+func (m *siteMap) pairs(l, numCodons int) (pairs []sitePair) {
+	if m == nil {
+		for i := 0; i+l < numCodons; i++ {
+			pairs = append(pairs, sitePair{i, i + l})
+		}
+		return
+	}
+	end := m.first + numCodons
+	firstSites := m.sitesA
+	if firstSites == nil {
+		firstSites = m.byPos
+	}
+	if m.byPos == nil {
+		if firstSites == nil {
+			for i := m.first; i+l < end; i++ {
+				if m.inRegions(i, i+l) {
+					pairs = append(pairs, sitePair{i, i + l})
+				}
+			}
+			return
+		}
+		for _, i := range firstSites[sort.SearchInts(firstSites, m.first):] {
+			if i+l >= end {
+				break
+			}
+			if m.inRegions(i, i+l) {
+				pairs = append(pairs, sitePair{i, i + l})
+			}
+		}
+		return
+	}
+	for _, i := range firstSites {
+		if m.pos[i] == refGap || i < m.first || i >= end {
+			continue
+		}
+		if l == 0 {
+			if m.inRegions(i, i) {
+				pairs = append(pairs, sitePair{i, i})
+			}
+			continue
+		}
+		from := m.pos[i] + 3*l
+		for b := sort.SearchInts(m.sorted, from); b < len(m.sorted) && m.sorted[b] < from+3; b++ {
+			if j := m.byPos[b]; j >= m.first && j < end && m.inRegions(i, j) {
+				pairs = append(pairs, sitePair{i, j})
+			}
+		}
+	}
+	return
+}
+
+// local returns the index of codon i in the loaded sequences.
+func (m *siteMap) local(i int) int {
+	if m == nil {
+		return i
+	}
+	return i - m.first
+}
@@ -0,0 +1,38 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestHeaderFormat(t *testing.T) {
+	tests := []struct {
+		format, id string
+		want       seqHeader
+	}{
+		{defaultHeaderFormat, "orf1 1+90 strain0", seqHeader{"orf1", 1, 90, "strain0"}},
+		{defaultHeaderFormat, "orf1 1+90 strain0 len=300", seqHeader{"orf1", 1, 90, "strain0"}},
+		{defaultHeaderFormat, "orf1 1+90 strain0\tlen=300 cov=12", seqHeader{"orf1", 1, 90, "strain0"}},
+		{"{strain}|{gene}|{start}-{stop}", "hCoV-19/X/1|S|121-210", seqHeader{"S", 121, 210, "hCoV-19/X/1"}},
+		{"{strain}|{gene}|{start}-{stop}", "hCoV-19/X/1|S|121-210 extra", seqHeader{"S", 121, 210, "hCoV-19/X/1"}},
+		{"{gene}_{strain} {start}", "orf1_strain_2 5", seqHeader{"orf1", 5, 0, "strain_2"}},
+		{"{gene} {_} {start} {strain}", "N ignored words 211 strain3", seqHeader{"N", 211, 0, "strain3"}},
+		{`^(?P<gene>\w+):(?P<start>\d+) (?P<strain>.+)$`, "N:211 strain 3", seqHeader{"N", 211, 0, "strain 3"}},
+	}
+	for _, tt := range tests {
+		if got := newHeaderFormat(tt.format).parse(tt.id); got != tt.want {
+			t.Errorf("header %q in format %q = %+v, want %+v", tt.id, tt.format, got, tt.want)
+		}
+	}
+}
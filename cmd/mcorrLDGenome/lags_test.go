@@ -0,0 +1,74 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLags(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []int
+	}{
+		{"30", []int{0, 10}},
+		{"0", []int{0}},
+		{"31,32", []int{0, 10}},
+		{"3:12", []int{0, 1, 2, 3, 4}},
+		{"0:30:15", []int{0, 5, 10}},
+		{"3:9, 6:12", []int{0, 1, 2, 3, 4}},
+		{"log:3:300:3", []int{0, 1, 10, 100}},
+		{"log:30:30:1", []int{0, 10}},
+		{"log:3:3000:4,15", []int{0, 1, 5, 10, 100, 1000}},
+	}
+	for _, tt := range tests {
+		if got := parseLags(tt.spec); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLags(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestPoolLags(t *testing.T) {
+	tests := []struct {
+		lags   []int
+		binLen int
+		labels []int
+		pools  map[int][]int
+	}{
+		{[]int{0, 1, 2}, 0, []int{0, 1, 2}, map[int][]int{0: {0}, 1: {1}, 2: {2}}},
+		{[]int{0, 1, 2}, 1, []int{0, 1, 2}, map[int][]int{0: {0}, 1: {1}, 2: {2}}},
+		// lag 0 stays on its own, even though it falls in the first bin
+		{[]int{0, 1, 2, 3, 4, 5}, 3, []int{0, 1, 3}, map[int][]int{0: {0}, 1: {1, 2}, 3: {3, 4, 5}}},
+		// bins are aligned to multiples of binLen, and empty bins are left out
+		{[]int{0, 2, 7, 8, 20}, 5, []int{0, 2, 7, 20}, map[int][]int{0: {0}, 2: {2}, 7: {7, 8}, 20: {20}}},
+	}
+	for _, tt := range tests {
+		s := poolLags(tt.lags, tt.binLen)
+		if !reflect.DeepEqual(s.labels, tt.labels) || !reflect.DeepEqual(s.pools, tt.pools) {
+			t.Errorf("poolLags(%v, %d) = %v %v, want %v %v", tt.lags, tt.binLen, s.labels, s.pools, tt.labels, tt.pools)
+		}
+	}
+}
+
+func TestLagSetSpan(t *testing.T) {
+	s := newLagSet("", 2, 10, 4)
+	if min, max := s.span(); min != 2 || max != 10 {
+		t.Errorf("span() = %d, %d, want 2, 10", min, max)
+	}
+	if min, max := (lagSet{}).span(); min != 0 || max != 0 {
+		t.Errorf("empty span() = %d, %d, want 0, 0", min, max)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testLags returns results at lags 0 to 2 across several chunks, with one empty cell per lag,
+// and the cells an LD matrix file should hold for them.
+func testLags() (lags map[int]map[pos_key]CorrResult, want []ldCell) {
+	lags = make(map[int]map[pos_key]CorrResult)
+	for l := 0; l < 3; l++ {
+		lags[l] = make(map[pos_key]CorrResult)
+		for _, x := range []int{0, 1, 7, ldmChunkSize - 1, ldmChunkSize, 3*ldmChunkSize + 5} {
+			res := CorrResult{N: 10*x + l + 1, P11: float64(x) / 3, P1a: 0.25, P1b: float64(l) / 7}
+			if x == 7 {
+				res.N = 0
+			}
+			lags[l][pos_key{x, x + l}] = res
+			if res.N > 0 {
+				want = append(want, ldCell{x: x, lag: l, n: res.N, p11: res.P11, p1a: res.P1a, p1b: res.P1b})
+			}
+		}
+	}
+	return
+}
+
+// writeTestMatrix writes the lags to a new LD matrix file, with its index if index is true.
+func writeTestMatrix(t *testing.T, file string, lags map[int]map[pos_key]CorrResult, index bool) {
+	initLDMatrixOut(file)
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m := newLDMatrixWriter(f, f)
+	for l := 0; l < len(lags); l++ {
+		m.WriteLag(l, lags[l])
+	}
+	if index {
+		m.WriteIndex()
+	}
+}
+
+func readCells(file string, xMin, xMax, lMin, lMax int) (cells []ldCell) {
+	m := openLDMatrix(file)
+	defer m.Close()
+	m.Cells(xMin, xMax, lMin, lMax, func(c ldCell) { cells = append(cells, c) })
+	return
+}
+
+func TestLDMatrixRoundTrip(t *testing.T) {
+	lags, want := testLags()
+	for _, index := range []bool{true, false} {
+		file := filepath.Join(t.TempDir(), "t.ldm")
+		writeTestMatrix(t, file, lags, index)
+		if got := readCells(file, 0, 1<<30, 0, 1<<30); !reflect.DeepEqual(got, want) {
+			t.Errorf("index %t: read %v, want %v", index, got, want)
+		}
+	}
+}
+
+func TestLDMatrixBlock(t *testing.T) {
+	lags, all := testLags()
+	file := filepath.Join(t.TempDir(), "t.ldm")
+	writeTestMatrix(t, file, lags, true)
+	var want []ldCell
+	for _, c := range all {
+		if c.x >= 1 && c.x < ldmChunkSize+1 && c.lag >= 1 && c.lag < 2 {
+			want = append(want, c)
+		}
+	}
+	if got := readCells(file, 1, ldmChunkSize+1, 1, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+}
+
+func TestLDMatrixAppend(t *testing.T) {
+	lags, want := testLags()
+	file := filepath.Join(t.TempDir(), "t.ldm")
+	writeTestMatrix(t, file, map[int]map[pos_key]CorrResult{0: lags[0]}, false)
+	//a resumed run picks up the chunks already written
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newLDMatrixWriter(f, f)
+	m.WriteLag(1, lags[1])
+	m.WriteLag(2, lags[2])
+	m.WriteIndex()
+	f.Close()
+	if got := readCells(file, 0, 1<<30, 0, 1<<30); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+}
+
+func TestLDMatrixPartialChunk(t *testing.T) {
+	lags, all := testLags()
+	file := filepath.Join(t.TempDir(), "t.ldm")
+	writeTestMatrix(t, file, lags, false)
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//an interrupted run leaves the last chunk (of lag 2, the last x) cut short
+	if err := os.Truncate(file, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	want := all[:len(all)-1]
+	if got := readCells(file, 0, 1<<30, 0, 1<<30); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// closeTo reports whether got and want are equal within rounding, or both NaN.
+func closeTo(got, want float64) bool {
+	if math.IsNaN(want) {
+		return math.IsNaN(got)
+	}
+	return math.Abs(got-want) <= 1e-12*math.Max(1, math.Abs(want))
+}
+
+func TestHaplotypeStats(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		h             haplotypes
+		d, dPrime, r2 float64
+	}{
+		{haplotypes{10, 0, 0, 10}, 0.25, 1, 1},
+		{haplotypes{0, 10, 10, 0}, -0.25, -1, 1},
+		{haplotypes{5, 5, 5, 5}, 0, 0, 0},
+		// pAB = 0.3, pA = 0.4, pB = 0.5: D = 0.1, Dmax = min(pA*pb, pa*pB) = 0.2
+		{haplotypes{3, 1, 2, 4}, 0.1, 0.5, 0.01 / 0.06},
+		// pAB = 0.1, pA = 0.4, pB = 0.5: D = -0.1, Dmax = min(pA*pB, pa*pb) = 0.2
+		{haplotypes{1, 3, 4, 2}, -0.1, -0.5, 0.01 / 0.06},
+		{haplotypes{7, 1, 0, 1}, 7.0 / 81, 1, 0.4375},
+		// a monomorphic site has no D' or r^2
+		{haplotypes{5, 5, 0, 0}, 0, nan, nan},
+		{haplotypes{5, 0, 5, 0}, 0, nan, nan},
+		{haplotypes{}, nan, nan, nan},
+	}
+	for _, tt := range tests {
+		d, dPrime, r2 := tt.h.stats()
+		if !closeTo(d, tt.d) || !closeTo(dPrime, tt.dPrime) || !closeTo(r2, tt.r2) {
+			t.Errorf("%v.stats() = %g, %g, %g, want %g, %g, %g", tt.h, d, dPrime, r2, tt.d, tt.dPrime, tt.r2)
+		}
+	}
+}
+
+func TestCountHaplotypes(t *testing.T) {
+	pairs := func(sites ...string) (cps []CodonPair) {
+		for _, s := range sites {
+			cps = append(cps, CodonPair{A: Codon("AA" + s[:1]), B: Codon("AA" + s[1:])})
+		}
+		return
+	}
+	tests := []struct {
+		classes [][]CodonPair
+		want    haplotypes
+	}{
+		// site a: A major (3), G minor; site b: C major (3), T minor
+		{[][]CodonPair{pairs("AC", "AC", "AT", "GC")}, haplotypes{2, 1, 1, 0}},
+		// the major and minor bases are counted over all the classes
+		{[][]CodonPair{pairs("GT", "GT"), pairs("AC", "AC", "AC")}, haplotypes{3, 0, 0, 2}},
+		// a third base, a gap or an N leaves the sequence out
+		{[][]CodonPair{pairs("AC", "AC", "AC", "GT", "GT", "TC", "A-", "NC")}, haplotypes{3, 0, 0, 2}},
+		// ties go to A, T, G, C in that order
+		{[][]CodonPair{pairs("CG", "GC")}, haplotypes{0, 1, 1, 0}},
+		// a monomorphic site has no minor base
+		{[][]CodonPair{pairs("AC", "AT", "AT")}, haplotypes{2, 1, 0, 0}},
+		{nil, haplotypes{}},
+	}
+	for _, tt := range tests {
+		if got := countHaplotypes(tt.classes, 2); got != tt.want {
+			t.Errorf("countHaplotypes(%v) = %v, want %v", tt.classes, got, tt.want)
+		}
+	}
+}
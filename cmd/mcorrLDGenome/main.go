@@ -21,10 +21,11 @@ import (
 	"github.com/kussell-lab/ncbiftp/taxonomy"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"io"
+	"log"
+	"math"
 	"os"
 	"runtime"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,25 +36,77 @@ func main() {
 	app := kingpin.New("mcorrLDGenome", "Calculate mutation correlation across CDS regions from an XMFA file.")
 	app.Version("v20210513")
 
-	alnFile := app.Arg("aln", "Alignment file in XMFA format.").Required().String()
-	outPrefix := app.Arg("out", "Output prefix.").Required().String()
-	minl := app.Flag("min-corr-length", "min distance of correlation (base pairs)").Default("0").Int()
-	maxl := app.Flag("max-corr-length", "Max distance of correlation (base pairs)").Default("0").Int()
-	mateAln := app.Flag("mate-aln", "Second alignment for calculating between clades").Default("").String()
+	calcCmd := app.Command("calc", "Calculate the correlations (the default command).").Default()
+	alnFile := calcCmd.Arg("aln", "Alignment file in XMFA format.").Required().String()
+	outPrefix := calcCmd.Arg("out", "Output prefix.").Required().String()
+	minl := calcCmd.Flag("min-corr-length", "min distance of correlation (base pairs)").Default("0").Int()
+	maxl := calcCmd.Flag("max-corr-length", "Max distance of correlation (base pairs)").Default("0").Int()
+	mateAln := calcCmd.Flag("mate-aln", "Second alignment for calculating between clades").Default("").String()
 	ncpu := app.Flag("num-cpu", "Number of CPUs (default: using all available cores)").Default("0").Int()
-	mates := app.Flag("between-clades", "just calculate correlations between pairs from different xmfa files").Default("false").Bool()
-	numDigesters := app.Flag("num-threads", "number of threads").Default("50").Int()
+	mates := calcCmd.Flag("between-clades", "just calculate correlations between pairs from different xmfa files").Default("false").Bool()
+	numDigesters := calcCmd.Flag("num-threads", "number of threads").Default("50").Int()
+	resume := calcCmd.Flag("resume", "resume an interrupted run, skipping lags listed in <out>.checkpoint").Default("false").Bool()
+	refName := calcCmd.Flag("ref-name", "strain name of a reference genome in the alignment, to give positions in its coordinates").Default("").String()
+	refFasta := calcCmd.Flag("ref-fasta", "FASTA file of the reference sequence of each CDS region, aligned to the XMFA and named by gene, to give positions in its coordinates").Default("").String()
+	duplicateNames := calcCmd.Flag("duplicate-names", "what to do with a strain name which appears more than once in a CDS region: rename the copies in order (<name>_1, ...), error, keep-first or keep-longest").Default("rename").Enum(duplicatePolicies...)
+	headerFormat := calcCmd.Flag("header-format", "format of the XMFA sequence headers: a template of {gene}, {start}, {stop}, {strain} and {_} (any text), or a regular expression with those named groups").Default(defaultHeaderFormat).String()
+	genomicLags := calcCmd.Flag("genomic-lags", "define lags by the distance between sites on the genome (from the gene positions in the XMFA headers, or the reference), counting the gaps between CDS regions, rather than along the concatenated CDS regions").Default("false").Bool()
+	regions := calcCmd.Flag("region", "only calculate site pairs whose first site (x) is in this CDS region or genome coordinates <start>-<end> (repeatable; default: anywhere)").Strings()
+	regionsB := calcCmd.Flag("region-b", "only calculate site pairs whose second site is in this CDS region or genome coordinates <start>-<end> (repeatable; default: anywhere)").Strings()
+	geneMatrixOut := calcCmd.Flag("gene-matrix", "also sum up the site pairs by the CDS regions holding their two sites, writing <out>.gene_matrix.csv").Default("false").Bool()
+	geneMatrixBin := calcCmd.Flag("gene-matrix-bin", "bin the gene matrix by lag, in bins of this many base pairs (default: one bin of all lags)").Default("0").Int()
+	lagSpec := calcCmd.Flag("lags", "lags to calculate (base pairs) instead of --min-corr-length to --max-corr-length: a comma-separated list of lags, ranges <min>:<max>[:<step>] and log:<min>:<max>:<n> (n lags evenly spaced on a log scale)").Default("").String()
+	lagBin := calcCmd.Flag("lag-bin", "pool the lags into bins of this width (base pairs), writing one row per initial position and bin with the pooled n (0: no pooling)").Default("0").Int()
+	ldStats := calcCmd.Flag("ld-stats", "add the classical LD statistics of each site pair to the csv: the haplotype counts of the major and minor bases at the two sites, D, D' and r^2").Default("false").Bool()
+	format := calcCmd.Flag("format", "output format: csv, or binary for a compressed LD matrix file (<out>.ldm)").Default("csv").Enum("csv", "binary")
 	//showProgress := app.Flag("show-progress", "Show progress").Bool()
 
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	exportCmd := app.Command("export", "Convert an LD matrix file (.ldm) to csv, optionally just a block of positions and lags.")
+	ldmFile := exportCmd.Arg("ldm", "LD matrix file.").Required().String()
+	exportOut := exportCmd.Arg("out", "Output csv file.").Required().String()
+	xMin := exportCmd.Flag("x-min", "first initial position x (base pairs)").Default("0").Int()
+	xMax := exportCmd.Flag("x-max", "last initial position x, exclusive (base pairs; default: all)").Default("0").Int()
+	lMin := exportCmd.Flag("l-min", "smallest distance l (base pairs)").Default("0").Int()
+	lMax := exportCmd.Flag("l-max", "largest distance l, exclusive (base pairs; default: all)").Default("0").Int()
+
+	fdrCmd := app.Command("fdr", "Test each site pair of a csv calculated with --ld-stats for linkage (Fisher's exact test), adding p- and Benjamini-Hochberg q-values.")
+	fdrCsv := fdrCmd.Arg("csv", "LD csv calculated with --ld-stats.").Required().String()
+	fdrOut := fdrCmd.Arg("out", "Output csv file.").Required().String()
+	qMax := fdrCmd.Flag("q-value", "only write the site pairs with a q-value of at most this (default: write all site pairs)").Default("0").Float64()
+
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	if *ncpu <= 0 {
 		*ncpu = runtime.NumCPU()
 	}
 	runtime.GOMAXPROCS(*ncpu)
 
+	if command == exportCmd.FullCommand() {
+		if *xMax == 0 {
+			*xMax = math.MaxInt32
+		}
+		if *lMax == 0 {
+			*lMax = math.MaxInt32
+		}
+		exportLDMatrix(*ldmFile, *exportOut, *xMin, *xMax, *lMin, *lMax, newProvenance(app, command))
+		return
+	}
+
+	if command == fdrCmd.FullCommand() {
+		testLDCsv(*fdrCsv, *fdrOut, *qMax, newProvenance(app, command))
+		return
+	}
+
+	if *lagBin > 0 && *geneMatrixOut {
+		log.Fatalf("the gene matrix sums up each site pair by its own CDS regions, so --lag-bin does not work with --gene-matrix; use --gene-matrix-bin")
+	}
+
+	headers = newHeaderFormat(*headerFormat)
+
 	//timer
 	start := time.Now()
+	timer := newPhaseTimer()
+	summary := &runSummary{Program: "mcorrLDGenome"}
 
 	// prepare calculator.
 	//var calculator Calculator
@@ -77,6 +130,36 @@ func main() {
 	//sort the slice numerically
 	sort.Ints(startSlice)
 
+	//the CDS regions, in the order they are concatenated, placed on the genome
+	//and limited to the regions before any codons are loaded
+	ref := loadReference(*refName, *refFasta)
+	scanned := []string{*alnFile}
+	if *mateAln != "" && !*mates {
+		scanned = append(scanned, *mateAln)
+	}
+	genes := scanGenes(startSlice, codonOffset, ref, scanned...)
+	sites := newSiteMap(genes, codonPos-1)
+	sites.restrict(*regions, *regionsB)
+	if *genomicLags {
+		if *format == "binary" {
+			log.Fatalf("an LD matrix file holds one site pair per (x, l), so --genomic-lags needs --format=csv")
+		}
+		maxCodonLen = sites.useGenomicLags(maxCodonLen)
+	}
+	if *ldStats && *format == "binary" {
+		log.Fatalf("an LD matrix file holds P11, P1a and P1b only, so --ld-stats needs --format=csv")
+	}
+	//get total number of codons
+	numCodons := len(sites.gene)
+	minlag, maxlag := minCodonLen, maxCodonLen
+	if maxCodonLen == 0 {
+		minlag, maxlag = 0, numCodons
+	}
+	lags := newLagSet(*lagSpec, minlag, maxlag, *lagBin/3)
+	//only the CDS regions within reach of the regions are loaded
+	_, lagEnd := lags.span()
+	first, last := sites.window(genes, lagEnd)
+
 	// now go through and make a map of codon sequences
 	// where we add on codons to the end of each strain sequence
 	fmt.Print("fetching CDS regions\n")
@@ -84,25 +167,28 @@ func main() {
 	//seqMap := make(map[string][]Codon)
 	var seqMap map[string][]Codon
 	var seqMap1 map[string][]Codon
+	var loaded []geneRegion
 	if *mateAln != "" {
 		if *mates {
-			seqMap = makeSeqMap(startSlice, *alnFile, codonOffset)
-			seqMap1 = makeSeqMap(startSlice, *mateAln, codonOffset)
+			seqMap, loaded = makeSeqMap(startSlice[first:last], *alnFile, codonOffset, *duplicateNames)
+			var loaded1 []geneRegion
+			seqMap1, loaded1 = makeSeqMap(startSlice[first:last], *mateAln, codonOffset, *duplicateNames)
+			summary.addDuplicates(loaded1)
 		} else {
-			seqMap = combinedSeqMap(startSlice, *alnFile, *mateAln, codonOffset)
+			seqMap, loaded = combinedSeqMap(startSlice[first:last], *alnFile, *mateAln, codonOffset, *duplicateNames)
 		}
 	} else {
-		seqMap = makeSeqMap(startSlice, *alnFile, codonOffset)
+		seqMap, loaded = makeSeqMap(startSlice[first:last], *alnFile, codonOffset, *duplicateNames)
+	}
+	for k, gene := range loaded {
+		genes[first+k].Duplicates = gene.Duplicates
 	}
 
 	numSeqs := len(seqMap)
-	//get total number of codons
-	var numCodons int
-	for _, seq := range seqMap {
-		numCodons = len(seq)
-		break
-	}
 	fmt.Print("done fetching CDS regions\n")
+	if last-first < len(genes) {
+		fmt.Printf("loaded %d of %d CDS regions, which hold the site pairs of the regions\n", last-first, len(genes))
+	}
 	if *mates {
 		numSeqs = numSeqs + len(seqMap1)
 		fmt.Printf("total number of strains: %d\n", numSeqs)
@@ -110,15 +196,93 @@ func main() {
 		fmt.Printf("total number of strains: %d\n", numSeqs)
 	}
 	fmt.Printf("total number of codons: %d\n", numCodons)
+	timer.Done("read alignments")
+	summary.summarizeSequences(genes[first:last], []map[string][]Codon{seqMap, seqMap1}, codingTable, codonPos-1)
+	timer.Done("summarize sequences")
 
-	//initialize output csv
+	//record the run so that it can be resumed
+	inputs := []string{*alnFile}
+	if *mateAln != "" {
+		inputs = append(inputs, *mateAln)
+	}
+	inputHash := hashFiles(inputs...)
+	params := []string{
+		"program=mcorrLDGenome",
+		fmt.Sprintf("min-corr-length=%d", *minl),
+		fmt.Sprintf("max-corr-length=%d", *maxl),
+		fmt.Sprintf("between-clades=%t", *mates),
+		fmt.Sprintf("synonymous=%t", synonymous),
+		fmt.Sprintf("codon-position=%d", codonPos),
+		"genetic-code=11",
+		fmt.Sprintf("num-strains=%d", numSeqs),
+		fmt.Sprintf("num-codons=%d", numCodons),
+		"input-sha256=" + inputHash,
+		"format=" + *format,
+		"reference=" + *refName + *refFasta,
+		"duplicate-names=" + *duplicateNames,
+		"header-format=" + *headerFormat,
+		fmt.Sprintf("genomic-lags=%t", *genomicLags),
+		"region=" + strings.Join(*regions, ","),
+		"region-b=" + strings.Join(*regionsB, ","),
+		"lags=" + *lagSpec,
+		fmt.Sprintf("lag-bin=%d", *lagBin),
+		fmt.Sprintf("ld-stats=%t", *ldStats),
+	}
+	prov := newProvenance(app, command)
+	prov.Set("genetic-code", "11")
+	prov.Set("synonymous", synonymous)
+	prov.Set("codon-position", codonPos)
+	prov.Set("num-strains", numSeqs)
+	prov.Set("num-codons", numCodons)
+	prov.Set("input-sha256", inputHash)
+
+	//initialize output, or pick up where we left off
 	outFile := *outPrefix + ".csv"
-	initCsvOut(outFile)
+	initOut := func(outFile string) { initCsvOut(outFile, prov, *ldStats) }
+	binary := *format == "binary"
+	if binary {
+		outFile = *outPrefix + ".ldm"
+		initOut = initLDMatrixOut
+		prov.Set("genes", encodeGenes(genes))
+		if ref != nil {
+			prov.Set("sites", sites.encodeSites())
+		}
+		prov.WriteSidecar(outFile)
+	}
+	ckptFile := *outPrefix + ".checkpoint"
+	var ckpt *Checkpoint
+	if _, err := os.Stat(ckptFile); *resume && err == nil {
+		ckpt = resumeCheckpoint(ckptFile, outFile, params, initOut)
+		fmt.Printf("resuming with %d lags already done\n", ckpt.NumCompleted())
+	} else {
+		if *resume {
+			fmt.Printf("no checkpoint found at %s, starting from scratch\n", ckptFile)
+		}
+		initOut(outFile)
+		ckpt = newCheckpoint(ckptFile, outFile, params)
+	}
+	defer ckpt.Close()
+	var matrix *geneMatrix
+	if *geneMatrixOut {
+		if ckpt.NumCompleted() > 0 {
+			log.Fatalf("the gene matrix needs every lag to be calculated in one run; start again without --resume")
+		}
+		matrix = newGeneMatrix(sites, *geneMatrixBin/3)
+	}
+	var pairs map[int]int
 	if *mates {
-		calcQsMatesAll(seqMap, seqMap1, codonOffset, codonPos-1, minCodonLen, maxCodonLen, codingTable, synonymous, outFile, *numDigesters)
+		pairs = calcQsMatesAll(seqMap, seqMap1, codonOffset, codonPos-1, lags, codingTable, synonymous, outFile, binary, *ldStats, sites, matrix, *numDigesters, ckpt)
 	} else {
-		calcQsAll(seqMap, codonOffset, codonPos-1, minCodonLen, maxCodonLen, codingTable, synonymous, outFile, *numDigesters)
+		pairs = calcQsAll(seqMap, codonOffset, codonPos-1, lags, codingTable, synonymous, outFile, binary, *ldStats, sites, matrix, *numDigesters, ckpt)
+	}
+	timer.Done("calculate LD")
+	if matrix != nil {
+		minlag, maxlag := lags.span()
+		matrix.Write(*outPrefix+".gene_matrix.csv", minlag, maxlag, prov)
+		fmt.Printf("\nwrote %s.gene_matrix.csv\n", *outPrefix)
 	}
+	summary.setLags(pairs)
+	summary.Write(*outPrefix, timer)
 
 	duration := time.Since(start)
 	fmt.Println("Time to calculate LD:", duration)
@@ -129,17 +293,22 @@ func main() {
 	//CollectWrite(corrResChan, *outPrefix+".csv")
 }
 
-func makeSeqMap(startSlice []int, alnFile string, codonOffset int) (seqMap map[string][]Codon) {
+//makeSeqMap concatenates the CDS regions in order of their start positions,
+//and returns the sequences along with where each CDS region is in them
+func makeSeqMap(startSlice []int, alnFile string, codonOffset int, policy string) (seqMap map[string][]Codon, genes []geneRegion) {
 	seqMap = make(map[string][]Codon)
+	chooseLongestCopies(policy, alnFile)
 	for _, i := range startSlice {
 		a := getGene(alnFile, i)
-		addCodons(a, seqMap, codonOffset)
+		duplicates := addCodons(a, seqMap, codonOffset, policy)
+		genes = addGeneRegion(genes, a, i, codonOffset, nil, duplicates)
 	}
-	return seqMap
+	return seqMap, genes
 }
 
-func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int) (seqMap map[string][]Codon) {
+func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int, policy string) (seqMap map[string][]Codon, genes []geneRegion) {
 	seqMap = make(map[string][]Codon)
+	chooseLongestCopies(policy, alnFile, mateAln)
 	for _, i := range startSlice {
 		// get the gene alignment from the first file
 		aln1 := getGene(alnFile, i)
@@ -147,9 +316,10 @@ func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int)
 		aln2 := getGene(mateAln, i)
 		// add on the alignment 2 sequences onto alignment 1
 		aln1.Sequences = append(aln1.Sequences, aln2.Sequences...)
-		addCodons(aln1, seqMap, codonOffset)
+		duplicates := addCodons(aln1, seqMap, codonOffset, policy)
+		genes = addGeneRegion(genes, aln1, i, codonOffset, nil, duplicates)
 	}
-	return seqMap
+	return seqMap, genes
 }
 
 func getGene(alnFile string, startCodon int) (gene Alignment) {
@@ -165,16 +335,14 @@ func getGene(alnFile string, startCodon int) (gene Alignment) {
 }
 
 func getStartPos(aln Alignment) int {
-	genomePos := aln.genePos
-	terms := strings.Split(genomePos, "+")
-	startPos, _ := strconv.Atoi(terms[0])
-	return startPos
+	return aln.start
 }
 
 // Alignment is an array of mutliple sequences with same length.
 type Alignment struct {
 	ID        string //gene ID
-	genePos   string // position of gene on the genome
+	start     int    // position of gene on the genome
+	stop      int
 	Sequences []seq.Sequence
 }
 
@@ -223,10 +391,8 @@ func readAlignments(file string) (alnChan chan Alignment) {
 
 		c := readXMFA(file)
 		for alignment := range c {
-			header := strings.Split(alignment[0].Id, " ")
-			alnID := header[0]
-			genomePos := header[1]
-			alnChan <- Alignment{ID: alnID, genePos: genomePos, Sequences: alignment}
+			header := headers.parse(alignment[0].Id)
+			alnChan <- Alignment{ID: header.gene, start: header.start, stop: header.stop, Sequences: alignment}
 		}
 	}()
 
@@ -282,45 +448,32 @@ func mustOpen(file string) (f *os.File) {
 	return
 }
 
+//getNames reads the gene and strain names from a sequence header (see --header-format)
 func getNames(s string) (geneName, genomeName string) {
-	terms := strings.Split(s, " ")
-	//this is the genomeName for the MSA files assembled from ReferenceAlignmentGenerator
-	geneName = terms[0]
-	genomeName = terms[2]
-	return
+	header := headers.parse(s)
+	return header.gene, header.strain
 }
 
-//addCodons adds codons to each strain sequence in the sequence map
-func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int) {
+//addCodons adds codons to each strain sequence in the sequence map, keeping or renaming strains
+//which appear more than once according to the duplicate-name policy, and returns those duplicates
+func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int, policy string) []strainDuplicate {
+	seqs, names, dups := uniqueStrains(a, policy)
+	reportDuplicates(dups)
 	//add codons to the map for each sequence
 	var wg sync.WaitGroup
 	//tell wg how many threads will be running concurrently
-	wg.Add(len(a.Sequences))
+	wg.Add(len(seqs))
 	//mutex lock for safe access to seqMap
 	var mutex = &sync.Mutex{}
-	alnSeqs := a.Sequences
-	//give duplicate strain names a suffix to differentiate
-	duplicates := make(map[string]int)
-	for j := 0; j < len(alnSeqs); j++ {
+	for j := 0; j < len(seqs); j++ {
 		go func(j int) {
 			defer wg.Done()
-			s := alnSeqs[j]
-			codons := extractCodons(s, codonOffset)
-			_, seqName := getNames(s.Id)
-			//check if the strain name has been done ...
-			mutex.Lock()
-			i, found := duplicates[seqName]
-			//update the count for the strain
-			duplicates[seqName]++
-			mutex.Unlock()
-			if found {
-				id := strconv.Itoa(i)
-				seqName = seqName + "_" + id
-			}
+			codons := extractCodons(seqs[j], codonOffset)
 			mutex.Lock()
-			seqMap[seqName] = append(seqMap[seqName], codons...)
+			seqMap[names[j]] = append(seqMap[names[j]], codons...)
 			mutex.Unlock()
 		}(j)
 	}
 	wg.Wait()
+	return dups
 }
@@ -21,10 +21,11 @@ import (
 	"sync"
 )
 
-// calcQsAll calculates Qs at all positions for a given alignment and writes it to the outputcsv
+// calcQsAll calculates Qs at all positions for a given alignment and writes it to the outputcsv,
+// returning the number of sequence pairs at each lag it wrote
 
-func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, codonOffset, codonPosition, minCodonLen int, maxCodonLen int,
-	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, numDigesters int) {
+func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, codonOffset, codonPosition int, lags lagSet,
+	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, binary, ldStats bool, sites *siteMap, genes *geneMatrix, numDigesters int, ckpt *Checkpoint) (pairs map[int]int) {
 	//get our two lists of codon sequences
 	var cs1 []CodonSequence
 	var cs2 []CodonSequence
@@ -38,38 +39,47 @@ func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, codonOffset, codonPosit
 	}
 	done := make(chan struct{})
 
-	lagChan := startLagChan(done, minCodonLen, maxCodonLen, cs1)
+	//results are written in order of lag, with a few lags in flight per worker
+	ow := newOrderedWriter(outFile, binary, pendingLags(lags, ckpt), 2*numDigesters, sites, ckpt)
+	ow.genes = genes
+	ow.ldStats = ldStats
+	defer ow.Close()
+	lagChan := makeLagChan(done, ow)
 	//start a fixed number of go routines
-	c := make(chan map[pos_key]CorrResult)
+	c := make(chan lagResult)
 	var wg sync.WaitGroup
 	fmt.Printf("starting probability calculations ...\n")
 	for i := 0; i < numDigesters; i++ {
 		wg.Add(1)
-		go calcQsMates(done, lagChan, c, cs1, cs2, synonymous, codingTable, codonPosition, i, &wg)
+		go calcQsMates(done, lagChan, c, cs1, cs2, sites, lags, synonymous, codingTable, codonPosition, i, &wg)
 	}
 
 	go func() {
 		wg.Wait()
 		close(c)
 	}()
-	//end of pipeline; write files ...
+	//end of pipeline; write files in order and mark each lag as done
 	for res := range c {
-		writeCsvOut(outFile, res)
+		ow.Write(res)
 	}
+	return ow.pairs
 
 }
 
 //calcQsMates calculates Qs for a given lag across all initial positions
-func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- map[pos_key]CorrResult, cs1, cs2 []CodonSequence, synonymous bool,
+func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- lagResult, cs1, cs2 []CodonSequence, sites *siteMap, lags lagSet, synonymous bool,
 	codingTable *taxonomy.GeneticCode, codonPosition int, id int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	//fmt.Printf("Worker %d starting\n", id)
 	//var results []CorrResult
 	for l := range lagChan {
 		//fmt.Printf("lag %d starting \n", l)
-		corrResMap := mapCorrResMates(cs1, cs2, synonymous, codingTable, codonPosition, l)
+		corrResMap := mapCorrResMates(cs1, cs2, sites, synonymous, codingTable, codonPosition, l)
+		for _, pooled := range lags.pools[l][1:] {
+			poolCorrRes(corrResMap, mapCorrResMates(cs1, cs2, sites, synonymous, codingTable, codonPosition, pooled), l)
+		}
 		select {
-		case resChan <- corrResMap:
+		case resChan <- lagResult{l, corrResMap}:
 			lag := 3 * l
 			fmt.Printf("\rlag %d done", lag)
 		case <-done:
@@ -79,31 +89,35 @@ func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- map[po
 	//fmt.Printf("Worker %d done\n", id)
 }
 
-func mapCorrResMates(cs1, cs2 []CodonSequence, synonymous bool,
+func mapCorrResMates(cs1, cs2 []CodonSequence, sites *siteMap, synonymous bool,
 	codingTable *taxonomy.GeneticCode, codonPosition int, l int) map[pos_key]CorrResult {
 	corrResMap := make(map[pos_key]CorrResult)
 	//loop through initial positions for a given lag
-	for i := 0; i+l < len(cs1[0]); i++ {
+	for _, p := range sites.pairs(l, len(cs1[0])) {
 		//collect P2
 		totalP2 := 0.0
 		totaln := 0
 		//collect probability of difference at site a (Pa) and b (Pb)
 		totalPa := 0.0
 		totalPb := 0.0
-		j := i + l
+		i, j := p.i, p.j
 		if _, ok := corrResMap[pos_key{i, j}]; !ok {
 			//get codonPairs, which are two codons on the same sequence
 			//separated by a distance i+l
-			cpList1 := extractCodonPairs(cs1, i, j, codingTable, synonymous)
-			cpList2 := extractCodonPairs(cs2, i, j, codingTable, synonymous)
-			for _, cp1 := range cpList1 {
+			cpList1 := extractCodonPairs(cs1, sites.local(i), sites.local(j), codingTable, synonymous)
+			cpList2 := extractCodonPairs(cs2, sites.local(i), sites.local(j), codingTable, synonymous)
+			//classes of either clade which meet a class of the other
+			matched1 := make([]bool, len(cpList1))
+			matched2 := make([]bool, len(cpList2))
+			for k1, cp1 := range cpList1 {
 				nc1, nc1A, nc1B := doubleCodonsAll(cp1, codonPosition)
-				for _, cp2 := range cpList2 {
+				for k2, cp2 := range cpList2 {
 					nc2, nc2A, nc2B := doubleCodonsAll(cp2, codonPosition)
 					if synonymous {
 						aa1 := translateCodonPair(cp1[0], codingTable)
 						aa2 := translateCodonPair(cp2[0], codingTable)
 						if aa1 == aa2 {
+							matched1[k1], matched2[k2] = true, true
 							xy, n := nc1.MateP11(nc2, 0)
 							xx, _ := nc1A.MateP11(nc2A, 0)
 							yy, _ := nc1B.MateP11(nc2B, 0)
@@ -117,6 +131,18 @@ func mapCorrResMates(cs1, cs2 []CodonSequence, synonymous bool,
 					}
 				}
 			}
+			classes := [][]CodonPair{}
+			for k, cp := range cpList1 {
+				if matched1[k] {
+					classes = append(classes, cp)
+				}
+			}
+			for k, cp := range cpList2 {
+				if matched2[k] {
+					classes = append(classes, cp)
+				}
+			}
+			hap := countHaplotypes(classes, codonPosition)
 			if totaln > 0 {
 				res1 := CorrResult{
 					x_pos:    i * 3,
@@ -127,6 +153,7 @@ func mapCorrResMates(cs1, cs2 []CodonSequence, synonymous bool,
 					P1b:      totalPb / float64(totaln),
 					N:        totaln,
 					Type:     "P2",
+					hap:      hap,
 				}
 				//results = append(results, res1)
 				corrResMap[pos_key{i, j}] = res1
@@ -142,6 +169,7 @@ func mapCorrResMates(cs1, cs2 []CodonSequence, synonymous bool,
 					P1b:      math.NaN(),
 					N:        totaln,
 					Type:     "P2",
+					hap:      hap,
 				}
 				corrResMap[pos_key{i, j}] = res1
 			}
@@ -172,27 +200,3 @@ func translateCodonPair(cp CodonPair, codingTable *taxonomy.GeneticCode) string
 	b := codingTable.Table[string(cp.B)]
 	return string([]byte{a, b})
 }
-
-//startLagChan returns a channel of lags
-func startLagChan(done <-chan struct{}, minCodonLen int, maxCodonLen int, codonSequences []CodonSequence) <-chan int {
-	lagChan := make(chan int)
-	var maxlag int
-	var minlag int
-	if maxCodonLen == 0 {
-		maxlag = len(codonSequences[0])
-		minlag = 0
-	} else {
-		maxlag = maxCodonLen
-		minlag = minCodonLen
-	}
-	go func() {
-		defer close(lagChan)
-		for l := minlag; l < maxlag; l++ {
-			select {
-			case lagChan <- l:
-			case <-done:
-			}
-		}
-	}()
-	return lagChan
-}
@@ -0,0 +1,139 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// provenance records how an output was made as "key=value" pairs: the program and its version,
+// the value of every argument and flag of the command which was run, and whatever else the
+// command adds (genetic code, input checksum, number of strains and codons, ...).
+// csv outputs start with the pairs as "# key=value" lines; other outputs get a <file>.meta.json sidecar.
+type provenance struct {
+	keys   []string
+	values map[string]string
+}
+
+// newProvenance starts the provenance of a run of command (empty for programs without commands).
+func newProvenance(app *kingpin.Application, command string) *provenance {
+	m := app.Model()
+	p := &provenance{values: make(map[string]string)}
+	p.Set("program", m.Name)
+	p.Set("version", m.Version)
+	if command != "" {
+		p.Set("command", command)
+	}
+	p.addModel(m.Flags, m.Args)
+	for _, cmd := range m.FlattenedCommands() {
+		if cmd.FullCommand == command {
+			p.addModel(cmd.Flags, cmd.Args)
+		}
+	}
+	return p
+}
+
+func (p *provenance) addModel(flags []*kingpin.FlagModel, args []*kingpin.ArgModel) {
+	for _, a := range args {
+		p.Set(a.Name, a.Value)
+	}
+	for _, f := range flags {
+		if f.Hidden || f.Name == "help" || f.Name == "version" {
+			continue
+		}
+		p.Set(f.Name, f.Value)
+	}
+}
+
+// Set records a value, replacing any earlier value of key.
+func (p *provenance) Set(key string, value interface{}) {
+	if _, found := p.values[key]; !found {
+		p.keys = append(p.keys, key)
+	}
+	p.values[key] = fmt.Sprint(value)
+}
+
+// Get returns the value of key, or an empty string.
+func (p *provenance) Get(key string) string {
+	return p.values[key]
+}
+
+// Lines returns the "key=value" pairs in the order they were set.
+func (p *provenance) Lines() (lines []string) {
+	for _, k := range p.keys {
+		lines = append(lines, k+"="+p.values[k])
+	}
+	return
+}
+
+// WriteHeader writes the pairs as "# key=value" lines at the top of a csv file.
+func (p *provenance) WriteHeader(w io.Writer) {
+	for _, line := range p.Lines() {
+		if _, err := io.WriteString(w, "# "+line+"\n"); err != nil {
+			log.Fatalf("failed writing provenance: %v", err)
+		}
+	}
+}
+
+// WriteSidecar writes the pairs as a json object to <file>.meta.json.
+func (p *provenance) WriteSidecar(file string) {
+	var b strings.Builder
+	b.WriteString("{\n")
+	for i, k := range p.keys {
+		key, _ := json.Marshal(k)
+		value, _ := json.Marshal(p.values[k])
+		b.WriteString(fmt.Sprintf("  %s: %s", key, value))
+		if i < len(p.keys)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n")
+	if err := ioutil.WriteFile(file+".meta.json", []byte(b.String()), 0644); err != nil {
+		log.Fatalf("failed writing provenance: %v", err)
+	}
+}
+
+// readSidecar reads the provenance in <file>.meta.json, or returns nil if there is none.
+func readSidecar(file string) *provenance {
+	b, err := ioutil.ReadFile(file + ".meta.json")
+	if err != nil {
+		return nil
+	}
+	p := &provenance{values: make(map[string]string)}
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	if _, err := dec.Token(); err != nil {
+		log.Fatalf("Error when reading %s.meta.json: %v", file, err)
+	}
+	for dec.More() {
+		var key, value string
+		t, err := dec.Token()
+		if err == nil {
+			key, _ = t.(string)
+			err = dec.Decode(&value)
+		}
+		if err != nil {
+			log.Fatalf("Error when reading %s.meta.json: %v", file, err)
+		}
+		p.Set(key, value)
+	}
+	return p
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/kussell-lab/biogo/seq"
+	"log"
+)
+
+// refGap marks an alignment column where the reference has a gap.
+const refGap = -1
+
+// reference holds a reference genome aligned to the CDS regions, which is used to give
+// positions in reference coordinates: either a strain within the alignment, or
+// the aligned reference sequence of each CDS region read from a FASTA file.
+type reference struct {
+	name string            // strain name of the reference in the alignment
+	seqs map[string][]byte // aligned reference sequences by gene ID, from a FASTA file
+}
+
+// loadReference returns the reference named by --ref-name or read from --ref-fasta,
+// or nil if neither is given.
+func loadReference(name, fastaFile string) *reference {
+	if name != "" && fastaFile != "" {
+		log.Fatalf("give either --ref-name or --ref-fasta, not both")
+	}
+	if name != "" {
+		return &reference{name: name}
+	}
+	if fastaFile == "" {
+		return nil
+	}
+	f := mustOpen(fastaFile)
+	defer f.Close()
+	ref := &reference{seqs: make(map[string][]byte)}
+	seqs, err := seq.NewFastaReader(f).ReadAll()
+	if err != nil {
+		log.Fatalf("Error when reading %s: %v", fastaFile, err)
+	}
+	for _, s := range seqs {
+		if _, found := ref.seqs[s.Id]; found {
+			log.Fatalf("%s has more than one sequence for CDS region %s", fastaFile, s.Id)
+		}
+		ref.seqs[s.Id] = s.Seq
+	}
+	return ref
+}
+
+// columns returns the reference coordinate of each alignment column of the CDS region a
+// from codonOffset on, counting the reference bases from start, the gene start in the XMFA header.
+// Columns where the reference has a gap are refGap.
+func (ref *reference) columns(a Alignment, start, codonOffset int) (cols []int) {
+	var refSeq []byte
+	if ref.seqs != nil {
+		refSeq = ref.seqs[a.ID]
+		if refSeq == nil {
+			log.Fatalf("the reference FASTA has no sequence for CDS region %s", a.ID)
+		}
+	} else {
+		for _, s := range a.Sequences {
+			if _, strain := getNames(s.Id); strain == ref.name {
+				refSeq = s.Seq
+				break
+			}
+		}
+		if refSeq == nil {
+			log.Fatalf("reference %s is not in the alignment of CDS region %s", ref.name, a.ID)
+		}
+	}
+	if len(a.Sequences) > 0 && len(refSeq) != len(a.Sequences[0].Seq) {
+		log.Fatalf("the reference of CDS region %s has %d columns but the alignment has %d",
+			a.ID, len(refSeq), len(a.Sequences[0].Seq))
+	}
+	pos := start
+	for i, b := range refSeq {
+		c := pos
+		if b == '-' || b == '.' {
+			c = refGap
+		} else {
+			pos++
+		}
+		if i >= codonOffset {
+			cols = append(cols, c)
+		}
+	}
+	return
+}
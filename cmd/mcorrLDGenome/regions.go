@@ -0,0 +1,145 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// restrict limits the site pairs to those with the first site (x) in the regions and the second
+// in the regions of regionsB; no regions leaves a site unrestricted.
+func (m *siteMap) restrict(regions, regionsB []string) {
+	m.inA = m.selectRegions(regions, "--region")
+	m.inB = m.selectRegions(regionsB, "--region-b")
+	for i, in := range m.inA {
+		if in {
+			m.sitesA = append(m.sitesA, i)
+		}
+	}
+}
+
+// window returns the CDS regions genes[first:last] holding both sites of every pair in the regions
+// at lags below maxlag, so that only their codons need to be loaded, and counts the codons of the
+// loaded sequences from the first of them.
+func (m *siteMap) window(genes []geneRegion, maxlag int) (first, last int) {
+	if m.inA == nil && m.inB == nil {
+		return 0, len(genes)
+	}
+	//the loaded codons run from lo to hi
+	lo, hi := len(m.gene), -1
+	if m.byPos == nil {
+		//the second site is at most maxlag-1 codons after the first
+		minA, maxA := 0, len(m.gene)-1
+		if m.sitesA != nil {
+			minA, maxA = m.sitesA[0], m.sitesA[len(m.sitesA)-1]
+		}
+		minB, maxB := 0, len(m.gene)-1
+		if m.inB != nil {
+			minB, maxB = len(m.gene), -1
+			for i, in := range m.inB {
+				if in {
+					minB, maxB = minInt(minB, i), maxInt(maxB, i)
+				}
+			}
+		}
+		lo, hi = maxInt(minA, minB-maxlag+1), minInt(maxA+maxlag-1, maxB)
+	} else {
+		add := func(i int) {
+			lo, hi = minInt(lo, i), maxInt(hi, i)
+		}
+		//the second site is at most 3*maxlag-1 bp past the first on the genome, wherever it is in the sequences
+		minPos, maxPos := math.MaxInt32, math.MinInt32
+		for _, i := range m.byPos {
+			if m.inA == nil || m.inA[i] {
+				add(i)
+				minPos, maxPos = minInt(minPos, m.pos[i]), maxInt(maxPos, m.pos[i])
+			}
+		}
+		for _, j := range m.byPos {
+			if (m.inB == nil || m.inB[j]) && m.pos[j] >= minPos && m.pos[j] < maxPos+3*maxlag {
+				add(j)
+			}
+		}
+	}
+	if hi < lo {
+		log.Fatalf("no site pairs have their first site in --region and their second in --region-b at these lags")
+	}
+	for first < len(genes)-1 && genes[first].StartCodon+genes[first].NumCodons <= lo {
+		first++
+	}
+	last = first
+	for last < len(genes) && genes[last].StartCodon <= hi {
+		last++
+	}
+	m.first = genes[first].StartCodon
+	return
+}
+
+// selectRegions returns which codons lie in any of the regions, each the name of a CDS region or
+// genome coordinates "<start>-<end>" (inclusive), or nil if there are no regions.
+func (m *siteMap) selectRegions(regions []string, flag string) (in []bool) {
+	if len(regions) == 0 {
+		return nil
+	}
+	in = make([]bool, len(m.gene))
+	for _, region := range regions {
+		found := false
+		for i, g := range m.gene {
+			if m.genes[g] == region {
+				in[i], found = true, true
+			}
+		}
+		if start, end, ok := parseCoordinates(region); ok && !found {
+			for i, pos := range m.pos {
+				if pos != refGap && pos >= start && pos <= end {
+					in[i], found = true, true
+				}
+			}
+		}
+		if !found {
+			log.Fatalf("%s %q holds no codons: it should be a CDS region (%s) or genome coordinates <start>-<end>",
+				flag, region, strings.Join(m.genes, ", "))
+		}
+	}
+	return
+}
+
+// parseCoordinates reads genome coordinates "<start>-<end>".
+func parseCoordinates(region string) (start, end int, ok bool) {
+	fields := strings.Split(region, "-")
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(fields[0]))
+	end, err2 := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	if end < start {
+		log.Fatalf("region %q ends before it starts", region)
+	}
+	return start, end, true
+}
+
+// inRegions reports whether the site pair at codons i and j lies in the regions.
+func (m *siteMap) inRegions(i, j int) bool {
+	if m == nil {
+		return true
+	}
+	return (m.inA == nil || m.inA[i]) && (m.inB == nil || m.inB[j])
+}
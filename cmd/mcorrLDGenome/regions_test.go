@@ -0,0 +1,91 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testGenes are three CDS regions of 10 codons, 70 bp apart on the genome.
+func testGenes() []geneRegion {
+	return []geneRegion{
+		{ID: "a", Start: 1, StartCodon: 0, NumCodons: 10},
+		{ID: "b", Start: 101, StartCodon: 10, NumCodons: 10},
+		{ID: "c", Start: 201, StartCodon: 20, NumCodons: 10},
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tests := []struct {
+		regions, regionsB []string
+		genomic           bool
+		maxlag            int
+		first, last       int
+	}{
+		{nil, nil, false, 5, 0, 3},
+		{[]string{"b"}, nil, false, 5, 1, 3},
+		{[]string{"a"}, []string{"a"}, false, 30, 0, 1},
+		{nil, []string{"c"}, false, 3, 1, 3},
+		{[]string{"1-12"}, nil, false, 2, 0, 1},
+		{[]string{"b"}, []string{"b", "c"}, false, 2, 1, 3},
+		{[]string{"a"}, nil, true, 40, 0, 2},
+		{[]string{"a"}, nil, true, 5, 0, 1},
+		{nil, []string{"c"}, true, 10, 0, 3},
+	}
+	for _, tt := range tests {
+		genes := testGenes()
+		full := newSiteMap(genes, 2)
+		full.restrict(tt.regions, tt.regionsB)
+		sites := newSiteMap(genes, 2)
+		sites.restrict(tt.regions, tt.regionsB)
+		if tt.genomic {
+			full.useGenomicLags(tt.maxlag)
+			sites.useGenomicLags(tt.maxlag)
+		}
+		first, last := sites.window(genes, tt.maxlag)
+		if first != tt.first || last != tt.last {
+			t.Errorf("window of %v, %v (genomic %t) at lags below %d = genes %d to %d, want %d to %d",
+				tt.regions, tt.regionsB, tt.genomic, tt.maxlag, first, last, tt.first, tt.last)
+			continue
+		}
+		//the loaded CDS regions give the same site pairs as all of them
+		loaded := 0
+		for _, g := range genes[first:last] {
+			loaded += g.NumCodons
+		}
+		for l := 0; l < tt.maxlag; l++ {
+			got, want := sites.pairs(l, loaded), full.pairs(l, len(full.gene))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("pairs of %v, %v (genomic %t) at lag %d = %v, want %v",
+					tt.regions, tt.regionsB, tt.genomic, l, got, want)
+			}
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	genes := testGenes()
+	sites := newSiteMap(genes, 2)
+	sites.restrict([]string{"c"}, nil)
+	sites.window(genes, 3)
+	if got := sites.local(25); got != 5 {
+		t.Errorf("local(25) = %d, want 5", got)
+	}
+	var none *siteMap
+	if got := none.local(25); got != 25 {
+		t.Errorf("local(25) without a site map = %d, want 25", got)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/kussell-lab/biogo/seq"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// geneRegion is a CDS region within the concatenated codon sequences.
+type geneRegion struct {
+	ID         string
+	Start      int // position of the gene on the genome
+	StartCodon int // index of the first codon in the concatenated sequences
+	NumCodons  int
+	RefPos     []int             // reference coordinate of each alignment column from the codon offset, if there is a reference
+	Duplicates []strainDuplicate // strain names which appear more than once in the region
+}
+
+// addGeneRegion appends the CDS region of the alignment a, starting at start on the genome, to genes,
+// placing its columns on the reference ref if there is one.
+func addGeneRegion(genes []geneRegion, a Alignment, start, codonOffset int, ref *reference, duplicates []strainDuplicate) []geneRegion {
+	startCodon := 0
+	if len(genes) > 0 {
+		last := genes[len(genes)-1]
+		startCodon = last.StartCodon + last.NumCodons
+	}
+	gene := geneRegion{
+		ID:         a.ID,
+		Start:      start,
+		StartCodon: startCodon,
+		NumCodons:  len(extractCodons(a.Sequences[0], codonOffset)),
+		Duplicates: duplicates,
+	}
+	if ref != nil {
+		gene.RefPos = ref.columns(a, start, codonOffset)
+	}
+	return append(genes, gene)
+}
+
+// scanGenes returns the CDS regions at the start positions of startSlice, in that order, keeping just
+// the first sequence of each and that of the reference strain, so that the sites can be placed before
+// any codons are loaded. The files are combined as by combinedSeqMap.
+func scanGenes(startSlice []int, codonOffset int, ref *reference, files ...string) (genes []geneRegion) {
+	kept := make(map[int]*Alignment)
+	for k, file := range files {
+		seen := make(map[int]bool)
+		for a := range readAlignments(file) {
+			if seen[a.start] {
+				continue
+			}
+			seen[a.start] = true
+			gene := kept[a.start]
+			if gene == nil {
+				if k > 0 {
+					continue
+				}
+				gene = &Alignment{ID: a.ID, start: a.start, stop: a.stop, Sequences: []seq.Sequence{a.Sequences[0]}}
+				kept[a.start] = gene
+			}
+			if ref != nil && ref.seqs == nil {
+				for _, s := range a.Sequences {
+					if _, strain := getNames(s.Id); strain == ref.name {
+						gene.Sequences = append(gene.Sequences, s)
+						break
+					}
+				}
+			}
+		}
+	}
+	for _, start := range startSlice {
+		genes = addGeneRegion(genes, *kept[start], start, codonOffset, ref, nil)
+	}
+	return
+}
+
+// encodeGenes writes the CDS regions as "<ID>:<start>:<number of codons>" separated by commas,
+// so that they can be kept in the provenance of an LD matrix file.
+func encodeGenes(genes []geneRegion) string {
+	var terms []string
+	for _, g := range genes {
+		terms = append(terms, fmt.Sprintf("%s:%d:%d", g.ID, g.Start, g.NumCodons))
+	}
+	return strings.Join(terms, ",")
+}
+
+// decodeGenes reads CDS regions written by encodeGenes.
+func decodeGenes(s string) (genes []geneRegion) {
+	startCodon := 0
+	for _, term := range strings.Split(s, ",") {
+		fields := strings.Split(term, ":")
+		if len(fields) < 3 {
+			log.Fatalf("malformed CDS region %q", term)
+		}
+		n := len(fields)
+		start, err1 := strconv.Atoi(fields[n-2])
+		numCodons, err2 := strconv.Atoi(fields[n-1])
+		if err1 != nil || err2 != nil {
+			log.Fatalf("malformed CDS region %q", term)
+		}
+		genes = append(genes, geneRegion{
+			ID:         strings.Join(fields[:n-2], ":"),
+			Start:      start,
+			StartCodon: startCodon,
+			NumCodons:  numCodons,
+		})
+		startCodon += numCodons
+	}
+	return
+}
+
+// siteMap gives the CDS region and genome coordinate of each codon in the concatenated sequences.
+// The coordinate is that of the nucleotide compared at the codon (codonPosition, counted from 0):
+// on the reference if the CDS regions have one, and otherwise assuming the codons of a CDS region
+// are consecutive on the genome from its start.
+type siteMap struct {
+	genes  []string // gene IDs
+	gene   []int    // index in genes of each codon
+	pos    []int    // genome coordinate of each codon, or refGap
+	byPos  []int    // with genomic lags, the codons in order of their genome coordinates
+	sorted []int    // and those coordinates
+	inA    []bool   // with --region, whether each codon may be the first site of a pair
+	inB    []bool   // with --region-b, whether each codon may be the second site
+	sitesA []int    // with --region, the codons which may be the first site, in order
+	first  int      // the first codon of the sequences loaded, which start at a CDS region
+}
+
+func newSiteMap(genes []geneRegion, codonPosition int) *siteMap {
+	m := &siteMap{}
+	for g, gene := range genes {
+		m.genes = append(m.genes, gene.ID)
+		for k := 0; k < gene.NumCodons; k++ {
+			m.gene = append(m.gene, g)
+			if gene.RefPos != nil {
+				m.pos = append(m.pos, gene.RefPos[3*k+codonPosition])
+			} else {
+				m.pos = append(m.pos, gene.Start+3*k+codonPosition)
+			}
+		}
+	}
+	return m
+}
+
+// encodeSites writes the genome coordinates of the codons as runs of "<first>:<number of codons>",
+// where each codon in a run is 3 bp after the one before, or "gap:<number of codons>" for
+// codons at reference gaps, separated by commas.
+func (m *siteMap) encodeSites() string {
+	var terms []string
+	for k := 0; k < len(m.pos); {
+		n := 1
+		for k+n < len(m.pos) && ((m.pos[k] == refGap && m.pos[k+n] == refGap) ||
+			(m.pos[k] != refGap && m.pos[k+n] == m.pos[k]+3*n)) {
+			n++
+		}
+		if m.pos[k] == refGap {
+			terms = append(terms, fmt.Sprintf("gap:%d", n))
+		} else {
+			terms = append(terms, fmt.Sprintf("%d:%d", m.pos[k], n))
+		}
+		k += n
+	}
+	return strings.Join(terms, ",")
+}
+
+// decodeSites replaces the genome coordinates of the codons with those written by encodeSites.
+func (m *siteMap) decodeSites(s string) {
+	var pos []int
+	for _, term := range strings.Split(s, ",") {
+		fields := strings.Split(term, ":")
+		if len(fields) != 2 {
+			log.Fatalf("malformed run of sites %q", term)
+		}
+		n, err := strconv.Atoi(fields[1])
+		first := refGap
+		if err == nil && fields[0] != "gap" {
+			first, err = strconv.Atoi(fields[0])
+		}
+		if err != nil {
+			log.Fatalf("malformed run of sites %q", term)
+		}
+		for k := 0; k < n; k++ {
+			if first == refGap {
+				pos = append(pos, refGap)
+			} else {
+				pos = append(pos, first+3*k)
+			}
+		}
+	}
+	if len(pos) != len(m.gene) {
+		log.Fatalf("the sites give %d codons but the CDS regions have %d", len(pos), len(m.gene))
+	}
+	m.pos = pos
+}
+
+// columns returns the g, pos and pos_b columns of the site pair at codons i and j:
+// the gene of site i (or "<gene>|<gene>" when j is in another gene), and the genome
+// coordinates of both sites, which are "ref-gap" at reference gaps. Without a map,
+// they are "all CDS" and "n/a".
+func (m *siteMap) columns(i, j int) (g, pos, posB string) {
+	if m == nil || i >= len(m.gene) || j >= len(m.gene) {
+		return "all CDS", "n/a", "n/a"
+	}
+	g = m.genes[m.gene[i]]
+	if m.gene[j] != m.gene[i] {
+		g += "|" + m.genes[m.gene[j]]
+	}
+	return g, m.coordinate(i), m.coordinate(j)
+}
+
+func (m *siteMap) coordinate(i int) string {
+	if m.pos[i] == refGap {
+		return "ref-gap"
+	}
+	return strconv.Itoa(m.pos[i])
+}
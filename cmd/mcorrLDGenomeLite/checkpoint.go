@@ -0,0 +1,183 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Checkpoint keeps track of the lags which have been written to the output csv,
+// so that an interrupted run can be picked up again with --resume.
+// The checkpoint file starts with the run parameters as "# key=value" lines,
+// followed by one "lag,offset,pairs" line per completed lag, where lag is in nucleotides,
+// offset is the size of the output csv once that lag was written and pairs is the number
+// of sequence pairs written at that lag, so that the run summary covers every lag.
+type Checkpoint struct {
+	file      string
+	outFile   string
+	f         *os.File
+	completed map[int]bool
+	pairs     map[int]int // number of sequence pairs at each completed lag (in codons)
+}
+
+// newCheckpoint starts a new checkpoint file, overwriting any previous one.
+func newCheckpoint(file, outFile string, params []string) *Checkpoint {
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatalf("failed creating checkpoint %s: %v", file, err)
+	}
+	for _, p := range params {
+		f.WriteString("# " + p + "\n")
+	}
+	return &Checkpoint{file: file, outFile: outFile, f: f, completed: make(map[int]bool), pairs: make(map[int]int)}
+}
+
+// resumeCheckpoint reads an existing checkpoint file, checks that it was made with
+// the same parameters and input, and truncates the output csv to the last completed lag
+// so that partially written lags are calculated again; initOut starts the output again if no lag was finished.
+func resumeCheckpoint(file, outFile string, params []string, initOut func(string)) *Checkpoint {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("Error when reading checkpoint %s: %v", file, err)
+	}
+	var header []string
+	completed := make(map[int]bool)
+	pairs := make(map[int]int)
+	var offset int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			header = append(header, strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			continue
+		}
+		terms := strings.Split(line, ",")
+		if len(terms) != 3 {
+			log.Fatalf("malformed line in checkpoint %s: %q (a checkpoint without pair counts cannot be resumed; rerun without --resume)", file, line)
+		}
+		lag, err1 := strconv.Atoi(terms[0])
+		size, err2 := strconv.ParseInt(terms[1], 10, 64)
+		n, err3 := strconv.Atoi(terms[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			log.Fatalf("malformed line in checkpoint %s: %q", file, line)
+		}
+		completed[lag/3] = true
+		pairs[lag/3] = n
+		if size > offset {
+			offset = size
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Error when reading checkpoint %s: %v", file, err)
+	}
+	f.Close()
+
+	if len(header) != len(params) {
+		log.Fatalf("checkpoint %s was made with different parameters; rerun without --resume", file)
+	}
+	for i, p := range params {
+		if header[i] != p {
+			log.Fatalf("checkpoint %s does not match this run (%s, expected %s); rerun without --resume", file, header[i], p)
+		}
+	}
+
+	if len(completed) == 0 {
+		//nothing was finished, so just start the output again
+		initOut(outFile)
+	} else if err := os.Truncate(outFile, offset); err != nil {
+		log.Fatalf("failed to resume output %s: %v", outFile, err)
+	}
+
+	f, err = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("failed opening checkpoint %s: %v", file, err)
+	}
+	return &Checkpoint{file: file, outFile: outFile, f: f, completed: completed, pairs: pairs}
+}
+
+// Completed returns true if lag l (in codons) is already in the output csv.
+func (c *Checkpoint) Completed(l int) bool {
+	if c == nil {
+		return false
+	}
+	return c.completed[l]
+}
+
+// NumCompleted returns the number of completed lags.
+func (c *Checkpoint) NumCompleted() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.completed)
+}
+
+// Pairs returns the number of sequence pairs at each completed lag (in codons).
+func (c *Checkpoint) Pairs() map[int]int {
+	pairs := make(map[int]int)
+	if c == nil {
+		return pairs
+	}
+	for l, n := range c.pairs {
+		pairs[l] = n
+	}
+	return pairs
+}
+
+// Done records that lag l (in codons) has been written to the output csv, with n sequence pairs.
+func (c *Checkpoint) Done(l, n int) {
+	if c == nil {
+		return
+	}
+	info, err := os.Stat(c.outFile)
+	if err != nil {
+		log.Fatalf("failed to checkpoint %s: %v", c.outFile, err)
+	}
+	c.completed[l] = true
+	c.pairs[l] = n
+	c.f.WriteString(fmt.Sprintf("%d,%d,%d\n", l*3, info.Size(), n))
+	c.f.Sync()
+}
+
+// Close closes the checkpoint file.
+func (c *Checkpoint) Close() {
+	if c == nil {
+		return
+	}
+	c.f.Close()
+}
+
+// hashFiles returns the sha256 checksum of the input files.
+func hashFiles(files ...string) string {
+	h := sha256.New()
+	for _, file := range files {
+		f := mustOpen(file)
+		if _, err := io.Copy(h, f); err != nil {
+			log.Fatalf("Error when reading file %s: %v", file, err)
+		}
+		f.Close()
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -15,8 +15,8 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/kussell-lab/mcorr"
 	"github.com/kussell-lab/ncbiftp/taxonomy"
 	"gopkg.in/cheggaaa/pb.v2"
@@ -25,57 +25,50 @@ import (
 	"sync"
 )
 
-// calcQsAll calculates Qs at all positions for a given alignment and writes it to the outputcsv
+// calcQsAll calculates Qs at all positions for a given alignment and writes it to the outputcsv,
+// returning the number of sequence pairs at each lag it wrote
 
-func calcQsAll(codonStarts []int, dbMap map[int]*bolt.DB, codonOffset, codonPosition, minCodonLen int,
-	maxCodonLen int, numCodons int, codingTable *taxonomy.GeneticCode, synonymous bool,
-	outFile string, numDigesters int, bar *pb.ProgressBar) {
+func calcQsAll(store *CodonStore, codonOffset, codonPosition int,
+	lags lagSet, codingTable *taxonomy.GeneticCode, synonymous bool,
+	outFile string, binary, ldStats bool, sites *siteMap, numDigesters int, bar *pb.ProgressBar, ckpt *Checkpoint) (pairs map[int]int) {
 	//numDigesters := 20
 	done := make(chan struct{})
 
-	lagChan := makeLagChan(done, minCodonLen, maxCodonLen)
+	//results are written in order of lag, with a few lags in flight per worker
+	ow := newOrderedWriter(outFile, binary, pendingLags(lags, ckpt), 2*numDigesters, sites, ckpt)
+	ow.ldStats = ldStats
+	defer ow.Close()
+	lagChan := makeLagChan(done, ow)
 	//start a fixed number of go routines
-	c := make(chan map[pos_key]CorrResult)
+	c := make(chan lagResult)
 	var wg sync.WaitGroup
 	fmt.Printf("starting probability calculations ...\n")
 	for i := 0; i < numDigesters; i++ {
 		wg.Add(1)
-		go calcQs(done, lagChan, c, codonStarts, dbMap, numCodons, synonymous, codingTable, codonPosition, i, bar, &wg)
+		go calcQs(done, lagChan, c, store, sites, lags, synonymous, codingTable, codonPosition, i, bar, &wg)
 	}
 
 	go func() {
 		wg.Wait()
 		close(c)
 	}()
-	//end of pipeline; write files ...
+	//end of pipeline; write files in order and mark each lag as done
 	for res := range c {
-		writeCsvOut(outFile, res)
+		ow.Write(res)
 	}
+	return ow.pairs
 
 }
 
-//makeLagChan returns a channel of lags
-func makeLagChan(done <-chan struct{}, minCodonLen int, maxCodonLen int) <-chan int {
-	lagChan := make(chan int)
-	var maxlag int
-	var minlag int
-	maxlag = maxCodonLen
-	minlag = minCodonLen
-	go func() {
-		defer close(lagChan)
-		for l := minlag; l < maxlag; l++ {
-			select {
-			case lagChan <- l:
-			case <-done:
-			}
-		}
-	}()
-	return lagChan
+//lagResult holds the results at all initial positions for a single lag
+type lagResult struct {
+	lag     int
+	results map[pos_key]CorrResult
 }
 
 //calcQs calculates Qs for a given lag across all initial positions
-func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- map[pos_key]CorrResult, codonStarts []int,
-	dbMap map[int]*bolt.DB, numCodons int, synonymous bool, codingTable *taxonomy.GeneticCode,
+func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- lagResult, store *CodonStore,
+	sites *siteMap, lags lagSet, synonymous bool, codingTable *taxonomy.GeneticCode,
 	codonPosition int, id int, bar *pb.ProgressBar, wg *sync.WaitGroup) {
 	defer wg.Done()
 	//fmt.Printf("Worker %d starting\n", id)
@@ -83,9 +76,12 @@ func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- map[pos_key
 	for l := range lagChan {
 		//fmt.Printf("lag %d starting \n", l)
 		// start := time.Now()
-		corrResMap := mapCorrRes(codonStarts, dbMap, numCodons, synonymous, codingTable, codonPosition, l)
+		corrResMap := mapCorrRes(store, sites, synonymous, codingTable, codonPosition, l)
+		for _, pooled := range lags.pools[l][1:] {
+			poolCorrRes(corrResMap, mapCorrRes(store, sites, synonymous, codingTable, codonPosition, pooled), l)
+		}
 		select {
-		case resChan <- corrResMap:
+		case resChan <- lagResult{l, corrResMap}:
 			//lag := 3 * l
 			//duration := time.Since(start)
 			if bar != nil {
@@ -99,11 +95,28 @@ func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- map[pos_key
 	//fmt.Printf("Worker %d done\n", id)
 }
 
-func mapCorrRes(codonStarts []int, dbMap map[int]*bolt.DB, numCodons int, synonymous bool,
+func mapCorrRes(store *CodonStore, sites *siteMap, synonymous bool,
 	codingTable *taxonomy.GeneticCode, codonPosition int, l int) map[pos_key]CorrResult {
 	corrResMap := make(map[pos_key]CorrResult)
+	numCodons := store.Meta.NumCodons
+	//read the codons at both sites in blocks of initial positions,
+	//each within a run of site pairs in the regions so that only the needed codons are read
+	var blockA, blockB [][]Codon
+	blockStart := 0
 	//loop through initial positions for a given lag
 	for i := 0; i+l < numCodons; i++ {
+		if !sites.inRegions(i, i+l) {
+			continue
+		}
+		if i >= blockStart+len(blockA) {
+			blockStart = i
+			blockEnd := blockStart + 1
+			for blockEnd < blockStart+codonBlockSize && blockEnd+l < numCodons && sites.inRegions(blockEnd, blockEnd+l) {
+				blockEnd++
+			}
+			blockA = store.ReadRange(blockStart, blockEnd)
+			blockB = store.ReadRange(blockStart+l, blockEnd+l)
+		}
 		//collect P2
 		totalP2 := 0.0
 		totaln := 0
@@ -123,11 +136,8 @@ func mapCorrRes(codonStarts []int, dbMap map[int]*bolt.DB, numCodons int, synony
 		if _, ok := corrResMap[pos_key{i, j}]; !ok {
 			//get codonPairs, which are two codons on the same sequence
 			//separated by a distance i+l
-			//this is where we can access keymaps to do this
-			var codonsA []Codon
-			var codonsB []Codon
-			codonsA = fetchCodonPartner(i, codonStarts, dbMap, numCodons)
-			codonsB = fetchCodonPartner(j, codonStarts, dbMap, numCodons)
+			codonsA := blockA[i-blockStart]
+			codonsB := blockB[i-blockStart]
 
 			//if codonsA == nil || codonsB == nil {
 			//	continue
@@ -145,8 +155,10 @@ func mapCorrRes(codonStarts []int, dbMap map[int]*bolt.DB, numCodons int, synony
 			} else {
 				multiCodonPairs = append(multiCodonPairs, codonPairs)
 			}
+			classes := [][]CodonPair{}
 			for _, codonPairs := range multiCodonPairs {
 				if len(codonPairs) >= 2 {
+					classes = append(classes, codonPairs)
 					//
 					nc, ncA, ncB := doubleCodonsAll(codonPairs, codonPosition)
 					xy, n := nc.P11(0)
@@ -163,6 +175,7 @@ func mapCorrRes(codonStarts []int, dbMap map[int]*bolt.DB, numCodons int, synony
 
 				}
 			}
+			hap := countHaplotypes(classes, codonPosition)
 			if totaln > 0 {
 				res1 := CorrResult{
 					x_pos:    i * 3,
@@ -173,6 +186,7 @@ func mapCorrRes(codonStarts []int, dbMap map[int]*bolt.DB, numCodons int, synony
 					P1b:      totalPb / float64(totaln),
 					N:        totaln,
 					Type:     "P2",
+					hap:      hap,
 				}
 				//results = append(results, res1)
 				corrResMap[pos_key{i, j}] = res1
@@ -188,6 +202,7 @@ func mapCorrRes(codonStarts []int, dbMap map[int]*bolt.DB, numCodons int, synony
 					P1b:      math.NaN(),
 					N:        totaln,
 					Type:     "P2",
+					hap:      hap,
 				}
 				corrResMap[pos_key{i, j}] = res1
 			}
@@ -215,18 +230,59 @@ func doubleCodonsAll(codonPairs []CodonPair, codonPosition int) (c, ca, cb *mcor
 	return c, ca, cb
 }
 
+//codonBlockSize is the number of initial positions read from the codon store at once
+const codonBlockSize = 1024
+
+// poolCorrRes adds the results of another lag to those of a pool of lags labelled by lag, summing
+// them up by initial position under the key of the first site pair at each position.
+func poolCorrRes(pool, other map[pos_key]CorrResult, lag int) {
+	keys := make(map[int]pos_key)
+	for _, k := range sortedKeys(pool) {
+		if _, found := keys[k.pos_x]; !found {
+			keys[k.pos_x] = k
+		}
+	}
+	for _, k := range sortedKeys(other) {
+		r := other[k]
+		r.Lag = lag * 3
+		pk, found := keys[k.pos_x]
+		if !found {
+			keys[k.pos_x] = k
+			pool[k] = r
+			continue
+		}
+		res := pool[pk]
+		if r.N == 0 {
+			continue
+		}
+		if res.N > 0 {
+			n := float64(res.N + r.N)
+			r.P1a = (res.P1a*float64(res.N) + r.P1a*float64(r.N)) / n
+			r.P1b = (res.P1b*float64(res.N) + r.P1b*float64(r.N)) / n
+			r.totalP11 += res.totalP11
+			r.N += res.N
+			r.P11 = r.totalP11 / n
+			r.hap.add(res.hap)
+		}
+		r.x_pos = res.x_pos
+		pool[pk] = r
+	}
+}
+
 //pos_key for corrResMap
 type pos_key struct {
 	pos_x int
 	lag   int
 }
 
-//initCsvOut initializes the output csv
-func initCsvOut(outFile string) {
+//initCsvOut initializes the output csv, starting with the provenance of the run,
+//with the columns of LD statistics if ldStats is true
+func initCsvOut(outFile string, prov *provenance, ldStats bool) {
 	w, err := os.Create(outFile)
 	if err != nil {
 		panic(err)
 	}
+	prov.WriteHeader(w)
 	w.WriteString("# x: the initial position of the probability\n")
 	w.WriteString("# l: the distance between two genomic positions\n")
 	w.WriteString("# P11: joint probability of difference\n")
@@ -234,46 +290,37 @@ func initCsvOut(outFile string) {
 	w.WriteString("# P1b: probability of difference at site x+l\n")
 	w.WriteString("# n: the total number of seq pairs used for calculation\n")
 	w.WriteString("# t: the type of result: ds is for d_sample, and Qs is for joint probability\n")
-	w.WriteString("# g: the gene name.\n")
-	w.WriteString("# pos: position of gene on the genome.\n")
+	w.WriteString("# g: the gene of site x (<gene>|<gene> when site x+l is in another gene).\n")
+	w.WriteString("# pos: position of site x on the genome.\n")
+	w.WriteString("# pos_b: position of site x+l on the genome.\n")
+	header := "x,l,P11,P1a,P1b,n,t,g,pos,pos_b"
+	if ldStats {
+		w.WriteString("# n_AB, n_Ab, n_aB, n_ab: sequences with the major (A, B) or minor (a, b) base at sites x and x+l.\n")
+		w.WriteString("# D: pAB - pA*pB; Dprime: D/Dmax; r2: D^2/(pA*pa*pB*pb).\n")
+		header += "," + ldStatsHeader
+	}
 
-	w.WriteString("x,l,P11,P1a,P1b,n,t,g,pos\n")
+	w.WriteString(header + "\n")
 	w.Close()
 }
 
-//writeCsvOut writes results to the output csv
-func writeCsvOut(outFile string, results map[pos_key]CorrResult) {
-	f, err := os.OpenFile(outFile, os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-	for _, res := range results {
+//writeCsvRows writes the results of a lag to the output csv in order of initial position,
+//placing both sites on the genome with sites, and adding the LD statistics if ldStats is true
+func writeCsvRows(w *bufio.Writer, results map[pos_key]CorrResult, sites *siteMap, ldStats bool) {
+	for _, k := range sortedKeys(results) {
+		res := results[k]
 		if res.Lag == 0 {
 			res.Type = "ds"
 		} else {
 			res.Type = "Qs"
 		}
-		f.WriteString(fmt.Sprintf("%d,%d,%g,%g,%g,%d,%s,%s,%s\n",
+		g, pos, posB := sites.columns(k.pos_x, k.lag)
+		w.WriteString(fmt.Sprintf("%d,%d,%g,%g,%g,%d,%s,%s,%s,%s",
 			res.x_pos, res.Lag, res.P11, res.P1a, res.P1b, res.N,
-			res.Type, "all CDS", "n/a"))
-	}
-}
-
-func fetchCodonPartner(codonPos int, codonStarts []int, dbMap map[int]*bolt.DB, numCodons int) (codons []Codon) {
-	for idx, k := range codonStarts {
-		var nextStart int
-		if idx+1 < len(codonStarts) {
-			nextStart = codonStarts[idx+1]
-		} else {
-			nextStart = numCodons
-		}
-
-		if codonPos >= k && codonPos < nextStart {
-			db := dbMap[k]
-			codons = getCodons(db, codonPos)
-			break
+			res.Type, g, pos, posB))
+		if ldStats {
+			w.WriteString("," + ldStatsColumns(res.hap))
 		}
+		w.WriteString("\n")
 	}
-	return
 }
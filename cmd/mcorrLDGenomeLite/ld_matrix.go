@@ -0,0 +1,330 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+)
+
+// an LD matrix file (.ldm) holds P11, P1a, P1b and n for each (x, l) with at least one sequence pair.
+// It starts with ldmMagic and the chunk size, followed by chunks of cells, then the index and a footer:
+//
+//	chunk:  lag, first x, number of cells, compressed length (uint32s), then the deflated cells
+//	cell:   x, n (uint32s), P11, P1a, P1b (float64s)
+//	index:  ldmIndexMagic, number of chunks (uint64), then lag, first x, number of cells,
+//	        compressed length (uint32s) and offset (uint64) for each chunk
+//	footer: offset of the index (uint64), ldmEndMagic
+//
+// Each chunk covers up to chunkSize initial positions of a single lag. Positions and lags are in codons,
+// and all numbers are little-endian. A file without a footer (from an interrupted run) can still be read
+// by walking the chunks.
+var (
+	ldmMagic      = []byte("MCORRLD1")
+	ldmIndexMagic = []byte("MCLDINDX")
+	ldmEndMagic   = []byte("MCLDEND\n")
+)
+
+const (
+	ldmHeaderSize      = 12
+	ldmChunkHeaderSize = 16
+	ldmCellSize        = 32
+	ldmIndexEntrySize  = 24
+	ldmFooterSize      = 16
+	ldmChunkSize       = 4096
+)
+
+// ldChunk is an entry in the index of an LD matrix file.
+type ldChunk struct {
+	lag      int // in codons
+	xStart   int // in codons
+	numCells int
+	compLen  int
+	offset   int64 // of the chunk header
+}
+
+// ldCell is the result at a single (x, l), with positions in codons.
+type ldCell struct {
+	x, lag        int
+	n             int
+	p11, p1a, p1b float64
+}
+
+// ldMatrixWriter appends chunks of lags to an LD matrix file and keeps the index.
+type ldMatrixWriter struct {
+	w         io.Writer
+	offset    int64
+	chunkSize int
+	index     []ldChunk
+}
+
+// initLDMatrixOut starts a new LD matrix file.
+func initLDMatrixOut(outFile string) {
+	f, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	header := make([]byte, ldmHeaderSize)
+	copy(header, ldmMagic)
+	binary.LittleEndian.PutUint32(header[8:], ldmChunkSize)
+	if _, err := f.Write(header); err != nil {
+		log.Fatalf("failed writing %s: %v", outFile, err)
+	}
+}
+
+// newLDMatrixWriter appends to the LD matrix file f through w, picking up the chunks already in f.
+func newLDMatrixWriter(f *os.File, w io.Writer) *ldMatrixWriter {
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	chunkSize, index, end := readLDMatrixChunks(f, info.Size(), f.Name())
+	if end != info.Size() {
+		log.Fatalf("%s has a trailing index or a partial chunk; it cannot be appended to", f.Name())
+	}
+	return &ldMatrixWriter{w: w, offset: end, chunkSize: chunkSize, index: index}
+}
+
+// WriteLag writes the cells of a lag with at least one sequence pair, in order of initial position.
+func (m *ldMatrixWriter) WriteLag(lag int, results map[pos_key]CorrResult) {
+	var cells []ldCell
+	for _, k := range sortedKeys(results) {
+		res := results[k]
+		if res.N == 0 {
+			continue
+		}
+		cells = append(cells, ldCell{x: k.pos_x, lag: lag, n: res.N, p11: res.P11, p1a: res.P1a, p1b: res.P1b})
+	}
+	for len(cells) > 0 {
+		xStart := cells[0].x - cells[0].x%m.chunkSize
+		end := sort.Search(len(cells), func(i int) bool { return cells[i].x >= xStart+m.chunkSize })
+		m.writeChunk(lag, xStart, cells[:end])
+		cells = cells[end:]
+	}
+}
+
+func (m *ldMatrixWriter) writeChunk(lag, xStart int, cells []ldCell) {
+	var raw bytes.Buffer
+	cell := make([]byte, ldmCellSize)
+	for _, c := range cells {
+		binary.LittleEndian.PutUint32(cell[0:], uint32(c.x))
+		binary.LittleEndian.PutUint32(cell[4:], uint32(c.n))
+		binary.LittleEndian.PutUint64(cell[8:], math.Float64bits(c.p11))
+		binary.LittleEndian.PutUint64(cell[16:], math.Float64bits(c.p1a))
+		binary.LittleEndian.PutUint64(cell[24:], math.Float64bits(c.p1b))
+		raw.Write(cell)
+	}
+	var comp bytes.Buffer
+	zw, err := flate.NewWriter(&comp, flate.DefaultCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	zw.Write(raw.Bytes())
+	zw.Close()
+
+	header := make([]byte, ldmChunkHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(lag))
+	binary.LittleEndian.PutUint32(header[4:], uint32(xStart))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(cells)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(comp.Len()))
+	m.write(header)
+	m.write(comp.Bytes())
+	m.index = append(m.index, ldChunk{lag: lag, xStart: xStart, numCells: len(cells),
+		compLen: comp.Len(), offset: m.offset - int64(comp.Len()) - ldmChunkHeaderSize})
+}
+
+// WriteIndex writes the index and footer; nothing can be appended afterwards.
+func (m *ldMatrixWriter) WriteIndex() {
+	indexOffset := m.offset
+	header := make([]byte, 16)
+	copy(header, ldmIndexMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(m.index)))
+	m.write(header)
+	entry := make([]byte, ldmIndexEntrySize)
+	for _, c := range m.index {
+		binary.LittleEndian.PutUint32(entry[0:], uint32(c.lag))
+		binary.LittleEndian.PutUint32(entry[4:], uint32(c.xStart))
+		binary.LittleEndian.PutUint32(entry[8:], uint32(c.numCells))
+		binary.LittleEndian.PutUint32(entry[12:], uint32(c.compLen))
+		binary.LittleEndian.PutUint64(entry[16:], uint64(c.offset))
+		m.write(entry)
+	}
+	footer := make([]byte, ldmFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(indexOffset))
+	copy(footer[8:], ldmEndMagic)
+	m.write(footer)
+}
+
+func (m *ldMatrixWriter) write(b []byte) {
+	if _, err := m.w.Write(b); err != nil {
+		log.Fatalf("failed writing output: %v", err)
+	}
+	m.offset += int64(len(b))
+}
+
+// readLDMatrixChunks walks the chunks of an LD matrix file of the given size, and returns the chunk size,
+// the index and the offset where the complete chunks end (the start of the index, if there is one).
+func readLDMatrixChunks(r io.ReaderAt, size int64, name string) (chunkSize int, index []ldChunk, end int64) {
+	header := make([]byte, ldmHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil || !bytes.Equal(header[:8], ldmMagic) {
+		log.Fatalf("%s is not an LD matrix file", name)
+	}
+	chunkSize = int(binary.LittleEndian.Uint32(header[8:]))
+	end = ldmHeaderSize
+	ch := make([]byte, ldmChunkHeaderSize)
+	for {
+		n, err := r.ReadAt(ch, end)
+		if n < ldmChunkHeaderSize || bytes.Equal(ch[:8], ldmIndexMagic) {
+			if err != nil && err != io.EOF {
+				log.Fatalf("Error when reading %s: %v", name, err)
+			}
+			return
+		}
+		c := ldChunk{
+			lag:      int(binary.LittleEndian.Uint32(ch[0:])),
+			xStart:   int(binary.LittleEndian.Uint32(ch[4:])),
+			numCells: int(binary.LittleEndian.Uint32(ch[8:])),
+			compLen:  int(binary.LittleEndian.Uint32(ch[12:])),
+			offset:   end,
+		}
+		if end+ldmChunkHeaderSize+int64(c.compLen) > size {
+			//a chunk cut short by an interrupted run
+			return
+		}
+		index = append(index, c)
+		end += ldmChunkHeaderSize + int64(c.compLen)
+	}
+}
+
+// LDMatrix is an LD matrix file opened for reading.
+type LDMatrix struct {
+	f         *os.File
+	chunkSize int
+	index     []ldChunk // sorted by lag, then first x
+}
+
+// openLDMatrix opens an LD matrix file, reading its index from the footer,
+// or by walking the chunks if the run that wrote it was interrupted.
+func openLDMatrix(file string) *LDMatrix {
+	f := mustOpen(file)
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := &LDMatrix{f: f}
+	size := info.Size()
+	header := make([]byte, ldmHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil || !bytes.Equal(header[:8], ldmMagic) {
+		log.Fatalf("%s is not an LD matrix file", file)
+	}
+	footer := make([]byte, ldmFooterSize)
+	if size >= ldmHeaderSize+ldmFooterSize {
+		f.ReadAt(footer, size-ldmFooterSize)
+	}
+	if !bytes.Equal(footer[8:], ldmEndMagic) {
+		fmt.Printf("%s has no index (interrupted run?), reading all chunks\n", file)
+		m.chunkSize, m.index, _ = readLDMatrixChunks(f, size, file)
+	} else {
+		m.chunkSize = int(binary.LittleEndian.Uint32(header[8:]))
+		indexOffset := int64(binary.LittleEndian.Uint64(footer[0:]))
+		b := make([]byte, size-ldmFooterSize-indexOffset)
+		if _, err := f.ReadAt(b, indexOffset); err != nil || !bytes.Equal(b[:8], ldmIndexMagic) {
+			log.Fatalf("%s has a corrupt index", file)
+		}
+		numChunks := int(binary.LittleEndian.Uint64(b[8:16]))
+		for i := 0; i < numChunks; i++ {
+			e := b[16+i*ldmIndexEntrySize:]
+			m.index = append(m.index, ldChunk{
+				lag:      int(binary.LittleEndian.Uint32(e[0:])),
+				xStart:   int(binary.LittleEndian.Uint32(e[4:])),
+				numCells: int(binary.LittleEndian.Uint32(e[8:])),
+				compLen:  int(binary.LittleEndian.Uint32(e[12:])),
+				offset:   int64(binary.LittleEndian.Uint64(e[16:])),
+			})
+		}
+	}
+	sort.Slice(m.index, func(i, j int) bool {
+		if m.index[i].lag != m.index[j].lag {
+			return m.index[i].lag < m.index[j].lag
+		}
+		return m.index[i].xStart < m.index[j].xStart
+	})
+	return m
+}
+
+// Close closes the LD matrix file.
+func (m *LDMatrix) Close() {
+	m.f.Close()
+}
+
+// Cells calls fn for every stored cell with xMin <= x < xMax and lMin <= l < lMax (in codons),
+// in order of lag, then initial position. Only the chunks which overlap the block are read.
+func (m *LDMatrix) Cells(xMin, xMax, lMin, lMax int, fn func(c ldCell)) {
+	start := sort.Search(len(m.index), func(i int) bool { return m.index[i].lag >= lMin })
+	for _, c := range m.index[start:] {
+		if c.lag >= lMax {
+			break
+		}
+		if c.xStart >= xMax || c.xStart+m.chunkSize <= xMin {
+			continue
+		}
+		for _, cell := range m.readChunk(c) {
+			if cell.x >= xMin && cell.x < xMax {
+				fn(cell)
+			}
+		}
+	}
+}
+
+func (m *LDMatrix) readChunk(c ldChunk) []ldCell {
+	comp := make([]byte, c.compLen)
+	if _, err := m.f.ReadAt(comp, c.offset+ldmChunkHeaderSize); err != nil {
+		log.Fatalf("Error when reading %s: %v", m.f.Name(), err)
+	}
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(comp)))
+	if err != nil || len(raw) != c.numCells*ldmCellSize {
+		log.Fatalf("%s has a corrupt chunk at offset %d", m.f.Name(), c.offset)
+	}
+	cells := make([]ldCell, c.numCells)
+	for i := range cells {
+		b := raw[i*ldmCellSize:]
+		cells[i] = ldCell{
+			x:   int(binary.LittleEndian.Uint32(b[0:])),
+			lag: c.lag,
+			n:   int(binary.LittleEndian.Uint32(b[4:])),
+			p11: math.Float64frombits(binary.LittleEndian.Uint64(b[8:])),
+			p1a: math.Float64frombits(binary.LittleEndian.Uint64(b[16:])),
+			p1b: math.Float64frombits(binary.LittleEndian.Uint64(b[24:])),
+		}
+	}
+	return cells
+}
+
+// ceilCodons converts an exclusive upper bound in base pairs to codons.
+func ceilCodons(bp int) int {
+	if bp > math.MaxInt32-2 {
+		return math.MaxInt32
+	}
+	return (bp + 2) / 3
+}
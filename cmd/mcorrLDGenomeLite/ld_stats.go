@@ -0,0 +1,116 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// haplotypes counts the two-site haplotypes of a site pair, with each site reduced to its
+// major (A, B) and minor (a, b) base: nAB, nAb, naB and nab.
+type haplotypes [4]int
+
+// countHaplotypes counts the haplotypes of the codon pairs in classes at codonPosition.
+// The major and minor bases of each site are its two most common bases (A, T, G, C, in that
+// order on ties) over all the classes; sequences with any other base at either site are left out.
+func countHaplotypes(classes [][]CodonPair, codonPosition int) (h haplotypes) {
+	alphabet := []byte{'A', 'T', 'G', 'C'}
+	var countsA, countsB [256]int
+	for _, codonPairs := range classes {
+		for _, cp := range codonPairs {
+			countsA[cp.A[codonPosition]]++
+			countsB[cp.B[codonPosition]]++
+		}
+	}
+	majorA, minorA := majorMinor(countsA, alphabet)
+	majorB, minorB := majorMinor(countsB, alphabet)
+	for _, codonPairs := range classes {
+		for _, cp := range codonPairs {
+			a, b := cp.A[codonPosition], cp.B[codonPosition]
+			var k int
+			switch {
+			case a == majorA:
+			case a == minorA:
+				k += 2
+			default:
+				continue
+			}
+			switch {
+			case b == majorB:
+			case b == minorB:
+				k++
+			default:
+				continue
+			}
+			h[k]++
+		}
+	}
+	return
+}
+
+// majorMinor returns the most and second most common bases of alphabet in counts;
+// minor is 0 if only one base is seen.
+func majorMinor(counts [256]int, alphabet []byte) (major, minor byte) {
+	for _, c := range alphabet {
+		switch {
+		case counts[c] == 0:
+		case major == 0 || counts[c] > counts[major]:
+			major, minor = c, major
+		case minor == 0 || counts[c] > counts[minor]:
+			minor = c
+		}
+	}
+	return
+}
+
+// add sums up the haplotypes of another set of sequences.
+func (h *haplotypes) add(other haplotypes) {
+	for k := range h {
+		h[k] += other[k]
+	}
+}
+
+// stats returns the linkage disequilibrium D = pAB - pA*pB, D' = D/Dmax (signed, between -1 and 1)
+// and r^2 = D^2/(pA*pa*pB*pb) of the haplotypes. D' and r^2 are NaN when either site is monomorphic,
+// and all three are NaN without haplotypes.
+func (h haplotypes) stats() (d, dPrime, r2 float64) {
+	n := float64(h[0] + h[1] + h[2] + h[3])
+	if n == 0 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	//the sequences with each base, and D scaled by n^2, which keep D' and r^2 exact
+	nA, na := float64(h[0]+h[1]), float64(h[2]+h[3])
+	nB, nb := float64(h[0]+h[2]), float64(h[1]+h[3])
+	dn := float64(h[0])*float64(h[3]) - float64(h[1])*float64(h[2])
+	d = dn / (n * n)
+	if na == 0 || nb == 0 {
+		return d, math.NaN(), math.NaN()
+	}
+	dMax := math.Min(nA*nb, na*nB)
+	if dn < 0 {
+		dMax = math.Min(nA*nB, na*nb)
+	}
+	return d, dn / dMax, dn * dn / (nA * na * nB * nb)
+}
+
+// ldStatsHeader is the header of the extra LD statistics columns of the output csv.
+const ldStatsHeader = "n_AB,n_Ab,n_aB,n_ab,D,Dprime,r2"
+
+// ldStatsColumns formats the haplotypes and their LD statistics as extra csv columns.
+func ldStatsColumns(h haplotypes) string {
+	d, dPrime, r2 := h.stats()
+	return fmt.Sprintf("%d,%d,%d,%d,%g,%g,%g", h[0], h[1], h[2], h[3], d, dPrime, r2)
+}
@@ -16,40 +16,42 @@ package main
 
 // script written by Asher Preska Steinberg (apsteinberg@nyu.edu)
 import (
-	"bufio"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/kussell-lab/biogo/seq"
 	"github.com/kussell-lab/ncbiftp/taxonomy"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/cheggaaa/pb.v2"
-	"io"
 	"log"
 	"os"
 	"runtime"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 // global variables.
 func main() {
-	app := kingpin.New("mcorrLDGenomeLite", "Calculate mutation correlation across CDS regions from boltdb files.")
+	app := kingpin.New("mcorrLDGenomeLite", "Calculate mutation correlation across CDS regions from a codon store.")
 	app.Version("v20211003")
 
-	dbList := app.Flag("boltdb_list", "list of gene boltdb files.").Default("gene_boltdb_list.txt").String()
+	storeFile := app.Flag("store", "codon store made by makeGeneDB, or its manifest.").Default("codon_store.db").String()
 	outPrefix := app.Arg("out", "Output prefix.").Required().String()
 	minl := app.Flag("min-corr-length", "min distance of correlation (base pairs)").Default("0").Int()
-	maxl := app.Flag("max-corr-length", "Max distance of correlation (base pairs)").Default("29265").Int()
-	numCodons := app.Flag("num-codons", "total number of codons (output from makeGeneDB)").Default("9755").Int()
+	maxl := app.Flag("max-corr-length", "Max distance of correlation (base pairs; default: all CDS regions in the store)").Default("0").Int()
 	//mateAln := app.Flag("mate-aln", "Second alignment for calculating between clades").Default("").String()
 	ncpu := app.Flag("num-cpu", "Number of CPUs (default: using all available cores)").Default("0").Int()
 	//mates := app.Flag("between-clades", "just calculate correlations between pairs from different xmfa files").Default("false").Bool()
 	numDigesters := app.Flag("num-threads", "number of threads").Default("8").Int()
 	showProgress := app.Flag("show-progress", "Show progress").Default("true").Bool()
+	format := app.Flag("format", "output format: csv, or binary for a compressed LD matrix file (<out>.ldm; see mcorrLDGenome export)").Default("csv").Enum("csv", "binary")
+	lagSpec := app.Flag("lags", "lags to calculate (base pairs) instead of --min-corr-length to --max-corr-length: a comma-separated list of lags, ranges <min>:<max>[:<step>] and log:<min>:<max>:<n> (n lags evenly spaced on a log scale)").Default("").String()
+	lagBin := app.Flag("lag-bin", "pool the lags into bins of this width (base pairs), writing one row per initial position and bin with the pooled n (0: no pooling)").Default("0").Int()
+	regions := app.Flag("region", "only calculate site pairs whose first site (x) is in this CDS region or genome coordinates <start>-<end> (repeatable; default: anywhere)").Strings()
+	regionsB := app.Flag("region-b", "only calculate site pairs whose second site is in this CDS region or genome coordinates <start>-<end> (repeatable; default: anywhere)").Strings()
+	ldStats := app.Flag("ld-stats", "add the classical LD statistics of each site pair to the csv: the haplotype counts of the major and minor bases at the two sites, D, D' and r^2").Default("false").Bool()
+	keep := app.Flag("keep", "keep the codon store and its manifest once done (--no-keep removes them)").Default("true").Bool()
+	resume := app.Flag("resume", "resume an interrupted run, skipping lags listed in <out>.checkpoint").Default("false").Bool()
 
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	if *ncpu <= 0 {
 		*ncpu = runtime.NumCPU()
@@ -58,98 +60,141 @@ func main() {
 
 	//timer
 	start := time.Now()
+	timer := newPhaseTimer()
+	summary := &runSummary{Program: "mcorrLDGenomeLite"}
 
 	// prepare calculator.
 	//var calculator Calculator
-	codingTable := taxonomy.GeneticCodes()["11"]
-	maxCodonLen := *maxl / 3
-	minCodonLen := *minl / 3
-
 	synonymous := true
 	codonPos := 3
 	codonOffset := 0
 
-	//initialize output csv
-	outFile := *outPrefix + ".csv"
-	initCsvOut(outFile)
-	//number of codons in SARS-CoV-2 genome
-	//numCodons := 29265
-	//if maxCodonLen > numCodons {
-	//	maxCodonLen = numCodons
-	//}
+	//open the codon store
+	storePath, store := openCodonInput(*storeFile)
+	numCodons := store.Meta.NumCodons
+	fmt.Printf("total number of strains: %d\n", len(store.Meta.Strains))
+	fmt.Printf("total number of codons: %d\n", numCodons)
+	for _, g := range store.Meta.Genes {
+		g.ReportGapFilled()
+	}
 
+	//the store knows how long the CDS regions are, so use it to set and check the lags
+	if *maxl == 0 {
+		*maxl = numCodons * 3
+	}
+	if *maxl > numCodons*3 {
+		log.Fatalf("--max-corr-length %d is longer than the %d bp of CDS regions in %s", *maxl, numCodons*3, *storeFile)
+	}
+	if *minl < 0 || *minl >= *maxl {
+		log.Fatalf("--min-corr-length %d must be at least 0 and less than --max-corr-length %d", *minl, *maxl)
+	}
+	codingTable, found := taxonomy.GeneticCodes()[store.Meta.GeneticCode]
+	if !found {
+		log.Fatalf("%s was made with unknown genetic code %q", *storeFile, store.Meta.GeneticCode)
+	}
+	timer.Done("open codon store")
+	summary.summarizeStore(store, codingTable, codonPos-1)
+	timer.Done("summarize codons")
+	maxCodonLen := *maxl / 3
+	minCodonLen := *minl / 3
+	lags := newLagSet(*lagSpec, minCodonLen, maxCodonLen, *lagBin/3)
+
+	sites := newSiteMap(store.Meta.Genes, codonPos-1)
+	sites.restrict(*regions, *regionsB)
+	if *ldStats && *format == "binary" {
+		log.Fatalf("an LD matrix file holds P11, P1a and P1b only, so --ld-stats needs --format=csv")
+	}
+
+	//record the run so that it can be resumed
+	params := []string{
+		"program=mcorrLDGenomeLite",
+		fmt.Sprintf("min-corr-length=%d", *minl),
+		fmt.Sprintf("max-corr-length=%d", *maxl),
+		fmt.Sprintf("synonymous=%t", synonymous),
+		fmt.Sprintf("codon-position=%d", codonPos),
+		"genetic-code=" + store.Meta.GeneticCode,
+		fmt.Sprintf("num-strains=%d", len(store.Meta.Strains)),
+		fmt.Sprintf("num-codons=%d", numCodons),
+		"input-sha256=" + store.Meta.SourceSHA256,
+		"format=" + *format,
+		"lags=" + *lagSpec,
+		fmt.Sprintf("lag-bin=%d", *lagBin),
+		"region=" + strings.Join(*regions, ","),
+		"region-b=" + strings.Join(*regionsB, ","),
+		fmt.Sprintf("ld-stats=%t", *ldStats),
+	}
+	prov := newProvenance(app, command)
+	prov.Set("genetic-code", store.Meta.GeneticCode)
+	prov.Set("synonymous", synonymous)
+	prov.Set("codon-position", codonPos)
+	prov.Set("num-strains", len(store.Meta.Strains))
+	prov.Set("num-codons", numCodons)
+	prov.Set("input-sha256", store.Meta.SourceSHA256)
+	addSourceProvenance(prov, store.Meta.Provenance)
+
+	//initialize output, or pick up where we left off
+	outFile := *outPrefix + ".csv"
+	initOut := func(outFile string) { initCsvOut(outFile, prov, *ldStats) }
+	binary := *format == "binary"
+	if binary {
+		outFile = *outPrefix + ".ldm"
+		initOut = initLDMatrixOut
+		prov.Set("genes", encodeGenes(store.Meta.Genes))
+		prov.WriteSidecar(outFile)
+	}
+	ckptFile := *outPrefix + ".checkpoint"
+	var ckpt *Checkpoint
+	if _, err := os.Stat(ckptFile); *resume && err == nil {
+		ckpt = resumeCheckpoint(ckptFile, outFile, params, initOut)
+		fmt.Printf("resuming with %d lags already done\n", ckpt.NumCompleted())
+	} else {
+		if *resume {
+			fmt.Printf("no checkpoint found at %s, starting from scratch\n", ckptFile)
+		}
+		initOut(outFile)
+		ckpt = newCheckpoint(ckptFile, outFile, params)
+	}
+	defer ckpt.Close()
 	// show progress bar
 	var bar *pb.ProgressBar
 	if *showProgress {
 		//max := maxCodonLen
-		bar = pb.StartNew(maxCodonLen - minCodonLen)
+		bar = pb.StartNew(len(lags.labels) - ckpt.NumCompleted())
 		defer bar.Finish()
 	}
 
-	//make the dbMap
-	dbMap, codonStarts := makeDbMap(*dbList)
-	calcQsAll(codonStarts, dbMap, codonOffset, codonPos-1, minCodonLen,
-		maxCodonLen, *numCodons, codingTable, synonymous, outFile, *numDigesters, bar)
+	pairs := calcQsAll(store, codonOffset, codonPos-1,
+		lags, codingTable, synonymous, outFile, binary, *ldStats, sites, *numDigesters, bar, ckpt)
+	timer.Done("calculate LD")
 
 	//clean up the mess we made
-	//for _, startCodon := range codonStarts {
-	//	os.Remove(strconv.Itoa(startCodon) + ".db")
-	//}
+	store.Close()
+	if !*keep {
+		removeCodonStore(storePath, *storeFile)
+	}
 
 	duration := time.Since(start)
 	fmt.Println("Time to calculate LD:", duration)
+	summary.setLags(pairs)
+	summary.Write(*outPrefix, timer)
 }
 
-func makeSeqMap(startSlice []int, alnFile string, codonOffset int) (seqMap map[string][]Codon) {
-	seqMap = make(map[string][]Codon)
-	for _, i := range startSlice {
-		a, _ := getGene(alnFile, i)
-		addCodons(a, seqMap, codonOffset)
-	}
-	return seqMap
-}
-
-func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int) (seqMap map[string][]Codon) {
-	seqMap = make(map[string][]Codon)
-	for _, i := range startSlice {
-		// get the gene alignment from the first file
-		aln1, _ := getGene(alnFile, i)
-		//get the gene alignment from the second file
-		aln2, _ := getGene(mateAln, i)
-		// add on the alignment 2 sequences onto alignment 1
-		aln1.Sequences = append(aln1.Sequences, aln2.Sequences...)
-		addCodons(aln1, seqMap, codonOffset)
+// removeCodonStore removes a codon store and its manifest.
+func removeCodonStore(storePath, input string) {
+	files := []string{storePath, manifestFile(storePath)}
+	if input != storePath {
+		files = append(files, input)
 	}
-	return seqMap
-}
-
-func getGene(alnFile string, startCodon int) (gene Alignment, stopPos int) {
-	fmt.Printf("retrieving codons starting at " + strconv.Itoa(startCodon) + "\n")
-	c := readAlignments(alnFile)
-	for a := range c {
-		var startPos int
-		startPos, stopPos = getStartStop(a)
-		if startCodon == startPos {
-			gene = a
-			break
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
 		}
 	}
-	return gene, stopPos
-}
-
-// getStartStop get start/stop positions for each gene
-func getStartStop(aln Alignment) (int, int) {
-	genomePos := aln.genePos
-	terms := strings.Split(genomePos, "+")
-	startPos, _ := strconv.Atoi(terms[0])
-	stopPos, _ := strconv.Atoi(terms[1])
-	return startPos, stopPos
 }
 
 // Alignment is an array of mutliple sequences with same length.
 type Alignment struct {
 	ID        string //gene ID
-	genePos   string // position of gene on the genome
 	Sequences []seq.Sequence
 }
 
@@ -162,63 +207,6 @@ func setNumThreads(ncpu int) {
 	runtime.GOMAXPROCS(ncpu)
 }
 
-// readAlignments reads sequence alignment from a extended Multi-FASTA file,
-// and return a channel of alignment, which is a list of seq.Sequence
-func readAlignments(file string) (alnChan chan Alignment) {
-	alnChan = make(chan Alignment)
-	go func() {
-		defer close(alnChan)
-
-		c := readXMFA(file)
-		for alignment := range c {
-			header := strings.Split(alignment[0].Id, " ")
-			alnID := header[0]
-			genomePos := header[1]
-			alnChan <- Alignment{ID: alnID, genePos: genomePos, Sequences: alignment}
-		}
-	}()
-
-	return
-}
-
-// getNumberOfAlignments return total number of alignments in a xmfa file.
-func getNumberOfAlignments(file string) (count int) {
-	c := readXMFA(file)
-	for a := range c {
-		if len(a) >= 2 {
-			count++
-		}
-	}
-	return
-}
-
-// readXMFA reads a xmfa format file and returns a channel of []seq.Sequence.
-func readXMFA(file string) chan []seq.Sequence {
-	c := make(chan []seq.Sequence)
-	go func() {
-		defer close(c)
-
-		f := mustOpen(file)
-		defer f.Close()
-
-		rd := seq.NewXMFAReader(f)
-		for {
-			a, err := rd.Read()
-			if err != nil {
-				if err != io.EOF {
-					panic(err)
-				}
-				break
-			}
-			// can have 1 sequence in both xmfas
-			if len(a) >= 1 {
-				c <- a
-			}
-		}
-	}()
-	return c
-}
-
 // mustOpen is a helper function to open a file.
 // and panic if error occurs.
 func mustOpen(file string) (f *os.File) {
@@ -229,254 +217,3 @@ func mustOpen(file string) (f *os.File) {
 	}
 	return
 }
-
-func getNames(s string) (geneName, genomeName string) {
-	terms := strings.Split(s, " ")
-	//this is the genomeName for the MSA files assembled from ReferenceAlignmentGenerator
-	geneName = terms[0]
-	genomeName = terms[2]
-	return
-}
-
-//addCodons adds codons to each strain sequence in the sequence map
-func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int) {
-	//add codons to the map for each sequence
-	var wg sync.WaitGroup
-	//tell wg how many threads will be running concurrently
-	wg.Add(len(a.Sequences))
-	//mutex lock for safe access to seqMap
-	var mutex = &sync.Mutex{}
-	alnSeqs := a.Sequences
-	//give duplicate strain names a suffix to differentiate
-	duplicates := make(map[string]int)
-	for j := 0; j < len(alnSeqs); j++ {
-		go func(j int) {
-			defer wg.Done()
-			s := alnSeqs[j]
-			codons := extractCodons(s, codonOffset)
-			_, seqName := getNames(s.Id)
-			//check if the strain name has been done ...
-			mutex.Lock()
-			i, found := duplicates[seqName]
-			//update the count for the strain
-			duplicates[seqName]++
-			mutex.Unlock()
-			if found {
-				id := strconv.Itoa(i)
-				seqName = seqName + "_" + id
-			}
-			mutex.Lock()
-			seqMap[seqName] = append(seqMap[seqName], codons...)
-			mutex.Unlock()
-		}(j)
-	}
-	wg.Wait()
-}
-
-//makeStrainMap maps codons to strains
-func makeStrainMap(a Alignment, codonOffset int) (strainMap map[string][]Codon) {
-	strainMap = make(map[string][]Codon)
-	//add codons to the map for each sequence
-	var wg sync.WaitGroup
-	//tell wg how many threads will be running concurrently
-	wg.Add(len(a.Sequences))
-	//mutex lock for safe access to seqMap
-	var mutex = &sync.Mutex{}
-	alnSeqs := a.Sequences
-	//give duplicate strain names a suffix to differentiate
-	duplicates := make(map[string]int)
-	for j := 0; j < len(alnSeqs); j++ {
-		go func(j int) {
-			defer wg.Done()
-			s := alnSeqs[j]
-			codons := extractCodons(s, codonOffset)
-			_, seqName := getNames(s.Id)
-			//check if the strain name has been done ...
-			mutex.Lock()
-			i, found := duplicates[seqName]
-			//update the count for the strain
-			duplicates[seqName]++
-			mutex.Unlock()
-			if found {
-				id := strconv.Itoa(i)
-				seqName = seqName + "_" + id
-			}
-			mutex.Lock()
-			strainMap[seqName] = append(strainMap[seqName], codons...)
-			mutex.Unlock()
-		}(j)
-	}
-	wg.Wait()
-	return
-}
-
-// makeCodonMap assembles the codons of each gene into a map where keys are codon positions
-// and the values are all of the codons for each sequence
-// in the order defined by strain list
-func makeCodonMap(strainMap map[string][]Codon, startCodon int, strainList []string) (codonMap map[int][]Codon) {
-	//add codons for each sequences to a map where the keys are codon positions and the values
-	// are the codon sequence for each position
-	codonMap = make(map[int][]Codon)
-	for _, strain := range strainList {
-		codonSeq := strainMap[strain]
-		for k, cc := range codonSeq {
-			codonPos := startCodon + k
-			codonMap[codonPos] = append(codonMap[codonPos], cc)
-		}
-	}
-	return
-}
-
-// makeCodonDB makes a keymap database for each codon position
-//and return a list of databases ...
-func makeCodonDB(startSlice []int, alnFile string, codonOffset int) (numSeqs int, dbMap map[int]*bolt.DB) {
-	startCodon := 0
-	var codonMap map[int][]Codon
-	dbMap = make(map[int]*bolt.DB)
-	var strainList []string
-	for _, startPos := range startSlice {
-		a, stopPos := getGene(alnFile, startPos)
-		strainMap := makeStrainMap(a, codonOffset)
-		if startCodon == 0 {
-			for strain, _ := range strainMap {
-				strainList = append(strainList, strain)
-			}
-		}
-		codonMap = makeCodonMap(strainMap, startCodon, strainList)
-		//make the name of the database
-		dbName := strconv.Itoa(startCodon)
-		db := createDB(dbName + ".db")
-		createBucket(db, "codons")
-		loadCodons(db, "codons", codonMap)
-		dbMap[startCodon] = db
-		//db.Close()
-		//calculate the first codon position in the next db
-		//get the length of the cds in codons ...
-		cdslen := (stopPos - startPos + 1) / 3
-		startCodon = startCodon + cdslen
-		//fmt.Print(strconv.Itoa(startCodon)+"\n")
-
-	}
-	for _, v := range codonMap {
-		numSeqs = len(v)
-	}
-	return
-}
-
-type codonDB struct {
-	db         *bolt.DB
-	startCodon int
-}
-
-// createDB creates a bolt db.
-func createDB(dbFile string) *bolt.DB {
-	db, err := bolt.Open(dbFile, 0600, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return db
-}
-
-// createBucket creates a bucket.
-func createBucket(db *bolt.DB, bucketName string) {
-	fn := func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		return err
-	}
-
-	err := db.Update(fn)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func loadCodons(db *bolt.DB, bucketName string, codonMap map[int][]Codon) {
-	fn := func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		for pos, codon := range codonMap {
-			//codon position
-			codonPos := strconv.Itoa(pos)
-			//if pos == 5000 {
-			//	print("mammajamma")
-			//}
-			//all of the alleles of the codon for that position
-			codonBytes := CodonstoBytes(codon, 0)
-			err := b.Put([]byte(codonPos), codonBytes)
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
-	}
-
-	err := db.Update(fn)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func getCodons(db *bolt.DB, pos int) (codons []Codon) {
-	fn := func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("codons"))
-		codonPos := strconv.Itoa(pos)
-		v := b.Get([]byte(codonPos))
-		codons = BytestoCodons(v, 0)
-
-		return nil
-	}
-
-	db.View(fn)
-
-	return
-}
-
-// BytestoCodons convert bytes back to codons
-func BytestoCodons(s []byte, offset int) (codons []Codon) {
-	for i := offset; i+3 <= len(s); i += 3 {
-		c := s[i:(i + 3)]
-		codons = append(codons, c)
-	}
-	return
-}
-
-// CodonstoBytes convert codons to bytes
-func CodonstoBytes(codons []Codon, offset int) (s []byte) {
-	for _, cc := range codons {
-		s = append(s, cc...)
-	}
-	return
-}
-
-// makeDbMap returns a dbMap from the list of db files and the list of codon start positions
-func makeDbMap(filename string) (dbMap map[int]*bolt.DB, codonStarts []int) {
-	dbMap = make(map[int]*bolt.DB)
-	f, err := os.Open(filename)
-	if err != nil {
-		log.Fatalf("Error when reading file %s:%v", filename, err)
-	}
-	defer f.Close()
-
-	r := bufio.NewReader(f)
-	for {
-		line, err := r.ReadString('\n')
-
-		if err != nil {
-			if err != io.EOF {
-				log.Fatalf("Error when reading file %s: %v", filename, err)
-			}
-			break
-		}
-		dbName := strings.TrimSpace(line)
-		//might be the source of all the waits on the hpc?
-		db, err := bolt.Open(dbName+".db", 0600, &bolt.Options{Timeout: 1 * time.Second})
-		if err != nil {
-			log.Fatal(err)
-		}
-		//defer db.Close()
-		dbID, _ := strconv.Atoi(dbName)
-		dbMap[dbID] = db
-		codonStarts = append(codonStarts, dbID)
-	}
-	return
-}
@@ -23,8 +23,8 @@ import (
 
 // calcQsAll calculates Qs at all positions for a given alignment and writes it to the outputcsv
 
-func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, codonOffset, codonPosition, minCodonLen int, maxCodonLen int,
-	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, numDigesters int) {
+func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, codonOffset, codonPosition int, lags lagSet,
+	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, binary bool, sites *siteMap, numDigesters int, ckpt *Checkpoint) {
 	//get our two lists of codon sequences
 	var cs1 []CodonSequence
 	var cs2 []CodonSequence
@@ -38,29 +38,32 @@ func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, codonOffset, codonPosit
 	}
 	done := make(chan struct{})
 
-	lagChan := startLagChan(done, minCodonLen, maxCodonLen, cs1)
+	//results are written in order of lag, with a few lags in flight per worker
+	ow := newOrderedWriter(outFile, binary, pendingLags(lags, ckpt), 2*numDigesters, sites, ckpt)
+	defer ow.Close()
+	lagChan := makeLagChan(done, ow)
 	//start a fixed number of go routines
-	c := make(chan map[pos_key]CorrResult)
+	c := make(chan lagResult)
 	var wg sync.WaitGroup
 	fmt.Printf("starting probability calculations ...\n")
 	for i := 0; i < numDigesters; i++ {
 		wg.Add(1)
-		go calcQsMates(done, lagChan, c, cs1, cs2, synonymous, codingTable, codonPosition, i, &wg)
+		go calcQsMates(done, lagChan, c, cs1, cs2, lags, synonymous, codingTable, codonPosition, i, &wg)
 	}
 
 	go func() {
 		wg.Wait()
 		close(c)
 	}()
-	//end of pipeline; write files ...
+	//end of pipeline; write files in order and mark each lag as done
 	for res := range c {
-		writeCsvOut(outFile, res)
+		ow.Write(res)
 	}
 
 }
 
 //calcQsMates calculates Qs for a given lag across all initial positions
-func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- map[pos_key]CorrResult, cs1, cs2 []CodonSequence, synonymous bool,
+func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- lagResult, cs1, cs2 []CodonSequence, lags lagSet, synonymous bool,
 	codingTable *taxonomy.GeneticCode, codonPosition int, id int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	//fmt.Printf("Worker %d starting\n", id)
@@ -68,8 +71,11 @@ func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- map[po
 	for l := range lagChan {
 		//fmt.Printf("lag %d starting \n", l)
 		corrResMap := mapCorrResMates(cs1, cs2, synonymous, codingTable, codonPosition, l)
+		for _, pooled := range lags.pools[l][1:] {
+			poolCorrRes(corrResMap, mapCorrResMates(cs1, cs2, synonymous, codingTable, codonPosition, pooled), l)
+		}
 		select {
-		case resChan <- corrResMap:
+		case resChan <- lagResult{l, corrResMap}:
 			lag := 3 * l
 			fmt.Printf("\rlag %d done", lag)
 		case <-done:
@@ -172,27 +178,3 @@ func translateCodonPair(cp CodonPair, codingTable *taxonomy.GeneticCode) string
 	b := codingTable.Table[string(cp.B)]
 	return string([]byte{a, b})
 }
-
-//startLagChan returns a channel of lags
-func startLagChan(done <-chan struct{}, minCodonLen int, maxCodonLen int, codonSequences []CodonSequence) <-chan int {
-	lagChan := make(chan int)
-	var maxlag int
-	var minlag int
-	if maxCodonLen == 0 {
-		maxlag = len(codonSequences[0])
-		minlag = 0
-	} else {
-		maxlag = maxCodonLen
-		minlag = minCodonLen
-	}
-	go func() {
-		defer close(lagChan)
-		for l := minlag; l < maxlag; l++ {
-			select {
-			case lagChan <- l:
-			case <-done:
-			}
-		}
-	}()
-	return lagChan
-}
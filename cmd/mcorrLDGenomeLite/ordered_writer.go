@@ -0,0 +1,155 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"sort"
+)
+
+// orderedWriter writes lag results to the output in order of lag, and in order of
+// initial position within each lag, through a single buffered handle.
+// Workers finish lags in any order, so results which arrive early are held back until
+// the lags before them are written. Every lag handed out to the workers takes a slot,
+// which is only given back once the lag is written; this bounds the number of lags held in memory.
+type orderedWriter struct {
+	f       *os.File
+	w       *bufio.Writer
+	lags    []int // lags (in codons) in the order they are written
+	next    int   // index in lags of the next lag to write
+	pending map[int]lagResult
+	slots   chan struct{}
+	ckpt    *Checkpoint
+	matrix  *ldMatrixWriter // nil when writing csv
+	sites   *siteMap
+	ldStats bool        // adds the LD statistics of each site pair to the csv
+	pairs   map[int]int // number of sequence pairs written at each lag, including those of a resumed run
+}
+
+// newOrderedWriter opens outFile for appending the results of lags, in order,
+// with at most window lags in flight at once. outFile is an LD matrix file if binary is true,
+// and a csv file otherwise, with the sites of each row placed on the genome with sites.
+func newOrderedWriter(outFile string, binary bool, lags []int, window int, sites *siteMap, ckpt *Checkpoint) *orderedWriter {
+	f, err := os.OpenFile(outFile, os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		log.Fatalf("failed opening output %s: %v", outFile, err)
+	}
+	if window < 1 {
+		window = 1
+	}
+	ow := &orderedWriter{
+		f:       f,
+		w:       bufio.NewWriter(f),
+		lags:    lags,
+		pending: make(map[int]lagResult),
+		slots:   make(chan struct{}, window),
+		ckpt:    ckpt,
+		sites:   sites,
+		pairs:   ckpt.Pairs(),
+	}
+	if binary {
+		ow.matrix = newLDMatrixWriter(f, ow.w)
+	}
+	return ow
+}
+
+// pendingLags returns the lags of the set (the first lag of each pool)
+// which are not already in the checkpoint.
+func pendingLags(set lagSet, ckpt *Checkpoint) (lags []int) {
+	for _, l := range set.labels {
+		if !ckpt.Completed(l) {
+			lags = append(lags, l)
+		}
+	}
+	return
+}
+
+// makeLagChan returns a channel of the lags to calculate,
+// waiting for a free slot in the writer before handing out each lag.
+func makeLagChan(done <-chan struct{}, ow *orderedWriter) <-chan int {
+	lagChan := make(chan int)
+	go func() {
+		defer close(lagChan)
+		for _, l := range ow.lags {
+			select {
+			case ow.slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case lagChan <- l:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return lagChan
+}
+
+// Write holds on to the results of a lag, and writes out every lag which is now next in line;
+// each written lag is flushed and marked as done in the checkpoint.
+func (ow *orderedWriter) Write(res lagResult) {
+	ow.pending[res.lag] = res
+	for _, r := range res.results {
+		ow.pairs[res.lag] += r.N
+	}
+	for ow.next < len(ow.lags) {
+		res, found := ow.pending[ow.lags[ow.next]]
+		if !found {
+			break
+		}
+		if ow.matrix != nil {
+			ow.matrix.WriteLag(res.lag, res.results)
+		} else {
+			writeCsvRows(ow.w, res.results, ow.sites, ow.ldStats)
+		}
+		if err := ow.w.Flush(); err != nil {
+			log.Fatalf("failed writing output: %v", err)
+		}
+		ow.ckpt.Done(res.lag, ow.pairs[res.lag])
+		delete(ow.pending, res.lag)
+		ow.next++
+		<-ow.slots
+	}
+}
+
+// Close flushes and closes the output, adding the index to an LD matrix file
+// once all lags are written.
+func (ow *orderedWriter) Close() {
+	if ow.matrix != nil && ow.next == len(ow.lags) {
+		ow.matrix.WriteIndex()
+	}
+	if err := ow.w.Flush(); err != nil {
+		log.Fatalf("failed writing output: %v", err)
+	}
+	ow.f.Close()
+}
+
+// sortedKeys returns the keys of a lag's results in order of initial position, then lag.
+func sortedKeys(results map[pos_key]CorrResult) []pos_key {
+	keys := make([]pos_key, 0, len(results))
+	for k := range results {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pos_x != keys[j].pos_x {
+			return keys[i].pos_x < keys[j].pos_x
+		}
+		return keys[i].lag < keys[j].lag
+	})
+	return keys
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// restrict limits the site pairs to those with the first site (x) in the regions and the second
+// in the regions of regionsB; no regions leaves a site unrestricted.
+func (m *siteMap) restrict(regions, regionsB []string) {
+	m.inA = m.selectRegions(regions, "--region")
+	m.inB = m.selectRegions(regionsB, "--region-b")
+}
+
+// selectRegions returns which codons lie in any of the regions, each the name of a CDS region or
+// genome coordinates "<start>-<end>" (inclusive), or nil if there are no regions.
+func (m *siteMap) selectRegions(regions []string, flag string) (in []bool) {
+	if len(regions) == 0 {
+		return nil
+	}
+	in = make([]bool, len(m.gene))
+	for _, region := range regions {
+		found := false
+		for i, g := range m.gene {
+			if m.genes[g] == region {
+				in[i], found = true, true
+			}
+		}
+		if start, end, ok := parseCoordinates(region); ok && !found {
+			for i, pos := range m.pos {
+				if pos >= start && pos <= end {
+					in[i], found = true, true
+				}
+			}
+		}
+		if !found {
+			log.Fatalf("%s %q holds no codons: it should be a CDS region (%s) or genome coordinates <start>-<end>",
+				flag, region, strings.Join(m.genes, ", "))
+		}
+	}
+	return
+}
+
+// parseCoordinates reads genome coordinates "<start>-<end>".
+func parseCoordinates(region string) (start, end int, ok bool) {
+	fields := strings.Split(region, "-")
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(fields[0]))
+	end, err2 := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	if end < start {
+		log.Fatalf("region %q ends before it starts", region)
+	}
+	return start, end, true
+}
+
+// inRegions reports whether the site pair at codons i and j lies in the regions.
+func (m *siteMap) inRegions(i, j int) bool {
+	if m == nil {
+		return true
+	}
+	return (m.inA == nil || m.inA[i]) && (m.inB == nil || m.inB[j])
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// encodeGenes writes the CDS regions as "<ID>:<start>:<number of codons>" separated by commas,
+// so that they can be kept in the provenance of an LD matrix file.
+func encodeGenes(genes []GeneRegion) string {
+	var terms []string
+	for _, g := range genes {
+		terms = append(terms, fmt.Sprintf("%s:%d:%d", g.ID, g.Start, g.NumCodons))
+	}
+	return strings.Join(terms, ",")
+}
+
+// siteMap gives the CDS region and genome coordinate of each codon in the concatenated sequences.
+// The coordinate is that of the nucleotide compared at the codon (codonPosition, counted from 0),
+// assuming the codons of a CDS region are consecutive on the genome from its start.
+type siteMap struct {
+	genes []string // gene IDs
+	gene  []int    // index in genes of each codon
+	pos   []int    // genome coordinate of each codon
+	inA   []bool   // with --region, whether each codon may be the first site of a pair
+	inB   []bool   // with --region-b, whether each codon may be the second site
+}
+
+func newSiteMap(genes []GeneRegion, codonPosition int) *siteMap {
+	m := &siteMap{}
+	for g, gene := range genes {
+		m.genes = append(m.genes, gene.ID)
+		for k := 0; k < gene.NumCodons; k++ {
+			m.gene = append(m.gene, g)
+			m.pos = append(m.pos, gene.Start+3*k+codonPosition)
+		}
+	}
+	return m
+}
+
+// columns returns the g, pos and pos_b columns of the site pair at codons i and j:
+// the gene of site i (or "<gene>|<gene>" when j is in another gene), and the genome
+// coordinates of both sites. Without a map, they are "all CDS" and "n/a".
+func (m *siteMap) columns(i, j int) (g, pos, posB string) {
+	if m == nil || i >= len(m.gene) || j >= len(m.gene) {
+		return "all CDS", "n/a", "n/a"
+	}
+	g = m.genes[m.gene[i]]
+	if m.gene[j] != m.gene[i] {
+		g += "|" + m.genes[m.gene[j]]
+	}
+	return g, strconv.Itoa(m.pos[i]), strconv.Itoa(m.pos[j])
+}
@@ -15,19 +15,18 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/kussell-lab/biogo/seq"
 	"github.com/kussell-lab/mcorr"
 	"github.com/kussell-lab/ncbiftp/taxonomy"
 	"gopkg.in/cheggaaa/pb.v2"
-	"os"
-	"strings"
 	"sync"
 )
 
 //calcQsAll calculates Qs at all positions for a given alignment and writes it to the output csv
 
-func calcQsAll(seqMap map[string][]Codon, seqpairs [][]string, codonOffset, codonPosition int, maxCodonLen int,
+func calcQsAll(seqMap map[string][]Codon, seqpairs [][]string, codonOffset, codonPosition int, lags lagSet,
 	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, numDigesters int, bar *pb.ProgressBar) {
 	//numDigesters := 20
 	codonSequences := [][]Codon{}
@@ -37,35 +36,34 @@ func calcQsAll(seqMap map[string][]Codon, seqpairs [][]string, codonOffset, codo
 	}
 	done := make(chan struct{})
 
-	pairChan := makeSeqPairChan(done, seqMap, seqpairs)
+	//results are written in the order of the pair list, with a few pairs in flight per worker
+	ow := newOrderedWriter(outFile, 2*numDigesters)
+	defer ow.Close()
+	pairChan := makeSeqPairChan(done, seqMap, seqpairs, ow)
 	//start a fixed number of go routines
-	c := make(chan map[string]mcorr.CorrResults)
+	c := make(chan pairResult)
 	var wg sync.WaitGroup
 	for i := 0; i < numDigesters; i++ {
 		wg.Add(1)
 		go calcQsPair(done, pairChan, c, synonymous, codingTable, codonPosition,
-			maxCodonLen, i, bar, &wg)
+			lags, i, bar, &wg)
 	}
 
 	go func() {
 		wg.Wait()
 		close(c)
 	}()
-	//end of pipeline; write files ...
+	//end of pipeline; write files in order ...
 	for res := range c {
-		writeCsvOut(outFile, res)
+		ow.Write(res)
 	}
 
 }
 
-//writeCsvOut writes results to the output csv
-func writeCsvOut(outFile string, corrResMap map[string]mcorr.CorrResults) {
-	f, err := os.OpenFile(outFile, os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-	for pairID, corrRes := range corrResMap {
+//writeCsvRows writes results to the output csv
+func writeCsvRows(w *bufio.Writer, corrResMap map[string]mcorr.CorrResults) {
+	for _, pairID := range sortedPairIDs(corrResMap) {
+		corrRes := corrResMap[pairID]
 		results := corrRes.Results
 		//save d_sample ...
 		var ds float64
@@ -75,14 +73,14 @@ func writeCsvOut(outFile string, corrResMap map[string]mcorr.CorrResults) {
 			case lag == 0 && res.Mean == 0:
 				//stop writing this result if ds = 0
 				res.Type = "Ks"
-				f.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", res.Lag, res.Mean, res.Variance, res.N, res.Type, pairID))
+				w.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", res.Lag, res.Mean, res.Variance, res.N, res.Type, pairID))
 				break Loop
 			case lag == 0:
 				res.Type = "Ks"
-				f.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", res.Lag, res.Mean, res.Variance, res.N, res.Type, pairID))
+				w.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", res.Lag, res.Mean, res.Variance, res.N, res.Type, pairID))
 				ds = res.Mean
 			default:
-				f.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", res.Lag, res.Mean/ds, res.Variance, res.N, res.Type, pairID))
+				w.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", res.Lag, res.Mean/ds, res.Variance, res.N, res.Type, pairID))
 			}
 		}
 		//save d_sample ...
@@ -100,17 +98,17 @@ func writeCsvOut(outFile string, corrResMap map[string]mcorr.CorrResults) {
 }
 
 //calcQsPair calculates Qs for a given pair across all positions
-func calcQsPair(done <-chan struct{}, pairChan <-chan SeqPair, resChan chan<- map[string]mcorr.CorrResults,
+func calcQsPair(done <-chan struct{}, pairChan <-chan SeqPair, resChan chan<- pairResult,
 	synonymous bool, codingTable *taxonomy.GeneticCode, codonPosition int,
-	maxCodonLen int, id int, bar *pb.ProgressBar, wg *sync.WaitGroup) {
+	lags lagSet, id int, bar *pb.ProgressBar, wg *sync.WaitGroup) {
 	defer wg.Done()
 	//fmt.Printf("Worker %d starting\n", id)
 	//var results []CorrResult
 	for seqPair := range pairChan {
 		//fmt.Printf("lag %d starting \n", l)
-		QsResMap := mapQsRes(seqPair, synonymous, codingTable, codonPosition, maxCodonLen)
+		QsResMap := mapQsRes(seqPair, synonymous, codingTable, codonPosition, lags)
 		select {
-		case resChan <- QsResMap:
+		case resChan <- pairResult{seqPair.index, QsResMap}:
 			//lag := 3 * l
 			//fmt.Printf("\rlag %d done", lag)
 			if bar != nil {
@@ -123,9 +121,9 @@ func calcQsPair(done <-chan struct{}, pairChan <-chan SeqPair, resChan chan<- ma
 	//fmt.Printf("Worker %d done\n", id)
 }
 
-//mapQsRes calculates correlation profiles for a sequence pair
+//mapQsRes calculates correlation profiles for a sequence pair, summing up each pool of lags
 func mapQsRes(seqPair SeqPair, synonymous bool, codingTable *taxonomy.GeneticCode,
-	codonPos int, maxCodonLen int) map[string]mcorr.CorrResults {
+	codonPos int, lags lagSet) map[string]mcorr.CorrResults {
 	QsMap := make(map[string]mcorr.CorrResults)
 
 	//name pairs
@@ -140,51 +138,53 @@ func mapQsRes(seqPair SeqPair, synonymous bool, codingTable *taxonomy.GeneticCod
 	seq2 := seqPair.genome2
 	//initiate result collection
 	crRes := mcorr.CorrResults{ID: pairID}
-	for l := 0; l < maxCodonLen; l++ {
+	for _, label := range lags.labels {
 		d := 0.0
 		t := 0
-		for k := 0; k < len(seq1)-l; k++ {
-			c1 := seq1[k]
-			c2 := seq2[k]
-			a1, found1 := codingTable.Table[string(c1)]
-			a2, found2 := codingTable.Table[string(c2)]
-			if found1 && found2 && a1 == a2 {
-				b1 := seq1[k+l]
-				b2 := seq2[k+l]
-
-				good := true
-				if synonymous {
-					d1, found1 := codingTable.Table[string(b1)]
-					d2, found2 := codingTable.Table[string(b2)]
-					if found1 && found2 && d1 == d2 {
-						good = true
-					} else {
-						good = false
-					}
-				}
-				if good {
-					var codonPositions []int
-					if codonPos < 0 || codonPos > 2 {
-						codonPositions = []int{0, 1, 2}
-					} else {
-						codonPositions = append(codonPositions, codonPos)
+		for _, l := range lags.pools[label] {
+			for k := 0; k < len(seq1)-l; k++ {
+				c1 := seq1[k]
+				c2 := seq2[k]
+				a1, found1 := codingTable.Table[string(c1)]
+				a2, found2 := codingTable.Table[string(c2)]
+				if found1 && found2 && a1 == a2 {
+					b1 := seq1[k+l]
+					b2 := seq2[k+l]
+
+					good := true
+					if synonymous {
+						d1, found1 := codingTable.Table[string(b1)]
+						d2, found2 := codingTable.Table[string(b2)]
+						if found1 && found2 && d1 == d2 {
+							good = true
+						} else {
+							good = false
+						}
 					}
-					for _, codonP := range codonPositions {
-						if c1[codonP] != c2[codonP] {
-							if b1[codonP] != b2[codonP] {
-								d++
+					if good {
+						var codonPositions []int
+						if codonPos < 0 || codonPos > 2 {
+							codonPositions = []int{0, 1, 2}
+						} else {
+							codonPositions = append(codonPositions, codonPos)
+						}
+						for _, codonP := range codonPositions {
+							if c1[codonP] != c2[codonP] {
+								if b1[codonP] != b2[codonP] {
+									d++
+								}
 							}
+							t++
 						}
-						t++
 					}
 				}
 			}
 		}
 		cr := mcorr.CorrResult{}
-		cr.Lag = l * 3
+		cr.Lag = label * 3
 		cr.Mean = d / float64(t)
 		cr.N = t
-		if l == 0 {
+		if label == 0 {
 			cr.Type = "Ks"
 		} else {
 			cr.Type = "P2"
@@ -210,20 +210,27 @@ func extractCodons(s seq.Sequence, offset int) (codons []Codon) {
 }
 
 //makeSeqPairChan returns a channel of sequence pairs
-func makeSeqPairChan(done <-chan struct{}, seqMap map[string][]Codon, seqpairs [][]string) <-chan SeqPair {
+func makeSeqPairChan(done <-chan struct{}, seqMap map[string][]Codon, seqpairs [][]string, ow *orderedWriter) <-chan SeqPair {
 	SeqPairChan := make(chan SeqPair)
 	go func() {
 		defer close(SeqPairChan)
-		for _, seqpair := range seqpairs {
+		for index, seqpair := range seqpairs {
 			seqName1 := seqpair[0]
 			seqName2 := seqpair[1]
 			seq1 := seqMap[seqName1]
 			seq2 := seqMap[seqName2]
-			pairSeqs := SeqPair{seqName1, seq1,
+			pairSeqs := SeqPair{index, seqName1, seq1,
 				seqName2, seq2}
+			//wait for a free slot in the writer
+			select {
+			case ow.slots <- struct{}{}:
+			case <-done:
+				return
+			}
 			select {
 			case SeqPairChan <- pairSeqs:
 			case <-done:
+				return
 			}
 
 		}
@@ -233,19 +240,15 @@ func makeSeqPairChan(done <-chan struct{}, seqMap map[string][]Codon, seqpairs [
 
 //SeqPair pair of sequences to be analyzed
 type SeqPair struct {
+	index       int // position in the pair list
 	genomeName1 string
 	genome1     []Codon
 	genomeName2 string
 	genome2     []Codon
 }
 
+//getNames reads the gene and strain names from a sequence header (see --header-format)
 func getNames(s string) (geneName, genomeName string) {
-	terms := strings.Split(s, " ")
-	//this is for the helicobacter test files
-	//geneName = terms[0]
-	//genomeName = terms[1]
-	//this is the genomeName for the MSA files assembled from ReferenceAlignmentGenerator
-	geneName = terms[0]
-	genomeName = terms[2]
-	return
+	header := headers.parse(s)
+	return header.gene, header.strain
 }
@@ -0,0 +1,93 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"github.com/kussell-lab/mcorr"
+	"log"
+	"os"
+	"sort"
+)
+
+// pairResult holds the results for the sequence pair at a given index in the pair list
+type pairResult struct {
+	index   int
+	results map[string]mcorr.CorrResults
+}
+
+// orderedWriter writes pair results to the output csv in the order of the pair list,
+// which is sorted by genome names, through a single buffered handle.
+// Workers finish pairs in any order, so results which arrive early are held back until
+// the pairs before them are written. Every pair handed out to the workers takes a slot,
+// which is only given back once the pair is written; this bounds the number of pairs held in memory.
+type orderedWriter struct {
+	f       *os.File
+	w       *bufio.Writer
+	next    int // index of the next pair to write
+	pending map[int]pairResult
+	slots   chan struct{}
+}
+
+// newOrderedWriter opens outFile for appending pair results, in order,
+// with at most window pairs in flight at once.
+func newOrderedWriter(outFile string, window int) *orderedWriter {
+	f, err := os.OpenFile(outFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatalf("failed opening output %s: %v", outFile, err)
+	}
+	if window < 1 {
+		window = 1
+	}
+	return &orderedWriter{
+		f:       f,
+		w:       bufio.NewWriter(f),
+		pending: make(map[int]pairResult),
+		slots:   make(chan struct{}, window),
+	}
+}
+
+// Write holds on to the results of a pair, and writes out every pair which is now next in line.
+func (ow *orderedWriter) Write(res pairResult) {
+	ow.pending[res.index] = res
+	for {
+		res, found := ow.pending[ow.next]
+		if !found {
+			break
+		}
+		writeCsvRows(ow.w, res.results)
+		delete(ow.pending, ow.next)
+		ow.next++
+		<-ow.slots
+	}
+}
+
+// Close flushes and closes the output csv.
+func (ow *orderedWriter) Close() {
+	if err := ow.w.Flush(); err != nil {
+		log.Fatalf("failed writing output: %v", err)
+	}
+	ow.f.Close()
+}
+
+// sortedPairIDs returns the pair IDs of a set of results in sorted order.
+func sortedPairIDs(results map[string]mcorr.CorrResults) []string {
+	pairIDs := make([]string, 0, len(results))
+	for pairID := range results {
+		pairIDs = append(pairIDs, pairID)
+	}
+	sort.Strings(pairIDs)
+	return pairIDs
+}
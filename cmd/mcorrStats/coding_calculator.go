@@ -0,0 +1,101 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Initially modified from coding_calculator.go of mcorr
+// https://github.com/kussell-lab/mcorr
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/kussell-lab/biogo/seq"
+	"github.com/kussell-lab/ncbiftp/taxonomy"
+)
+
+//doubleCodons collects all codon pairs (where a codon pair is a codon at position i and i+l)
+//from the set of sequences and adds them into a covariance matrix for the set of sequences
+func doubleCodons(codonPairs []CodonPair, codonPosition int) *NuclCov {
+	alphabet := []byte{'A', 'T', 'G', 'C'}
+	c := NewNuclCov(alphabet)
+	for _, codonPair := range codonPairs {
+		a := codonPair.A[codonPosition]
+		b := codonPair.B[codonPosition]
+		//add a value at site a and b (i and i+l)
+		c.Add(a, b)
+	}
+	return c
+}
+
+// Codon is a byte list of length 3
+type Codon []byte
+
+// CodonSequence is a sequence of codons.
+type CodonSequence []Codon
+
+// CodonPair is a pair of Codons.
+type CodonPair struct {
+	A, B Codon
+}
+
+// extractCodons return a list of codons from a DNA sequence.
+func extractCodons(s seq.Sequence, offset int) (codons []Codon) {
+	for i := offset; i+3 <= len(s.Seq); i += 3 {
+		c := s.Seq[i:(i + 3)]
+		codons = append(codons, c)
+	}
+	return
+}
+
+// synonymousSplit split a list of codon pairs into multiple
+// synonymous pairs. You check which AAs each codon in the two site pair produces,
+// then add it to the multiCodonPair list at an index corresponding to the AAs
+//the two sites produce
+func synonymousSplit(codonPairs []CodonPair, codingTable *taxonomy.GeneticCode) (multiCodonPairs [][]CodonPair) {
+	aaList := []string{}
+	for _, codonPair := range codonPairs {
+		// check gap.
+		containsGap := false
+		for _, codon := range []Codon{codonPair.A, codonPair.B} {
+			for i := 0; i < 3; i++ {
+				if codon[i] == '-' || codon[i] == 'N' {
+					containsGap = true
+					break
+				}
+			}
+		}
+		if containsGap {
+			continue
+		}
+
+		codonA := string(codonPair.A)
+		codonB := string(codonPair.B)
+		a := codingTable.Table[codonA]
+		b := codingTable.Table[codonB]
+		ab := string([]byte{a, b})
+		index := -1
+		for i := 0; i < len(aaList); i++ {
+			if aaList[i] == ab {
+				index = i
+			}
+		}
+		if index == -1 {
+			index = len(aaList)
+			aaList = append(aaList, ab)
+			multiCodonPairs = append(multiCodonPairs, []CodonPair{})
+		}
+
+		multiCodonPairs[index] = append(multiCodonPairs[index], codonPair)
+	}
+
+	return
+}
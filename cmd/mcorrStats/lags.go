@@ -0,0 +1,131 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lagSet is the lags to calculate, in codons, pooled into bins: the site pairs of all lags in a pool
+// are summed up into one result, labelled by the first (smallest) lag of the pool.
+type lagSet struct {
+	labels []int
+	pools  map[int][]int
+}
+
+// newLagSet returns the lags given by spec (see parseLags) or, if spec is empty, the lags from minlag
+// up to (not including) maxlag, pooled into bins of binLen codons.
+func newLagSet(spec string, minlag, maxlag, binLen int) lagSet {
+	var lags []int
+	if spec != "" {
+		lags = parseLags(spec)
+	} else {
+		for l := minlag; l < maxlag; l++ {
+			lags = append(lags, l)
+		}
+	}
+	return poolLags(lags, binLen)
+}
+
+// poolLags pools the lags (in increasing order) into bins of binLen codons; lag 0 (d_sample)
+// is never pooled, and a binLen of 0 or 1 leaves every lag on its own.
+func poolLags(lags []int, binLen int) lagSet {
+	s := lagSet{pools: make(map[int][]int)}
+	bin := func(l int) int { return l }
+	if binLen > 1 {
+		bin = func(l int) int {
+			if l == 0 {
+				return -1
+			}
+			return l / binLen
+		}
+	}
+	for k, l := range lags {
+		if k == 0 || bin(l) != bin(lags[k-1]) {
+			s.labels = append(s.labels, l)
+		}
+		label := s.labels[len(s.labels)-1]
+		s.pools[label] = append(s.pools[label], l)
+	}
+	return s
+}
+
+// parseLags reads a comma-separated list of lags in base pairs, each a single lag, a range
+// "<min>:<max>[:<step>]" (including max; the step is 3 by default) or "log:<min>:<max>:<n>" for
+// n lags evenly spaced on a log scale. Lags are rounded to whole codons, and lag 0 is always included.
+func parseLags(spec string) []int {
+	seen := map[int]bool{0: true}
+	number := func(term, s string) int {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || v < 0 {
+			log.Fatalf("--lags %q: %q is not a distance in base pairs", term, s)
+		}
+		return v
+	}
+	for _, term := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(term), ":")
+		switch {
+		case fields[0] == "log":
+			if len(fields) != 4 {
+				log.Fatalf("--lags %q should be log:<min>:<max>:<n>", term)
+			}
+			min, max, n := number(term, fields[1]), number(term, fields[2]), number(term, fields[3])
+			if min == 0 || max < min || n == 0 {
+				log.Fatalf("--lags %q needs 0 < min <= max and n > 0", term)
+			}
+			for k := 0; k < n; k++ {
+				v := float64(min)
+				if n > 1 {
+					v *= math.Pow(float64(max)/float64(min), float64(k)/float64(n-1))
+				}
+				seen[int(math.Round(v/3))] = true
+			}
+		case len(fields) == 1:
+			seen[number(term, fields[0])/3] = true
+		case len(fields) <= 3:
+			min, max, step := number(term, fields[0]), number(term, fields[1]), 3
+			if len(fields) == 3 {
+				step = number(term, fields[2])
+			}
+			if max < min || step < 3 {
+				log.Fatalf("--lags %q needs min <= max and a step of at least 3", term)
+			}
+			for v := min; v <= max; v += step {
+				seen[v/3] = true
+			}
+		default:
+			log.Fatalf("--lags %q is not a lag, a range <min>:<max>[:<step>] or log:<min>:<max>:<n>", term)
+		}
+	}
+	var lags []int
+	for l := range seen {
+		lags = append(lags, l)
+	}
+	sort.Ints(lags)
+	return lags
+}
+
+// span returns the smallest label and one more than the largest lag, bounding the lags in the set.
+func (s lagSet) span() (minlag, maxlag int) {
+	if len(s.labels) == 0 {
+		return 0, 0
+	}
+	last := s.pools[s.labels[len(s.labels)-1]]
+	return s.labels[0], last[len(last)-1] + 1
+}
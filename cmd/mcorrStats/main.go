@@ -0,0 +1,359 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/kussell-lab/biogo/seq"
+	"github.com/kussell-lab/ncbiftp/taxonomy"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// global variables.
+func main() {
+	app := kingpin.New("mcorrStats", "Build, update and render mergeable sufficient statistics of position-averaged corr profiles.")
+	app.Version("v20261018")
+
+	ncpu := app.Flag("num-cpu", "Number of CPUs (default: using all available cores)").Default("0").Int()
+	numDigesters := app.Flag("num-threads", "number of threads").Default("8").Int()
+	duplicateNames := app.Flag("duplicate-names", "what to do with a strain name which appears more than once in a CDS region: rename the copies in order (<name>_1, ...), error, keep-first or keep-longest").Default("rename").Enum(duplicatePolicies...)
+	headerFormat := app.Flag("header-format", "format of the XMFA sequence headers: a template of {gene}, {start}, {stop}, {strain} and {_} (any text), or a regular expression with those named groups").Default(defaultHeaderFormat).String()
+
+	buildCmd := app.Command("build", "Calculate the statistics for an XMFA file and store them in a new stats file.")
+	buildAln := buildCmd.Arg("aln", "Alignment file in XMFA format.").Required().String()
+	buildStats := buildCmd.Arg("stats", "Output stats file.").Required().String()
+	minl := buildCmd.Flag("min-corr-length", "min distance of correlation (nucleotides)").Default("0").Int()
+	maxl := buildCmd.Flag("max-corr-length", "Max distance of correlation (nucleotides)").Default("300").Int()
+	lagSpec := buildCmd.Flag("lags", "lags to calculate (nucleotides) instead of --min-corr-length to --max-corr-length: a comma-separated list of lags, ranges <min>:<max>[:<step>] and log:<min>:<max>:<n> (n lags evenly spaced on a log scale)").Default("").String()
+	perSite := buildCmd.Flag("per-site", "also store doublet counts for each site pair; required for add and merge").Default("false").Bool()
+
+	addCmd := app.Command("add", "Add the genomes in an XMFA file to an existing stats file, including cross-pairs with the old genomes.")
+	addStats := addCmd.Arg("stats", "Stats file to update (built with --per-site).").Required().String()
+	addAln := addCmd.Arg("aln", "Alignment file in XMFA format with the new genomes.").Required().String()
+
+	mergeCmd := app.Command("merge", "Merge a stats file built from other genomes into an existing stats file.")
+	mergeStats := mergeCmd.Arg("stats", "Stats file to update (built with --per-site).").Required().String()
+	mergeOther := mergeCmd.Arg("other", "Stats file to merge in (built with --per-site).").Required().String()
+
+	csvCmd := app.Command("csv", "Render the corr profile in a stats file as a .csv file.")
+	csvStats := csvCmd.Arg("stats", "Stats file.").Required().String()
+	outPrefix := csvCmd.Arg("out", "Output prefix.").Required().String()
+	lagBin := csvCmd.Flag("lag-bin", "pool the lags into bins of this width (nucleotides), writing one row per bin with the pooled n (0: no pooling)").Default("0").Int()
+
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+	headers = newHeaderFormat(*headerFormat)
+	prov := newProvenance(app, command)
+	version := app.Model().Version
+
+	if *ncpu <= 0 {
+		*ncpu = runtime.NumCPU()
+	}
+	runtime.GOMAXPROCS(*ncpu)
+
+	//timer
+	start := time.Now()
+
+	codingTable := taxonomy.GeneticCodes()["11"]
+	synonymous := true
+	codonPos := 3
+	codonOffset := 0
+
+	switch command {
+	case buildCmd.FullCommand():
+		startSlice, seqMap := loadSeqMap(*buildAln, codonOffset, *duplicateNames)
+		meta := statsMeta{
+			MinLag:        *minl / 3,
+			MaxLag:        *maxl / 3,
+			NumCodons:     countCodons(seqMap),
+			CodonPosition: codonPos,
+			Synonymous:    synonymous,
+			GeneticCode:   "11",
+			PerSite:       *perSite,
+			GeneStarts:    startSlice,
+			Strains:       strainNames(seqMap),
+			Version:       version,
+		}
+		if *lagSpec != "" {
+			meta.Lags = parseLags(*lagSpec)
+			meta.MinLag, meta.MaxLag = meta.Lags[0], meta.Lags[len(meta.Lags)-1]+1
+		}
+		setStatsProvenance(prov, meta, *buildAln)
+		meta.Provenance = prov.Lines()
+		db := createStats(*buildStats, meta)
+		defer db.Close()
+		buildStatsAll(db, seqMap, meta, codingTable, *numDigesters)
+		fmt.Printf("\nstored statistics for %d strains in %s\n", len(meta.Strains), *buildStats)
+	case addCmd.FullCommand():
+		db, meta := openStats(*addStats, false)
+		defer db.Close()
+		if !meta.PerSite {
+			log.Fatalf("%s was built without --per-site, so genomes cannot be added to it", *addStats)
+		}
+		startSlice, seqMap := loadSeqMap(*addAln, codonOffset, *duplicateNames)
+		added := meta
+		added.NumCodons = countCodons(seqMap)
+		added.GeneStarts = startSlice
+		added.Strains = strainNames(seqMap)
+		added.Version = version
+		checkMergeable(meta, added, *addAln, version)
+		setStatsProvenance(prov, added, *addAln)
+		meta.Updates = append(meta.Updates, prov.Lines())
+		addStatsAll(db, seqMap, meta, codingTable, *numDigesters)
+		fmt.Printf("\nadded %d strains to %s\n", len(added.Strains), *addStats)
+	case mergeCmd.FullCommand():
+		db, meta := openStats(*mergeStats, false)
+		defer db.Close()
+		other, otherMeta := openStats(*mergeOther, true)
+		defer other.Close()
+		checkMergeable(meta, otherMeta, *mergeOther, version)
+		prov.Set("num-strains", len(otherMeta.Strains))
+		prov.Set("input-sha256", hashFiles(*mergeOther))
+		meta.Updates = append(meta.Updates, prov.Lines())
+		mergeStatsAll(db, other, meta, otherMeta, *numDigesters)
+		fmt.Printf("\nmerged %d strains into %s\n", len(otherMeta.Strains), *mergeStats)
+	case csvCmd.FullCommand():
+		db, meta := openStats(*csvStats, true)
+		defer db.Close()
+		addSourceProvenance(prov, meta.Provenance, "source-")
+		for i, update := range meta.Updates {
+			addSourceProvenance(prov, update, fmt.Sprintf("update%d-", i+1))
+		}
+		WriteResults(poolTotals(readLagTotals(db, meta), poolLags(meta.lags(), *lagBin/3)), *outPrefix+".csv", prov)
+	}
+
+	duration := time.Since(start)
+	fmt.Println("Time to process stats:", duration)
+}
+
+// loadSeqMap reads all CDS regions of an XMFA file into a single codon sequence per strain
+// (applying the duplicate-name policy),
+// and returns the sorted gene start positions along with the sequences.
+func loadSeqMap(alnFile string, codonOffset int, policy string) (startSlice []int, seqMap map[string][]Codon) {
+	c := readAlignments(alnFile)
+	for a := range c {
+		startPos := getStartPos(a)
+		startSlice = append(startSlice, startPos)
+	}
+	//sort the slice numerically
+	sort.Ints(startSlice)
+	fmt.Print("fetching CDS regions\n")
+	seqMap = makeSeqMap(startSlice, alnFile, codonOffset, policy)
+	fmt.Print("done fetching CDS regions\n")
+	fmt.Printf("total number of strains: %d\n", len(seqMap))
+	fmt.Printf("total number of codons: %d\n", countCodons(seqMap))
+	return
+}
+
+// countCodons returns the length of the concatenated codon sequences.
+func countCodons(seqMap map[string][]Codon) (numCodons int) {
+	for _, seq := range seqMap {
+		numCodons = len(seq)
+		break
+	}
+	return
+}
+
+// strainNames returns the sorted strain names in a sequence map.
+func strainNames(seqMap map[string][]Codon) (strains []string) {
+	for strain := range seqMap {
+		strains = append(strains, strain)
+	}
+	sort.Strings(strains)
+	return
+}
+
+// setStatsProvenance records the settings in meta and the checksum of the alignment in prov.
+func setStatsProvenance(prov *provenance, meta statsMeta, alnFile string) {
+	prov.Set("genetic-code", meta.GeneticCode)
+	prov.Set("synonymous", meta.Synonymous)
+	prov.Set("codon-position", meta.CodonPosition)
+	prov.Set("num-strains", len(meta.Strains))
+	prov.Set("num-codons", meta.NumCodons)
+	prov.Set("input-sha256", hashFiles(alnFile))
+}
+
+// addSourceProvenance adds the "key=value" pairs in lines to prov, with prefix added to each key.
+func addSourceProvenance(prov *provenance, lines []string, prefix string) {
+	for _, line := range lines {
+		if i := strings.Index(line, "="); i > 0 {
+			prov.Set(prefix+line[:i], line[i+1:])
+		}
+	}
+}
+
+// checkMergeable makes sure the genomes described by other can be added to a stats file
+// by this version of mcorrStats.
+func checkMergeable(meta, other statsMeta, name string, version string) {
+	if !meta.PerSite || !other.PerSite {
+		log.Fatalf("stats files must be built with --per-site to add genomes")
+	}
+	if meta.Version != version {
+		log.Fatalf("the stats file was built by mcorrStats %q, which cannot be updated by %s", meta.Version, version)
+	}
+	if other.Version != meta.Version {
+		log.Fatalf("%s was made by mcorrStats %q but the stats file by %q", name, other.Version, meta.Version)
+	}
+	if other.NumCodons != meta.NumCodons {
+		log.Fatalf("%s has %d codons but the stats file has %d", name, other.NumCodons, meta.NumCodons)
+	}
+	if other.MinLag != meta.MinLag || other.MaxLag != meta.MaxLag || fmt.Sprint(other.Lags) != fmt.Sprint(meta.Lags) || other.CodonPosition != meta.CodonPosition ||
+		other.Synonymous != meta.Synonymous || other.GeneticCode != meta.GeneticCode {
+		log.Fatalf("%s was calculated with different parameters than the stats file", name)
+	}
+	if len(other.GeneStarts) != len(meta.GeneStarts) {
+		log.Fatalf("%s has %d CDS regions but the stats file has %d", name, len(other.GeneStarts), len(meta.GeneStarts))
+	}
+	for i, start := range meta.GeneStarts {
+		if other.GeneStarts[i] != start {
+			log.Fatalf("%s has a CDS region starting at %d where the stats file has %d", name, other.GeneStarts[i], start)
+		}
+	}
+	old := make(map[string]bool)
+	for _, strain := range meta.Strains {
+		old[strain] = true
+	}
+	for _, strain := range other.Strains {
+		if old[strain] {
+			log.Fatalf("strain %s from %s is already in the stats file", strain, name)
+		}
+	}
+}
+
+func makeSeqMap(startSlice []int, alnFile string, codonOffset int, policy string) (seqMap map[string][]Codon) {
+	seqMap = make(map[string][]Codon)
+	chooseLongestCopies(policy, alnFile)
+	for _, i := range startSlice {
+		a := getGene(alnFile, i)
+		addCodons(a, seqMap, codonOffset, policy)
+	}
+	return seqMap
+}
+
+func getGene(alnFile string, startCodon int) (gene Alignment) {
+	c := readAlignments(alnFile)
+	for a := range c {
+		startPos := getStartPos(a)
+		if startCodon == startPos {
+			gene = a
+			break
+		}
+	}
+	return gene
+}
+
+func getStartPos(aln Alignment) int {
+	return aln.start
+}
+
+// Alignment is an array of mutliple sequences with same length.
+type Alignment struct {
+	ID        string //gene ID
+	start     int    // position of gene on the genome
+	stop      int
+	Sequences []seq.Sequence
+}
+
+// readAlignments reads sequence alignment from a extended Multi-FASTA file,
+// and return a channel of alignment, which is a list of seq.Sequence
+func readAlignments(file string) (alnChan chan Alignment) {
+	alnChan = make(chan Alignment)
+	go func() {
+		defer close(alnChan)
+
+		c := readXMFA(file)
+		for alignment := range c {
+			header := headers.parse(alignment[0].Id)
+			alnChan <- Alignment{ID: header.gene, start: header.start, stop: header.stop, Sequences: alignment}
+		}
+	}()
+
+	return
+}
+
+// readXMFA reads a xmfa format file and returns a channel of []seq.Sequence.
+func readXMFA(file string) chan []seq.Sequence {
+	c := make(chan []seq.Sequence)
+	go func() {
+		defer close(c)
+
+		f := mustOpen(file)
+		defer f.Close()
+
+		rd := seq.NewXMFAReader(f)
+		for {
+			a, err := rd.Read()
+			if err != nil {
+				if err != io.EOF {
+					panic(err)
+				}
+				break
+			}
+			// can have 1 sequence in both xmfas
+			if len(a) >= 1 {
+				c <- a
+			}
+		}
+	}()
+	return c
+}
+
+// mustOpen is a helper function to open a file.
+// and panic if error occurs.
+func mustOpen(file string) (f *os.File) {
+	var err error
+	f, err = os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+//getNames reads the gene and strain names from a sequence header (see --header-format)
+func getNames(s string) (geneName, genomeName string) {
+	header := headers.parse(s)
+	return header.gene, header.strain
+}
+
+//addCodons adds codons to each strain sequence in the sequence map, keeping or renaming strains
+//which appear more than once according to the duplicate-name policy, and returns those duplicates
+func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int, policy string) []strainDuplicate {
+	seqs, names, dups := uniqueStrains(a, policy)
+	reportDuplicates(dups)
+	//add codons to the map for each sequence
+	var wg sync.WaitGroup
+	//tell wg how many threads will be running concurrently
+	wg.Add(len(seqs))
+	//mutex lock for safe access to seqMap
+	var mutex = &sync.Mutex{}
+	for j := 0; j < len(seqs); j++ {
+		go func(j int) {
+			defer wg.Done()
+			codons := extractCodons(seqs[j], codonOffset)
+			mutex.Lock()
+			seqMap[names[j]] = append(seqMap[names[j]], codons...)
+			mutex.Unlock()
+		}(j)
+	}
+	wg.Wait()
+	return dups
+}
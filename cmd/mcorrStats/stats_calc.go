@@ -0,0 +1,249 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/kussell-lab/ncbiftp/taxonomy"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// P2 at each lag is sum(xy)/sum(n) over initial positions and synonymous classes,
+// and xy and n for a set of genomes only depend on the doublet counts at each pair of sites.
+// So two disjoint sets of genomes can be combined by adding up their doublet counts,
+// where the cross-pairs between the sets are counted with MateP11 before the counts are added.
+
+// buildStatsAll calculates the statistics of every lag and stores them in db.
+func buildStatsAll(db *bolt.DB, seqMap map[string][]Codon, meta statsMeta,
+	codingTable *taxonomy.GeneticCode, numDigesters int) {
+	codonSequences := [][]Codon{}
+	for _, s := range seqMap {
+		codonSequences = append(codonSequences, s)
+	}
+	runLags(db, meta, numDigesters, func(l int) lagStats {
+		return calcLagStats(codonSequences, meta, codingTable, l)
+	})
+}
+
+// addStatsAll adds the genomes in seqMap to the statistics in db.
+func addStatsAll(db *bolt.DB, seqMap map[string][]Codon, meta statsMeta,
+	codingTable *taxonomy.GeneticCode, numDigesters int) {
+	codonSequences := [][]Codon{}
+	for _, s := range seqMap {
+		codonSequences = append(codonSequences, s)
+	}
+	runLags(db, meta, numDigesters, func(l int) lagStats {
+		ls := getLag(db, l, meta.NumCodons, true)
+		mergeLagStats(&ls, calcLagStats(codonSequences, meta, codingTable, l))
+		return ls
+	})
+	meta.Strains = append(meta.Strains, strainNames(seqMap)...)
+	sort.Strings(meta.Strains)
+	writeMeta(db, meta)
+}
+
+// mergeStatsAll adds the statistics in other to those in db.
+func mergeStatsAll(db, other *bolt.DB, meta, otherMeta statsMeta, numDigesters int) {
+	runLags(db, meta, numDigesters, func(l int) lagStats {
+		ls := getLag(db, l, meta.NumCodons, true)
+		mergeLagStats(&ls, getLag(other, l, meta.NumCodons, true))
+		return ls
+	})
+	meta.Strains = append(meta.Strains, otherMeta.Strains...)
+	sort.Strings(meta.Strains)
+	writeMeta(db, meta)
+}
+
+// runLags calculates the statistics of each lag with a fixed number of workers,
+// and writes them to db as they come in.
+func runLags(db *bolt.DB, meta statsMeta, numDigesters int, calc func(l int) lagStats) {
+	done := make(chan struct{})
+	lagChan := make(chan int)
+	go func() {
+		defer close(lagChan)
+		for _, l := range meta.lags() {
+			select {
+			case lagChan <- l:
+			case <-done:
+			}
+		}
+	}()
+
+	c := make(chan lagStats)
+	var wg sync.WaitGroup
+	fmt.Printf("starting probability calculations ...\n")
+	for i := 0; i < numDigesters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range lagChan {
+				select {
+				case c <- calc(l):
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+	//end of pipeline; write to the stats file
+	for ls := range c {
+		putLag(db, ls)
+		fmt.Printf("\rlag %d done", ls.lag*3)
+	}
+}
+
+// calcLagStats calculates the statistics of a lag from a set of codon sequences.
+func calcLagStats(codonSequences [][]Codon, meta statsMeta, codingTable *taxonomy.GeneticCode, l int) (ls lagStats) {
+	ls.lag = l
+	if meta.PerSite {
+		ls.sites = make([]siteStats, meta.NumCodons)
+	}
+	codonPosition := meta.CodonPosition - 1
+	for i := 0; i+l < meta.NumCodons; i++ {
+		codonPairs := []CodonPair{}
+		j := i + l
+		for _, cc := range codonSequences {
+			if i+l < len(cc) {
+				codonPairs = append(codonPairs, CodonPair{A: cc[i], B: cc[j]})
+			}
+		}
+
+		multiCodonPairs := [][]CodonPair{}
+		if meta.Synonymous {
+			multiCodonPairs = synonymousSplit(codonPairs, codingTable)
+		} else {
+			multiCodonPairs = append(multiCodonPairs, codonPairs)
+		}
+		ss := make(siteStats)
+		for _, codonPairs := range multiCodonPairs {
+			if len(codonPairs) == 0 {
+				continue
+			}
+			nc := doubleCodons(codonPairs, codonPosition)
+			if len(codonPairs) >= 2 {
+				xy, n := nc.P11(0)
+				ls.xy += xy
+				ls.n += n
+			}
+			//classes with a single pair are kept, since they may pair up with genomes added later
+			if meta.PerSite {
+				aa := ""
+				if meta.Synonymous {
+					aa = translateCodonPair(codonPairs[0], codingTable)
+				}
+				ss[aa] = nc.Doublets
+			}
+		}
+		if meta.PerSite {
+			ls.sites[i] = ss
+		}
+	}
+	return
+}
+
+// mergeLagStats adds the statistics of src to dst, counting the cross-pairs between the two.
+func mergeLagStats(dst *lagStats, src lagStats) {
+	alphabet := []byte{'A', 'T', 'G', 'C'}
+	dst.xy += src.xy
+	dst.n += src.n
+	for i, ss := range src.sites {
+		if len(ss) == 0 {
+			continue
+		}
+		if dst.sites[i] == nil {
+			dst.sites[i] = make(siteStats)
+		}
+		for aa, doublets := range ss {
+			old, found := dst.sites[i][aa]
+			if !found {
+				dst.sites[i][aa] = doublets
+				continue
+			}
+			nc1 := &NuclCov{Doublets: old, Alphabet: alphabet}
+			nc2 := &NuclCov{Doublets: doublets, Alphabet: alphabet}
+			xy, n := nc1.MateP11(nc2, 0)
+			dst.xy += xy
+			dst.n += n
+			if err := nc1.Append(nc2); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+func translateCodonPair(cp CodonPair, codingTable *taxonomy.GeneticCode) string {
+	a := codingTable.Table[string(cp.A)]
+	b := codingTable.Table[string(cp.B)]
+	return string([]byte{a, b})
+}
+
+// poolTotals sums up the per-lag totals of each pool of lags, giving the first lag of the pool.
+func poolTotals(totals []lagStats, lags lagSet) (pooled []lagStats) {
+	byLag := make(map[int]lagStats)
+	for _, ls := range totals {
+		byLag[ls.lag] = ls
+	}
+	for _, label := range lags.labels {
+		sum := lagStats{lag: label}
+		for _, l := range lags.pools[label] {
+			sum.xy += byLag[l].xy
+			sum.n += byLag[l].n
+		}
+		pooled = append(pooled, sum)
+	}
+	return
+}
+
+// WriteResults writes the corr profile in a stats file to a .csv file
+func WriteResults(totals []lagStats, outFile string, prov *provenance) {
+	if len(totals) == 0 || totals[0].lag != 0 || totals[0].n == 0 {
+		log.Fatalf("the stats file has no d_sample (lag 0); rebuild it with --min-corr-length 0")
+	}
+
+	w, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	prov.WriteHeader(w)
+	w.WriteString("# l: the distance between two genomic positions\n")
+	w.WriteString("# m: the mean value of correlation profile\n")
+	w.WriteString("# v: the variance of correlation profile\n")
+	w.WriteString("# n: the total number of codon pairs used for calculation\n")
+	w.WriteString("# t: the type of result: Ks is for d_sample, and P2 is for correlation profile\n")
+	w.WriteString("# b: the bootstrap number (all means used all alignments).\n")
+
+	w.WriteString("l,m,v,n,t,b\n")
+
+	ds := totals[0].xy / float64(totals[0].n)
+	w.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", 0, ds, 0.0, totals[0].n, "Ks", "all"))
+	for _, ls := range totals[1:] {
+		if ls.n == 0 {
+			continue
+		}
+		m := ls.xy / float64(ls.n)
+		w.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", ls.lag*3, m/ds, 0.0, ls.n, "P2", "all"))
+	}
+}
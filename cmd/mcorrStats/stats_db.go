@@ -0,0 +1,246 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// a stats file is a boltdb file with three buckets:
+// "meta" holds the statsMeta as json under the key "meta",
+// "lags" holds the summed P11 numerator and pair count for each lag, keyed by the lag (in codons),
+// "sites" holds the doublet counts for each synonymous class at each pair of sites,
+// keyed by the lag and the initial position (only written with --per-site).
+// all integer keys are big-endian uint32 so that cursors walk them in order.
+var (
+	metaBucket  = []byte("meta")
+	lagBucket   = []byte("lags")
+	siteBucket  = []byte("sites")
+	metaKey     = []byte("meta")
+	doubletSize = 16
+)
+
+// statsMeta describes how a stats file was calculated.
+type statsMeta struct {
+	MinLag        int        `json:"min_lag"`        // in codons
+	MaxLag        int        `json:"max_lag"`        // in codons, exclusive
+	Lags          []int      `json:"lags,omitempty"` // in codons, if not all lags from MinLag to MaxLag
+	NumCodons     int        `json:"num_codons"`     // length of the concatenated CDS regions
+	CodonPosition int        `json:"codon_position"`
+	Synonymous    bool       `json:"synonymous"`
+	GeneticCode   string     `json:"genetic_code"`
+	PerSite       bool       `json:"per_site"`
+	GeneStarts    []int      `json:"gene_starts"`
+	Strains       []string   `json:"strains"`
+	Version       string     `json:"version,omitempty"`    // version of mcorrStats which built the file
+	Provenance    []string   `json:"provenance,omitempty"` // "key=value" pairs of the build
+	Updates       [][]string `json:"updates,omitempty"`    // "key=value" pairs of each add and merge
+}
+
+// siteStats holds the doublet counts of each synonymous class at a pair of sites;
+// the keys are the amino acids coded at the two sites.
+type siteStats map[string][]int
+
+// lagStats holds the sufficient statistics of a single lag.
+type lagStats struct {
+	lag   int     // in codons
+	xy    float64 // summed P11 numerator
+	n     int     // summed number of sequence pairs
+	sites []siteStats
+}
+
+// createStats creates a new stats file, overwriting any previous one.
+func createStats(file string, meta statsMeta) *bolt.DB {
+	os.Remove(file)
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, lagBucket, siteBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeMeta(db, meta)
+	return db
+}
+
+// openStats opens an existing stats file and reads its description.
+func openStats(file string, readOnly bool) (db *bolt.DB, meta statsMeta) {
+	if _, err := os.Stat(file); err != nil {
+		log.Fatalf("Error when reading stats file %s: %v", file, err)
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaBucket)
+		if b == nil {
+			return fmt.Errorf("%s is not a stats file", file)
+		}
+		return json.Unmarshal(b.Get(metaKey), &meta)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return
+}
+
+// writeMeta stores the description of a stats file.
+func writeMeta(db *bolt.DB, meta statsMeta) {
+	v, err := json.Marshal(meta)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(metaKey, v)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// putLag stores the statistics of a lag, replacing what was there before.
+func putLag(db *bolt.DB, ls lagStats) {
+	fn := func(tx *bolt.Tx) error {
+		v := make([]byte, 16)
+		binary.BigEndian.PutUint64(v[0:8], math.Float64bits(ls.xy))
+		binary.BigEndian.PutUint64(v[8:16], uint64(ls.n))
+		if err := tx.Bucket(lagBucket).Put(uint32Key(ls.lag), v); err != nil {
+			return err
+		}
+		b := tx.Bucket(siteBucket)
+		for i, ss := range ls.sites {
+			if len(ss) == 0 {
+				continue
+			}
+			if err := b.Put(siteKey(ls.lag, i), encodeSiteStats(ss)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := db.Update(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// getLag reads the statistics of a lag; per-site counts are only read if withSites is true.
+func getLag(db *bolt.DB, l int, numCodons int, withSites bool) (ls lagStats) {
+	ls.lag = l
+	fn := func(tx *bolt.Tx) error {
+		v := tx.Bucket(lagBucket).Get(uint32Key(l))
+		if v != nil {
+			ls.xy = math.Float64frombits(binary.BigEndian.Uint64(v[0:8]))
+			ls.n = int(binary.BigEndian.Uint64(v[8:16]))
+		}
+		if !withSites {
+			return nil
+		}
+		ls.sites = make([]siteStats, numCodons)
+		prefix := uint32Key(l)
+		c := tx.Bucket(siteBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && string(k[:4]) == string(prefix); k, v = c.Next() {
+			i := int(binary.BigEndian.Uint32(k[4:8]))
+			ls.sites[i] = decodeSiteStats(v)
+		}
+		return nil
+	}
+
+	err := db.View(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return
+}
+
+// lags returns the lags of a stats file in increasing order.
+func (meta statsMeta) lags() []int {
+	if meta.Lags != nil {
+		return meta.Lags
+	}
+	var lags []int
+	for l := meta.MinLag; l < meta.MaxLag; l++ {
+		lags = append(lags, l)
+	}
+	return lags
+}
+
+// readLagTotals returns the per-lag totals in a stats file in order of lag.
+func readLagTotals(db *bolt.DB, meta statsMeta) (totals []lagStats) {
+	for _, l := range meta.lags() {
+		totals = append(totals, getLag(db, l, meta.NumCodons, false))
+	}
+	return
+}
+
+func uint32Key(i int) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, uint32(i))
+	return k
+}
+
+func siteKey(l, i int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint32(k[0:4], uint32(l))
+	binary.BigEndian.PutUint32(k[4:8], uint32(i))
+	return k
+}
+
+// encodeSiteStats writes each synonymous class as a length-prefixed
+// amino acid key followed by the doublet counts as uint32s.
+func encodeSiteStats(ss siteStats) (v []byte) {
+	for aa, doublets := range ss {
+		v = append(v, byte(len(aa)))
+		v = append(v, aa...)
+		for _, d := range doublets {
+			v = append(v, uint32Key(d)...)
+		}
+	}
+	return
+}
+
+// decodeSiteStats reverses encodeSiteStats.
+func decodeSiteStats(v []byte) siteStats {
+	ss := make(siteStats)
+	for p := 0; p < len(v); {
+		keyLen := int(v[p])
+		aa := string(v[p+1 : p+1+keyLen])
+		p += 1 + keyLen
+		doublets := make([]int, doubletSize)
+		for d := range doublets {
+			doublets[d] = int(binary.BigEndian.Uint32(v[p : p+4]))
+			p += 4
+		}
+		ss[aa] = doublets
+	}
+	return ss
+}
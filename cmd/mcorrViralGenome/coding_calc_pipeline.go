@@ -19,13 +19,22 @@ import (
 	"github.com/kussell-lab/mcorr"
 	"github.com/kussell-lab/ncbiftp/taxonomy"
 	"os"
+	"strings"
 	"sync"
 )
 
-// calcQsAll calculates Qs at all positions for a given alignment and writes it to the outputcsv
+// calcQsAll calculates Qs at all positions for a given alignment and writes it to the outputcsv,
+// along with the profile of each genomic window (if any), returning the number of sequence pairs at each lag
+func calcQsAll(seqMap map[string][]Codon, genes []geneRegion, idx *siteIndex, codonOffset, codonPosition int, lags lagSet,
+	codingTable *taxonomy.GeneticCode, synonymous bool, outFile, jsonFile string, prov *provenance, numDigesters int) (pairs map[int]int) {
+	lagMap := calcLagResults(seqMap, idx, codonPosition, lags, codingTable, synonymous, numDigesters)
+	return writeLagResults(lagMap, genes, idx.windows, lags, outFile, jsonFile, prov)
+}
 
-func calcQsAll(seqMap map[string][]Codon, codonOffset, codonPosition, minCodonLen int, maxCodonLen int,
-	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, numDigesters int) {
+// calcLagResults calculates Qs at all positions for each lag, keyed by the lag in codons
+// (the first lag of each pool of lags).
+func calcLagResults(seqMap map[string][]Codon, idx *siteIndex, codonPosition int, lags lagSet,
+	codingTable *taxonomy.GeneticCode, synonymous bool, numDigesters int) (lagMap map[int]lagResult) {
 	//numDigesters := 20
 	codonSequences := [][]Codon{}
 	//for _, s := range aln.Sequences {
@@ -38,46 +47,67 @@ func calcQsAll(seqMap map[string][]Codon, codonOffset, codonPosition, minCodonLe
 	}
 	done := make(chan struct{})
 
-	lagChan := makeLagChan(done, minCodonLen, maxCodonLen, codonSequences)
+	lagChan := makeLagChan(done, lags)
 	//start a fixed number of go routines
-	c := make(chan mcorr.CorrResult)
+	c := make(chan lagResult)
 	var wg sync.WaitGroup
 	fmt.Printf("starting probability calculations ...\n")
 	for i := 0; i < numDigesters; i++ {
 		wg.Add(1)
-		go calcQs(done, lagChan, c, codonSequences, synonymous, codingTable, codonPosition, i, &wg)
+		go calcQs(done, lagChan, c, codonSequences, idx, lags, synonymous, codingTable, codonPosition, i, &wg)
 	}
 
 	go func() {
 		wg.Wait()
 		close(c)
 	}()
-	//end of pipeline; make a map then write to file
+	//end of pipeline; collect the results by lag
 
-	resMap := make(map[int]mcorr.CorrResult)
+	lagMap = make(map[int]lagResult)
 	for res := range c {
-		resMap[res.Lag] = res
+		lagMap[res.lag] = res
 	}
+	return lagMap
+}
 
-	WriteResults(resMap, maxCodonLen, outFile)
+// writeLagResults writes the genome-wide profile to outFile, the profiles by CDS region to jsonFile
+// and those by genomic window (if any) to <outFile>.genome_windows.csv, returning the number of sequence pairs at each lag
+func writeLagResults(lagMap map[int]lagResult, genes []geneRegion, windows []genomeWindow, lags lagSet,
+	outFile, jsonFile string, prov *provenance) (pairs map[int]int) {
+	resMap := make(map[int]mcorr.CorrResult)
+	pairs = make(map[int]int)
+	for l, res := range lagMap {
+		resMap[res.all.Lag] = res.all
+		pairs[l] = res.all.N
+	}
 
+	WriteResults(resMap, lags.labels, outFile, prov)
+	minlag, maxlag := lags.span()
+	writeGeneResults(geneResults(lagMap, genes, minlag, maxlag), jsonFile)
+	prov.WriteSidecar(jsonFile)
+	writeSplitResults(lagMap, minlag, maxlag, strings.TrimSuffix(outFile, ".csv")+".split.csv", prov)
+	if len(windows) > 0 {
+		windowFile := strings.TrimSuffix(outFile, ".csv") + ".genome_windows.csv"
+		writeGenomeWindowResults(lagMap, windows, minlag, maxlag, windowFile, prov)
+		fmt.Printf("\nwrote %s\n", windowFile)
+	}
+	return pairs
 }
 
-//makeLagChan returns a channel of lags
-func makeLagChan(done <-chan struct{}, minCodonLen int, maxCodonLen int, codonSequences [][]Codon) <-chan int {
-	lagChan := make(chan int)
-	var maxlag int
-	var minlag int
-	if maxCodonLen == 0 {
-		maxlag = len(codonSequences[0])
-		minlag = 0
-	} else {
-		maxlag = maxCodonLen
-		minlag = minCodonLen
+// numCodons returns the length of the concatenated codon sequences.
+func numCodons(seqMap map[string][]Codon) int {
+	for _, s := range seqMap {
+		return len(s)
 	}
+	return 0
+}
+
+//makeLagChan returns a channel of lags (the first lag of each pool)
+func makeLagChan(done <-chan struct{}, lags lagSet) <-chan int {
+	lagChan := make(chan int)
 	go func() {
 		defer close(lagChan)
-		for l := minlag; l < maxlag; l++ {
+		for _, l := range lags.labels {
 			select {
 			case lagChan <- l:
 			case <-done:
@@ -87,15 +117,26 @@ func makeLagChan(done <-chan struct{}, minCodonLen int, maxCodonLen int, codonSe
 	return lagChan
 }
 
+//lagRange returns the lags to calculate; all lags along the sequences if maxCodonLen is 0
+func lagRange(minCodonLen, maxCodonLen, numCodons int) (minlag, maxlag int) {
+	if maxCodonLen == 0 {
+		return 0, numCodons
+	}
+	return minCodonLen, maxCodonLen
+}
+
 //calcQs calculates Qs for a given lag across all initial positions
-func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- mcorr.CorrResult, codonSequences [][]Codon, synonymous bool,
+func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- lagResult, codonSequences [][]Codon, idx *siteIndex, lags lagSet, synonymous bool,
 	codingTable *taxonomy.GeneticCode, codonPosition int, id int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	//fmt.Printf("Worker %d starting\n", id)
 	//var results []CorrResult
 	for l := range lagChan {
 		//fmt.Printf("lag %d starting \n", l)
-		corrRes := calcCorrRes(codonSequences, synonymous, codingTable, codonPosition, l)
+		corrRes := calcCorrRes(codonSequences, idx, synonymous, codingTable, codonPosition, l)
+		for _, pooled := range lags.pools[l][1:] {
+			corrRes.merge(calcCorrRes(codonSequences, idx, synonymous, codingTable, codonPosition, pooled))
+		}
 		select {
 		case resChan <- corrRes:
 			lag := 3 * l
@@ -107,17 +148,21 @@ func calcQs(done <-chan struct{}, lagChan <-chan int, resChan chan<- mcorr.CorrR
 	//fmt.Printf("Worker %d done\n", id)
 }
 
-func calcCorrRes(codonSequences [][]Codon, synonymous bool,
-	codingTable *taxonomy.GeneticCode, codonPosition int, l int) (corrRes mcorr.CorrResult) {
+//calcCorrRes calculates Qs for a given lag, summing it up both across the genome and
+//by the CDS regions (given for each codon by idx) holding the two sites and the genomic windows holding the first
+func calcCorrRes(codonSequences [][]Codon, idx *siteIndex, synonymous bool,
+	codingTable *taxonomy.GeneticCode, codonPosition int, l int) (corrRes lagResult) {
+	corrRes = newLagResult(idx)
+	corrRes.lag = l
 	//corrResMap := make(map[int]mcorr.CorrResult)
 	//loop through initial positions for a given lag
 	totalP2 := 0.0
 	totaln := 0
-	for i := 0; i+l < len(codonSequences[0]); i++ {
+	for _, p := range idx.pairs(l, len(codonSequences[0])) {
 		codonPairs := []CodonPair{}
-		j := i + l
+		i, j := p.i, p.j
 		for _, cc := range codonSequences {
-			if i+l < len(cc) {
+			if i < len(cc) && j < len(cc) {
 				codonPairs = append(codonPairs, CodonPair{A: cc[i], B: cc[j]})
 			}
 		}
@@ -134,7 +179,7 @@ func calcCorrRes(codonSequences [][]Codon, synonymous bool,
 				xy, n := nc.P11(0)
 				totalP2 += xy
 				totaln += n
-
+				corrRes.add(idx, i, j, xy, n)
 			}
 		}
 	}
@@ -145,7 +190,7 @@ func calcCorrRes(codonSequences [][]Codon, synonymous bool,
 	//	nn = totaln
 	//}
 	if totaln > 0 {
-		corrRes = mcorr.CorrResult{
+		corrRes.all = mcorr.CorrResult{
 			Lag:  l * 3,
 			Mean: totalP2 / float64(totaln),
 			N:    totaln,
@@ -0,0 +1,291 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/kussell-lab/mcorr"
+	"os"
+)
+
+// geneRegion is a CDS region within the concatenated codon sequences.
+type geneRegion struct {
+	ID         string
+	Start      int // position of the gene on the genome
+	StartCodon int // index of the first codon in the concatenated sequences
+	NumCodons  int
+	RefPos     []int             // reference coordinate of each alignment column from the codon offset, if there is a reference
+	Duplicates []strainDuplicate // strain names which appear more than once in the region
+}
+
+// siteIndex gives, for each codon of the concatenated sequences, the index in genes of the
+// CDS region holding it and the indices of the genomic windows holding it, along with
+// which pairs of codons make up each lag.
+type siteIndex struct {
+	gene     []int
+	numGenes int
+	windows  []genomeWindow
+	window   [][]int
+	byPos    []int // with genomic lags, the codons in order of their genome coordinates
+	pos      []int // and those coordinates
+}
+
+// newSiteIndex indexes the codons of the CDS regions, placing each codon in the windows holding
+// the genome coordinate of the nucleotide at codonPosition; codons at reference gaps are in no window.
+func newSiteIndex(genes []geneRegion, windows []genomeWindow, codonPosition int) *siteIndex {
+	idx := &siteIndex{numGenes: len(genes), windows: windows}
+	for g, gene := range genes {
+		for k := 0; k < gene.NumCodons; k++ {
+			idx.gene = append(idx.gene, g)
+		}
+	}
+	if len(windows) > 0 {
+		for _, pos := range codonCoordinates(genes, codonPosition) {
+			var in []int
+			for w, window := range windows {
+				if pos != refGap && pos >= window.start && pos <= window.end {
+					in = append(in, w)
+				}
+			}
+			idx.window = append(idx.window, in)
+		}
+	}
+	return idx
+}
+
+// qsSum holds the summed P11 numerator and number of sequence pairs of a set of site pairs.
+type qsSum struct {
+	xy float64
+	n  int
+}
+
+// lagResult holds the genome-wide Qs of a lag along with its contributions by CDS region:
+// within[g] sums the site pairs inside gene g, and cross[g][h] those with the first site
+// in gene g and the second in a later gene h. windows[w] sums the site pairs with the first
+// site in genomic window w.
+type lagResult struct {
+	lag     int // in codons
+	all     mcorr.CorrResult
+	within  []qsSum
+	cross   [][]qsSum
+	windows []qsSum
+}
+
+func newLagResult(idx *siteIndex) lagResult {
+	res := lagResult{within: make([]qsSum, idx.numGenes), cross: make([][]qsSum, idx.numGenes),
+		windows: make([]qsSum, len(idx.windows))}
+	for g := range res.cross {
+		res.cross[g] = make([]qsSum, idx.numGenes)
+	}
+	return res
+}
+
+// add adds the P11 numerator xy of n sequence pairs at codons i and j.
+func (res *lagResult) add(idx *siteIndex, i, j int, xy float64, n int) {
+	g, h := idx.gene[i], idx.gene[j]
+	if g > h {
+		//with genomic lags, the first site may be in a later, overlapping gene
+		g, h = h, g
+	}
+	if g == h {
+		res.within[g].xy += xy
+		res.within[g].n += n
+	} else {
+		res.cross[g][h].xy += xy
+		res.cross[g][h].n += n
+	}
+	if idx.window != nil {
+		for _, w := range idx.window[i] {
+			res.windows[w].xy += xy
+			res.windows[w].n += n
+		}
+	}
+}
+
+// merge adds the site pairs of another lag, pooling it into this one.
+func (res *lagResult) merge(other lagResult) {
+	if n := res.all.N + other.all.N; n > 0 {
+		xy := res.all.Mean*float64(res.all.N) + other.all.Mean*float64(other.all.N)
+		res.all = mcorr.CorrResult{Lag: res.lag * 3, Mean: xy / float64(n), N: n, Type: "P2"}
+	}
+	add := func(sum *qsSum, other qsSum) {
+		sum.xy += other.xy
+		sum.n += other.n
+	}
+	for g := range res.within {
+		add(&res.within[g], other.within[g])
+		for h := range res.cross[g] {
+			add(&res.cross[g][h], other.cross[g][h])
+		}
+	}
+	for w := range res.windows {
+		add(&res.windows[w], other.windows[w])
+	}
+}
+
+// geneResults collects the lag results into a profile of Qs for each CDS region,
+// followed by a profile for each pair of CDS regions with any cross-gene site pairs,
+// which has the ID "<gene>|<later gene>". Lags without any sequence pairs are left out.
+func geneResults(resMap map[int]lagResult, genes []geneRegion, minCodonLen, maxCodonLen int) (geneRes []mcorr.CorrResults) {
+	qs := func(l int, sum qsSum) mcorr.CorrResult {
+		return mcorr.CorrResult{Lag: l * 3, Mean: sum.xy / float64(sum.n), N: sum.n, Type: "P2"}
+	}
+	for g, gene := range genes {
+		corrRes := mcorr.CorrResults{ID: gene.ID}
+		for l := minCodonLen; l < maxCodonLen; l++ {
+			if res, found := resMap[l]; found && res.within[g].n > 0 {
+				corrRes.Results = append(corrRes.Results, qs(l, res.within[g]))
+			}
+		}
+		geneRes = append(geneRes, corrRes)
+	}
+	for g := range genes {
+		for h := g + 1; h < len(genes); h++ {
+			corrRes := mcorr.CorrResults{ID: genes[g].ID + "|" + genes[h].ID}
+			for l := minCodonLen; l < maxCodonLen; l++ {
+				if res, found := resMap[l]; found && res.cross[g][h].n > 0 {
+					corrRes.Results = append(corrRes.Results, qs(l, res.cross[g][h]))
+				}
+			}
+			if len(corrRes.Results) > 0 {
+				geneRes = append(geneRes, corrRes)
+			}
+		}
+	}
+	return
+}
+
+// split sums up the site pairs of a lag within any one CDS region (intragenic) and across
+// two CDS regions (intergenic).
+func (res lagResult) split() (intragenic, intergenic qsSum) {
+	for g := range res.within {
+		intragenic.xy += res.within[g].xy
+		intragenic.n += res.within[g].n
+		for h := range res.cross[g] {
+			intergenic.xy += res.cross[g][h].xy
+			intergenic.n += res.cross[g][h].n
+		}
+	}
+	return
+}
+
+// writeSplitResults writes the profile split into its intragenic and intergenic parts to a .csv file
+// in long format, one row per part and lag, along with the combined profile; the P2 of all parts
+// are divided by the same genome-wide d_sample. Lags without any sequence pairs are left out.
+func writeSplitResults(lagMap map[int]lagResult, minlag, maxlag int, outFile string, prov *provenance) {
+	w, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	prov.WriteHeader(w)
+	w.WriteString("# part: all site pairs, or those within one CDS region (intragenic) or across two (intergenic)\n")
+	w.WriteString("# l: the distance between two genomic positions\n")
+	w.WriteString("# m: the mean value of correlation profile\n")
+	w.WriteString("# v: the variance of correlation profile\n")
+	w.WriteString("# n: the total number of codon pairs used for calculation\n")
+	w.WriteString("# t: the type of result: Ks is for d_sample, and P2 is for correlation profile\n")
+	w.WriteString("# b: the bootstrap number (all means used all alignments).\n")
+	w.WriteString("part,l,m,v,n,t,b\n")
+
+	ds := 0.0
+	if res, found := lagMap[0]; found && res.all.N > 0 {
+		ds = res.all.Mean
+	}
+	for _, part := range []string{"all", "intragenic", "intergenic"} {
+		for l := minlag; l < maxlag; l++ {
+			res, found := lagMap[l]
+			if !found {
+				continue
+			}
+			sum := qsSum{res.all.Mean * float64(res.all.N), res.all.N}
+			if intragenic, intergenic := res.split(); part == "intragenic" {
+				sum = intragenic
+			} else if part == "intergenic" {
+				sum = intergenic
+			}
+			if sum.n == 0 {
+				continue
+			}
+			m, t := sum.xy/float64(sum.n), "Ks"
+			if l > 0 {
+				m, t = m/ds, "P2"
+			}
+			w.WriteString(fmt.Sprintf("%s,%d,%g,%g,%d,%s,%s\n", part, 3*l, m, 0.0, sum.n, t, "all"))
+		}
+	}
+}
+
+// writeGeneResults writes the profiles of the CDS regions to a .json file, one region per line.
+func writeGeneResults(geneRes []mcorr.CorrResults, outFile string) {
+	c := make(chan mcorr.CorrResults)
+	go func() {
+		defer close(c)
+		for _, corrRes := range geneRes {
+			c <- corrRes
+		}
+	}()
+	for range mcorr.PipeOutCorrResults(c, outFile) {
+	}
+}
+
+// writeGenes writes the genome coordinates of the CDS regions to a .csv file: the first and last
+// nucleotide of each region (on the reference, if there is one), and the number of its codons
+// with a reference gap at any of their nucleotides.
+func writeGenes(genes []geneRegion, outFile string, prov *provenance) {
+	w, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	prov.WriteHeader(w)
+	w.WriteString("# gene: the CDS region, as in the .json file\n")
+	w.WriteString("# start, stop: the first and last nucleotide of the region on the genome\n")
+	w.WriteString("# codons: the number of codons in the region\n")
+	w.WriteString("# ref_gap_codons: the number of codons at gaps in the reference\n")
+	w.WriteString("gene,start,stop,codons,ref_gap_codons\n")
+	for _, gene := range genes {
+		start, stop, gaps := gene.Start, gene.Start+3*gene.NumCodons-1, 0
+		if gene.RefPos != nil {
+			start, stop = refGap, refGap
+			for k := 0; k < gene.NumCodons; k++ {
+				gap := false
+				for _, c := range gene.RefPos[3*k : 3*k+3] {
+					if c == refGap {
+						gap = true
+						continue
+					}
+					if start == refGap {
+						start = c
+					}
+					stop = c
+				}
+				if gap {
+					gaps++
+				}
+			}
+		}
+		w.WriteString(fmt.Sprintf("%s,%s,%s,%d,%d\n", gene.ID, coordinate(start), coordinate(stop), gene.NumCodons, gaps))
+	}
+}
+
+func coordinate(pos int) string {
+	if pos == refGap {
+		return "ref-gap"
+	}
+	return fmt.Sprint(pos)
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// sitePair is a pair of codons of the concatenated sequences, i being the first on the genome.
+type sitePair struct {
+	i, j int
+}
+
+// useGenomicLags makes lag l hold the pairs of codons whose sites (the nucleotide at codonPosition) are
+// 3l to 3l+2 nucleotides apart on the genome, rather than l codons apart in the concatenated sequences,
+// so that the gaps between CDS regions count; lag 0 holds each codon paired with itself, and codons at
+// reference gaps are left out. It returns maxCodonLen or, if that is 0, the number of lags spanning the genome.
+func (idx *siteIndex) useGenomicLags(genes []geneRegion, codonPosition, maxCodonLen int) int {
+	coords := codonCoordinates(genes, codonPosition)
+	for i, pos := range coords {
+		if pos != refGap {
+			idx.byPos = append(idx.byPos, i)
+		}
+	}
+	if len(idx.byPos) == 0 {
+		log.Fatal("no codons are placed on the genome, so there are no genomic lags")
+	}
+	sort.SliceStable(idx.byPos, func(a, b int) bool { return coords[idx.byPos[a]] < coords[idx.byPos[b]] })
+	for _, i := range idx.byPos {
+		idx.pos = append(idx.pos, coords[i])
+	}
+	if maxCodonLen == 0 {
+		return (idx.pos[len(idx.pos)-1]-idx.pos[0])/3 + 1
+	}
+	return maxCodonLen
+}
+
+// pairs returns the pairs of codons at lag l among the numCodons codons of the concatenated sequences.
+func (idx *siteIndex) pairs(l, numCodons int) (pairs []sitePair) {
+	if idx.byPos == nil {
+		for i := 0; i+l < numCodons; i++ {
+			pairs = append(pairs, sitePair{i, i + l})
+		}
+		return
+	}
+	for a, i := range idx.byPos {
+		if l == 0 {
+			pairs = append(pairs, sitePair{i, i})
+			continue
+		}
+		from := idx.pos[a] + 3*l
+		for b := sort.SearchInts(idx.pos, from); b < len(idx.pos) && idx.pos[b] < from+3; b++ {
+			pairs = append(pairs, sitePair{i, idx.byPos[b]})
+		}
+	}
+	return
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// genomeWindow is a window of the genome, from start to end (inclusive) in genome coordinates.
+type genomeWindow struct {
+	start, end int
+}
+
+// codonCoordinates returns the genome coordinate of the nucleotide at codonPosition in each codon of the
+// concatenated sequences: on the reference if there is one (refGap at a reference gap), or from the start of its gene.
+func codonCoordinates(genes []geneRegion, codonPosition int) (pos []int) {
+	for _, gene := range genes {
+		for k := 0; k < gene.NumCodons; k++ {
+			if gene.RefPos != nil {
+				pos = append(pos, gene.RefPos[3*k+codonPosition])
+			} else {
+				pos = append(pos, gene.Start+3*k+codonPosition)
+			}
+		}
+	}
+	return
+}
+
+// makeGenomeWindows tiles the genome covered by the CDS regions with windows of width codons,
+// starting every step codons from the first codon.
+func makeGenomeWindows(genes []geneRegion, codonPosition, width, step int) (windows []genomeWindow) {
+	if width <= 0 || step <= 0 {
+		log.Fatalf("genomic windows need a positive width and step (got %d and %d codons)", width, step)
+	}
+	first, last := refGap, refGap
+	for _, pos := range codonCoordinates(genes, codonPosition) {
+		if pos == refGap {
+			continue
+		}
+		if first == refGap || pos < first {
+			first = pos
+		}
+		if pos > last {
+			last = pos
+		}
+	}
+	if first == refGap {
+		log.Fatal("no codons are placed on the genome, so there are no genomic windows")
+	}
+	for start := first; start <= last; start += 3 * step {
+		windows = append(windows, genomeWindow{start, start + 3*width - 1})
+	}
+	fmt.Printf("%d genomic windows of %d codons every %d codons\n", len(windows), width, step)
+	return
+}
+
+// writeGenomeWindowResults writes the profile of each genomic window to a .csv file in long format,
+// one row per window and lag, with the P2 of each window divided by its own d_sample.
+func writeGenomeWindowResults(lagMap map[int]lagResult, windows []genomeWindow, minlag, maxlag int, outFile string, prov *provenance) {
+	w, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	prov.WriteHeader(w)
+	w.WriteString("# window: the index of the genomic window\n")
+	w.WriteString("# start, end: the first and last nucleotide of the window on the genome; windows hold the site pairs whose first site is in them\n")
+	w.WriteString("# l: the distance between two genomic positions\n")
+	w.WriteString("# m: the mean value of correlation profile\n")
+	w.WriteString("# v: the variance of correlation profile\n")
+	w.WriteString("# n: the total number of codon pairs used for calculation\n")
+	w.WriteString("# t: the type of result: Ks is for d_sample, and P2 is for correlation profile\n")
+	w.WriteString("# b: the bootstrap number (all means used all alignments).\n")
+	w.WriteString("window,start,end,l,m,v,n,t,b\n")
+
+	for k, window := range windows {
+		ds := 0.0
+		if res, found := lagMap[0]; found && res.windows[k].n > 0 {
+			ds = res.windows[k].xy / float64(res.windows[k].n)
+		}
+		for l := minlag; l < maxlag; l++ {
+			res, found := lagMap[l]
+			if !found || res.windows[k].n == 0 {
+				continue
+			}
+			sum := res.windows[k]
+			m, t := sum.xy/float64(sum.n), "Ks"
+			if l > 0 {
+				m, t = m/ds, "P2"
+			}
+			w.WriteString(fmt.Sprintf("%d,%d,%d,%d,%g,%g,%d,%s,%s\n", k, window.start, window.end, 3*l, m, 0.0, sum.n, t, "all"))
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/kussell-lab/ncbiftp/taxonomy"
+	"os"
+	"strings"
+	"sync"
+)
+
+// matrixResult holds the Qs of every pair of groups at one lag: cells[g][h], for g <= h,
+// sums the site pairs within group g if g == h, and between groups g and h otherwise.
+type matrixResult struct {
+	lag   int // in codons
+	cells [][]qsSum
+}
+
+// calcQsMatrixAll calculates Qs within each group of sequences and between each pair of groups
+// in one pass over the lags, and writes the K x K matrix of profiles to outFile in long format,
+// returning the number of sequence pairs at each lag.
+func calcQsMatrixAll(groups []map[string][]Codon, names []string, codonPosition int, lags lagSet,
+	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, prov *provenance, numDigesters int) (pairs map[int]int) {
+	var cs [][]CodonSequence
+	for _, seqMap := range groups {
+		var groupSeqs []CodonSequence
+		for _, s := range seqMap {
+			groupSeqs = append(groupSeqs, s)
+		}
+		cs = append(cs, groupSeqs)
+	}
+	done := make(chan struct{})
+
+	lagChan := startLagChan(done, lags)
+	c := make(chan matrixResult)
+	var wg sync.WaitGroup
+	fmt.Printf("starting probability calculations for %d groups ...\n", len(groups))
+	for i := 0; i < numDigesters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range lagChan {
+				res := calcCorrResMatrix(cs, synonymous, codingTable, codonPosition, l)
+				for _, pooled := range lags.pools[l][1:] {
+					res.merge(calcCorrResMatrix(cs, synonymous, codingTable, codonPosition, pooled))
+				}
+				select {
+				case c <- res:
+					fmt.Printf("\rlag %d done", 3*l)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+
+	lagMap := make(map[int]matrixResult)
+	pairs = make(map[int]int)
+	for res := range c {
+		lagMap[res.lag] = res
+		for g := range res.cells {
+			for h := g; h < len(res.cells); h++ {
+				pairs[res.lag] += res.cells[g][h].n
+			}
+		}
+	}
+
+	minlag, maxlag := lags.span()
+	writeMatrixResults(lagMap, names, minlag, maxlag, outFile, prov)
+	return pairs
+}
+
+// merge adds the site pairs of another lag, pooling it into this one.
+func (res *matrixResult) merge(other matrixResult) {
+	for g := range res.cells {
+		for h := range res.cells[g] {
+			res.cells[g][h].xy += other.cells[g][h].xy
+			res.cells[g][h].n += other.cells[g][h].n
+		}
+	}
+}
+
+//calcCorrResMatrix calculates Qs for a given lag within each group (as calcCorrRes)
+//and between each pair of groups (as calcCorrResMates)
+func calcCorrResMatrix(cs [][]CodonSequence, synonymous bool, codingTable *taxonomy.GeneticCode,
+	codonPosition int, l int) (res matrixResult) {
+	k := len(cs)
+	res.lag = l
+	res.cells = make([][]qsSum, k)
+	for g := range res.cells {
+		res.cells[g] = make([]qsSum, k)
+	}
+	cpLists := make([][][]CodonPair, k)
+	ncLists := make([][]*NuclCov, k)
+	for i := 0; i+l < len(cs[0][0]); i++ {
+		j := i + l
+		//collect the codon pairs of each group once, split by the amino acids they code for
+		for g := range cs {
+			cpLists[g] = extractCodonPairs(cs[g], i, j, codingTable, synonymous)
+			ncLists[g] = ncLists[g][:0]
+			for _, cp := range cpLists[g] {
+				ncLists[g] = append(ncLists[g], doubleCodons(cp, codonPosition))
+			}
+		}
+		for g := 0; g < k; g++ {
+			for a, cp := range cpLists[g] {
+				if len(cp) >= 2 {
+					xy, n := ncLists[g][a].P11(0)
+					res.cells[g][g].xy += xy
+					res.cells[g][g].n += n
+				}
+			}
+			for h := g + 1; h < k; h++ {
+				for a, cp1 := range cpLists[g] {
+					for b, cp2 := range cpLists[h] {
+						if synonymous && translateCodonPair(cp1[0], codingTable) != translateCodonPair(cp2[0], codingTable) {
+							continue
+						}
+						xy, n := ncLists[g][a].MateP11(ncLists[h][b], 0)
+						res.cells[g][h].xy += xy
+						res.cells[g][h].n += n
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// writeMatrixResults writes the profile of each pair of groups to a .csv file in long format,
+// one row per pair of groups and lag, with the P2 of each pair divided by its own d_sample.
+func writeMatrixResults(lagMap map[int]matrixResult, names []string, minlag, maxlag int, outFile string, prov *provenance) {
+	w, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	prov.WriteHeader(w)
+	w.WriteString("# group_a, group_b: the pair of groups; the same group for a within-group profile\n")
+	w.WriteString("# l: the distance between two genomic positions\n")
+	w.WriteString("# m: the mean value of correlation profile\n")
+	w.WriteString("# v: the variance of correlation profile\n")
+	w.WriteString("# n: the total number of codon pairs used for calculation\n")
+	w.WriteString("# t: the type of result: Ks is for d_sample, and P2 is for correlation profile\n")
+	w.WriteString("# b: the bootstrap number (all means used all alignments).\n")
+	w.WriteString("group_a,group_b,l,m,v,n,t,b\n")
+
+	for g := range names {
+		for h := g; h < len(names); h++ {
+			ds := 0.0
+			if res, found := lagMap[0]; found && res.cells[g][h].n > 0 {
+				ds = res.cells[g][h].xy / float64(res.cells[g][h].n)
+			}
+			for l := minlag; l < maxlag; l++ {
+				res, found := lagMap[l]
+				if !found || res.cells[g][h].n == 0 {
+					continue
+				}
+				cell := res.cells[g][h]
+				m, t := cell.xy/float64(cell.n), "Ks"
+				if l > 0 {
+					m, t = m/ds, "P2"
+				}
+				w.WriteString(fmt.Sprintf("%s,%s,%d,%g,%g,%d,%s,%s\n", csvField(names[g]), csvField(names[h]), 3*l, m, 0.0, cell.n, t, "all"))
+			}
+		}
+	}
+}
+
+// csvField quotes a group name holding a comma or quote.
+func csvField(s string) string {
+	if strings.ContainsAny(s, ",\"\n") {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+	return s
+}
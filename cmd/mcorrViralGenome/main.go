@@ -22,10 +22,10 @@ import (
 	"github.com/kussell-lab/ncbiftp/taxonomy"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"io"
+	"log"
 	"os"
 	"runtime"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -44,9 +44,47 @@ func main() {
 	ncpu := app.Flag("num-cpu", "Number of CPUs (default: using all available cores)").Default("0").Int()
 	mates := app.Flag("between-clades", "just calculate correlations between pairs from different xmfa files").Default("false").Bool()
 	numDigesters := app.Flag("num-threads", "number of threads").Default("50").Int()
+	refName := app.Flag("ref-name", "strain name of a reference genome in the alignment, to give gene positions in its coordinates").Default("").String()
+	refFasta := app.Flag("ref-fasta", "FASTA file of the reference sequence of each CDS region, aligned to the XMFA and named by gene, to give gene positions in its coordinates").Default("").String()
+	duplicateNames := app.Flag("duplicate-names", "what to do with a strain name which appears more than once in a CDS region: rename the copies in order (<name>_1, ...), error, keep-first or keep-longest").Default("rename").Enum(duplicatePolicies...)
+	headerFormat := app.Flag("header-format", "format of the XMFA sequence headers: a template of {gene}, {start}, {stop}, {strain} and {_} (any text), or a regular expression with those named groups").Default(defaultHeaderFormat).String()
+	metadata := app.Flag("metadata", "table of sample metadata (tab-separated, or comma-separated if .csv) to split the strains into groups, giving within- and between-group profiles").Default("").String()
+	groupBy := app.Flag("group-by", "metadata column holding the group of each strain").Default("clade").String()
+	idColumn := app.Flag("id-column", "metadata column holding the strain names (default: the first column)").Default("").String()
+	groupPicks := app.Flag("group-pair", "pair of groups to compare, as <group>,<group> (repeatable; default: all pairs)").Strings()
+	timeWindows := app.Flag("time-windows", "split the strains into time windows by collection date: fixed, sliding or equal-count; writes <out>.windows.csv").Default("").Enum("", "fixed", "sliding", "equal-count")
+	windowDays := app.Flag("window-days", "width of fixed and sliding time windows (days)").Default("14").Int()
+	windowStep := app.Flag("window-step", "distance between the starts of sliding time windows (days)").Default("7").Int()
+	numWindows := app.Flag("num-windows", "number of equal-count time windows").Default("4").Int()
+	consecutive := app.Flag("consecutive-windows", "also calculate the profile between each time window and the next").Default("false").Bool()
+	dateColumn := app.Flag("date-column", "metadata column holding the collection date (YYYY-MM-DD) of each strain").Default("date").String()
+	datePattern := app.Flag("date-pattern", "regular expression finding the collection date in the strain name, without --metadata").Default(`\d{4}-\d{2}-\d{2}`).String()
+	genomeWindowWidth := app.Flag("genome-window", "width of sliding genomic windows (codons) to calculate a profile for each, from the site pairs whose first site is in it; writes <out>.genome_windows.csv (0: none)").Default("0").Int()
+	genomeWindowStep := app.Flag("genome-window-step", "distance between the starts of genomic windows (codons; default: the window width)").Default("0").Int()
+	genomicLags := app.Flag("genomic-lags", "define lags by the distance between sites on the genome (from the gene positions in the XMFA headers, or the reference), counting the gaps between CDS regions, rather than along the concatenated CDS regions").Default("false").Bool()
+	lagSpec := app.Flag("lags", "lags to calculate (bp) instead of --min-corr-length to --max-corr-length: a comma-separated list of lags, ranges <min>:<max>[:<step>] and log:<min>:<max>:<n> (n lags evenly spaced on a log scale)").Default("").String()
+	lagBin := app.Flag("lag-bin", "pool the lags into bins of this width (bp), writing one row per bin with the pooled n (0: no pooling)").Default("0").Int()
+	groupMatrix := app.Flag("group-matrix", "with --metadata, calculate the profiles of all pairs of groups in one pass and write them to <out>.matrix.csv").Default("false").Bool()
 	//showProgress := app.Flag("show-progress", "Show progress").Bool()
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	headers = newHeaderFormat(*headerFormat)
+	if (*metadata != "" || *timeWindows != "") && *mates {
+		log.Fatalf("give either --metadata or --time-windows, or --between-clades, not both")
+	}
+	if *consecutive && *timeWindows == "sliding" && *windowStep < *windowDays {
+		log.Fatalf("--consecutive-windows needs windows which do not overlap (a --window-step of at least --window-days)")
+	}
+	if *groupMatrix && *metadata == "" {
+		log.Fatalf("--group-matrix needs the groups from --metadata")
+	}
+	if *genomicLags && *groupMatrix {
+		log.Fatalf("--genomic-lags does not work with --group-matrix")
+	}
+	if *genomeWindowWidth > 0 && (*timeWindows != "" || *groupMatrix) {
+		log.Fatalf("--genome-window does not work with --time-windows or --group-matrix")
+	}
+	prov := newProvenance(app, "")
 
 	if *ncpu <= 0 {
 		*ncpu = runtime.NumCPU()
@@ -55,6 +93,8 @@ func main() {
 
 	//timer
 	start := time.Now()
+	timer := newPhaseTimer()
+	summary := &runSummary{Program: "mcorrViralGenome"}
 
 	// prepare calculator.
 	codingTable := taxonomy.GeneticCodes()["11"]
@@ -84,15 +124,20 @@ func main() {
 	//seqMap := make(map[string][]Codon)
 	var seqMap map[string][]Codon
 	var seqMap1 map[string][]Codon
+	//the CDS regions, in the order they are concatenated
+	var genes []geneRegion
+	ref := loadReference(*refName, *refFasta)
 	if *mateAln != "" {
 		if *mates {
-			seqMap = makeSeqMap(startSlice, *alnFile, codonOffset)
-			seqMap1 = makeSeqMap(startSlice, *mateAln, codonOffset)
+			seqMap, genes = makeSeqMap(startSlice, *alnFile, codonOffset, ref, *duplicateNames)
+			var genes1 []geneRegion
+			seqMap1, genes1 = makeSeqMap(startSlice, *mateAln, codonOffset, nil, *duplicateNames)
+			summary.addDuplicates(genes1)
 		} else {
-			seqMap = combinedSeqMap(startSlice, *alnFile, *mateAln, codonOffset)
+			seqMap, genes = combinedSeqMap(startSlice, *alnFile, *mateAln, codonOffset, ref, *duplicateNames)
 		}
 	} else {
-		seqMap = makeSeqMap(startSlice, *alnFile, codonOffset)
+		seqMap, genes = makeSeqMap(startSlice, *alnFile, codonOffset, ref, *duplicateNames)
 	}
 
 	numSeqs := len(seqMap)
@@ -110,43 +155,132 @@ func main() {
 		fmt.Printf("total number of strains: %d\n", numSeqs)
 	}
 	fmt.Printf("total number of codons: %d\n", numCodons)
+	timer.Done("read alignments")
+	summary.summarizeSequences(genes, []map[string][]Codon{seqMap, seqMap1}, codingTable, codonPos-1)
+	timer.Done("summarize sequences")
+	prov.Set("genetic-code", "11")
+	prov.Set("synonymous", synonymous)
+	prov.Set("codon-position", codonPos)
+	prov.Set("num-strains", numSeqs)
+	prov.Set("num-codons", numCodons)
+	if *mateAln != "" {
+		prov.Set("input-sha256", hashFiles(*alnFile, *mateAln))
+	} else {
+		prov.Set("input-sha256", hashFiles(*alnFile))
+	}
 
 	//initialize output csv
 	outFile := *outPrefix + ".csv"
-	initCsvOut(outFile)
+	jsonFile := *outPrefix + ".json"
+	writeGenes(genes, *outPrefix+".genes.csv", prov)
+	var genomeWindows []genomeWindow
+	if *genomeWindowWidth > 0 {
+		if *genomeWindowStep == 0 {
+			*genomeWindowStep = *genomeWindowWidth
+		}
+		genomeWindows = makeGenomeWindows(genes, codonPos-1, *genomeWindowWidth, *genomeWindowStep)
+	}
+	idx := newSiteIndex(genes, genomeWindows, codonPos-1)
+	if *genomicLags {
+		maxCodonLen = idx.useGenomicLags(genes, codonPos-1, maxCodonLen)
+	}
+	minlag, maxlag := lagRange(minCodonLen, maxCodonLen, numCodons)
+	lags := newLagSet(*lagSpec, minlag, maxlag, *lagBin/3)
 	//var results mcorr.CorrResults
 	//corrResChan := make(chan mcorr.CorrResults)
 	//var calculator Calculator
-	if *mates {
-		calcQsMatesAll(seqMap, seqMap1, codonOffset, codonPos-1, minCodonLen, maxCodonLen,
-			codingTable, synonymous, outFile, *numDigesters)
+	var pairs map[int]int
+	if *timeWindows != "" {
+		//profiles of the strains collected in each time window
+		dates := collectionDates(seqMap, *metadata, *idColumn, *dateColumn, *datePattern)
+		windows := makeTimeWindows(seqMap, dates, *timeWindows, *windowDays, *windowStep, *numWindows)
+		pairs = calcWindowProfiles(windows, *consecutive, idx, codonPos-1, lags,
+			codingTable, synonymous, *outPrefix+".windows.csv", prov, *numDigesters)
+		fmt.Printf("wrote %s.windows.csv\n", *outPrefix)
+	} else if *metadata != "" && *groupMatrix {
+		//the matrix of profiles of all pairs of the groups (or of those in the picked pairs)
+		groups, names := splitGroups(seqMap, readMetadata(*metadata, *idColumn, *groupBy))
+		var matrixNames []string
+		var matrixGroups []map[string][]Codon
+		for _, p := range groupPairs(names, *groupPicks) {
+			if p.a == p.b {
+				matrixNames = append(matrixNames, p.a)
+				matrixGroups = append(matrixGroups, groups[p.a])
+			}
+		}
+		if len(matrixNames) < 2 {
+			log.Fatalf("--group-matrix needs at least two groups, but there is only %s", strings.Join(matrixNames, ""))
+		}
+		prov.Set("groups", strings.Join(matrixNames, " "))
+		pairs = calcQsMatrixAll(matrixGroups, matrixNames, codonPos-1, lags,
+			codingTable, synonymous, *outPrefix+".matrix.csv", prov, *numDigesters)
+		fmt.Printf("\nwrote %s.matrix.csv\n", *outPrefix)
+	} else if *metadata != "" {
+		//profiles within and between the groups of strains in the metadata
+		groups, names := splitGroups(seqMap, readMetadata(*metadata, *idColumn, *groupBy))
+		pairs = make(map[int]int)
+		picked := groupPairs(names, *groupPicks)
+		skipped := 0
+		for _, p := range picked {
+			prefix := p.prefix(*outPrefix)
+			var groupRes map[int]int
+			if p.a == p.b {
+				if len(groups[p.a]) < 2 {
+					fmt.Printf("skipping %s: group %s has fewer than 2 strains\n", prefix, p.a)
+					skipped++
+					continue
+				}
+				prov.Set("group", p.a)
+				groupRes = calcQsAll(groups[p.a], genes, idx, codonOffset, codonPos-1, lags,
+					codingTable, synonymous, prefix+".csv", prefix+".json", prov, *numDigesters)
+			} else {
+				prov.Set("group", p.a+","+p.b)
+				groupRes = calcQsMatesAll(groups[p.a], groups[p.b], genes, idx, codonOffset, codonPos-1, lags,
+					codingTable, synonymous, prefix+".csv", prefix+".json", prov, *numDigesters)
+			}
+			fmt.Printf("\nwrote %s.csv\n", prefix)
+			for l, n := range groupRes {
+				pairs[l] += n
+			}
+		}
+		if skipped == len(picked) {
+			log.Fatalf("no profiles to calculate: every group has fewer than 2 strains")
+		}
+	} else if *mates {
+		initCsvOut(outFile)
+		pairs = calcQsMatesAll(seqMap, seqMap1, genes, idx, codonOffset, codonPos-1, lags,
+			codingTable, synonymous, outFile, jsonFile, prov, *numDigesters)
 	} else {
+		initCsvOut(outFile)
 		//calculator = NewCodingCalculator(codingTable, maxCodonLen, codonOffset, codonPos-1, synonymous)
 		//results = calculator.CalcP2(seqMap)
-		calcQsAll(seqMap, codonOffset, codonPos-1, minCodonLen,
-			maxCodonLen, codingTable, synonymous, outFile, *numDigesters)
+		pairs = calcQsAll(seqMap, genes, idx, codonOffset, codonPos-1, lags,
+			codingTable, synonymous, outFile, jsonFile, prov, *numDigesters)
 	}
+	timer.Done("calculate profile")
+	summary.setLags(pairs)
+	summary.Write(*outPrefix, timer)
 
 	duration := time.Since(start)
 	fmt.Println("Time to calculate mean corr profile:", duration)
-	//corrResChan := calcSingleClade(alnChan, calculator)
-	//what's in the json is actually Qs NOT P2!
-	//resChan := mcorr.PipeOutCorrResults(corrResChan, *outPrefix+".json")
-	//division by d_sample or P2 is not until here!!!
-	//CollectWrite(corrResChan, *outPrefix+".csv")
 }
 
-func makeSeqMap(startSlice []int, alnFile string, codonOffset int) (seqMap map[string][]Codon) {
+//makeSeqMap concatenates the CDS regions in order of their start positions,
+//and returns the sequences along with where each CDS region is in them (and on the reference ref, if any)
+func makeSeqMap(startSlice []int, alnFile string, codonOffset int, ref *reference, policy string) (seqMap map[string][]Codon, genes []geneRegion) {
 	seqMap = make(map[string][]Codon)
+	chooseLongestCopies(policy, alnFile)
 	for _, i := range startSlice {
 		a := getGene(alnFile, i)
-		addCodons(a, seqMap, codonOffset)
+		duplicates := addCodons(a, seqMap, codonOffset, policy)
+		genes = addGeneRegion(genes, a, i, codonOffset, ref, duplicates)
 	}
-	return seqMap
+	return seqMap, genes
 }
 
-func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int) (seqMap map[string][]Codon) {
+func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int, ref *reference, policy string) (seqMap map[string][]Codon, genes []geneRegion) {
 	seqMap = make(map[string][]Codon)
+	chooseLongestCopies(policy, alnFile, mateAln)
 	for _, i := range startSlice {
 		// get the gene alignment from the first file
 		aln1 := getGene(alnFile, i)
@@ -154,9 +288,31 @@ func combinedSeqMap(startSlice []int, alnFile, mateAln string, codonOffset int)
 		aln2 := getGene(mateAln, i)
 		// add on the alignment 2 sequences onto alignment 1
 		aln1.Sequences = append(aln1.Sequences, aln2.Sequences...)
-		addCodons(aln1, seqMap, codonOffset)
+		duplicates := addCodons(aln1, seqMap, codonOffset, policy)
+		genes = addGeneRegion(genes, aln1, i, codonOffset, ref, duplicates)
 	}
-	return seqMap
+	return seqMap, genes
+}
+
+//addGeneRegion appends the CDS region of the alignment a, starting at start on the genome, to genes,
+//placing its columns on the reference ref if there is one
+func addGeneRegion(genes []geneRegion, a Alignment, start, codonOffset int, ref *reference, duplicates []strainDuplicate) []geneRegion {
+	startCodon := 0
+	if len(genes) > 0 {
+		last := genes[len(genes)-1]
+		startCodon = last.StartCodon + last.NumCodons
+	}
+	gene := geneRegion{
+		ID:         a.ID,
+		Start:      start,
+		StartCodon: startCodon,
+		NumCodons:  len(extractCodons(a.Sequences[0], codonOffset)),
+		Duplicates: duplicates,
+	}
+	if ref != nil {
+		gene.RefPos = ref.columns(a, start, codonOffset)
+	}
+	return append(genes, gene)
 }
 
 func getGene(alnFile string, startCodon int) (gene Alignment) {
@@ -172,16 +328,14 @@ func getGene(alnFile string, startCodon int) (gene Alignment) {
 }
 
 func getStartPos(aln Alignment) int {
-	genomePos := aln.genePos
-	terms := strings.Split(genomePos, "+")
-	startPos, _ := strconv.Atoi(terms[0])
-	return startPos
+	return aln.start
 }
 
 // Alignment is an array of mutliple sequences with same length.
 type Alignment struct {
 	ID        string //gene ID
-	genePos   string // position of gene on the genome
+	start     int    // position of gene on the genome
+	stop      int
 	Sequences []seq.Sequence
 }
 
@@ -230,10 +384,8 @@ func readAlignments(file string) (alnChan chan Alignment) {
 
 		c := readXMFA(file)
 		for alignment := range c {
-			header := strings.Split(alignment[0].Id, " ")
-			alnID := header[0]
-			genomePos := header[1]
-			alnChan <- Alignment{ID: alnID, genePos: genomePos, Sequences: alignment}
+			header := headers.parse(alignment[0].Id)
+			alnChan <- Alignment{ID: header.gene, start: header.start, stop: header.stop, Sequences: alignment}
 		}
 	}()
 
@@ -289,51 +441,38 @@ func mustOpen(file string) (f *os.File) {
 	return
 }
 
+//getNames reads the gene and strain names from a sequence header (see --header-format)
 func getNames(s string) (geneName, genomeName string) {
-	terms := strings.Split(s, " ")
-	//this is the genomeName for the MSA files assembled from ReferenceAlignmentGenerator
-	geneName = terms[0]
-	genomeName = terms[2]
-	return
+	header := headers.parse(s)
+	return header.gene, header.strain
 }
 
-//addCodons adds codons to each strain sequence in the sequence map
-func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int) {
+//addCodons adds codons to each strain sequence in the sequence map, keeping or renaming strains
+//which appear more than once according to the duplicate-name policy, and returns those duplicates
+func addCodons(a Alignment, seqMap map[string][]Codon, codonOffset int, policy string) []strainDuplicate {
+	seqs, names, dups := uniqueStrains(a, policy)
+	reportDuplicates(dups)
 	//add codons to the map for each sequence
 	var wg sync.WaitGroup
 	//tell wg how many threads will be running concurrently
-	wg.Add(len(a.Sequences))
+	wg.Add(len(seqs))
 	//mutex lock for safe access to seqMap
 	var mutex = &sync.Mutex{}
-	alnSeqs := a.Sequences
-	//give duplicate strain names a suffix to differentiate
-	duplicates := make(map[string]int)
-	for j := 0; j < len(alnSeqs); j++ {
+	for j := 0; j < len(seqs); j++ {
 		go func(j int) {
 			defer wg.Done()
-			s := alnSeqs[j]
-			codons := extractCodons(s, codonOffset)
-			_, seqName := getNames(s.Id)
-			//check if the strain name has been done ...
+			codons := extractCodons(seqs[j], codonOffset)
 			mutex.Lock()
-			i, found := duplicates[seqName]
-			//update the count for the strain
-			duplicates[seqName]++
-			mutex.Unlock()
-			if found {
-				id := strconv.Itoa(i)
-				seqName = seqName + "_" + id
-			}
-			mutex.Lock()
-			seqMap[seqName] = append(seqMap[seqName], codons...)
+			seqMap[names[j]] = append(seqMap[names[j]], codons...)
 			mutex.Unlock()
 		}(j)
 	}
 	wg.Wait()
+	return dups
 }
 
 // WriteResults writes correlation results of the original sample and the bootstraps to a .csv file
-func WriteResults(corrResMap map[int]mcorr.CorrResult, maxCodonLen int, outFile string) {
+func WriteResults(corrResMap map[int]mcorr.CorrResult, lags []int, outFile string, prov *provenance) {
 
 	w, err := os.Create(outFile)
 	if err != nil {
@@ -341,6 +480,8 @@ func WriteResults(corrResMap map[int]mcorr.CorrResult, maxCodonLen int, outFile
 	}
 	defer w.Close()
 
+	prov.WriteHeader(w)
+
 	w.WriteString("# l: the distance between two genomic positions\n")
 	w.WriteString("# m: the mean value of correlation profile\n")
 	w.WriteString("# v: the variance of correlation profile\n")
@@ -357,7 +498,10 @@ func WriteResults(corrResMap map[int]mcorr.CorrResult, maxCodonLen int, outFile
 	w.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", res.Lag, res.Mean, res.Variance, res.N, res.Type, "all"))
 	ds = res.Mean
 
-	for l := 1; l < maxCodonLen; l++ {
+	for _, l := range lags {
+		if l == 0 {
+			continue
+		}
 		res := corrResMap[l*3]
 		w.WriteString(fmt.Sprintf("%d,%g,%g,%d,%s,%s\n", res.Lag, res.Mean/ds, res.Variance, res.N, res.Type, "all"))
 	}
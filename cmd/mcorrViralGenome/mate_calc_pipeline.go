@@ -21,10 +21,18 @@ import (
 	"sync"
 )
 
-// calcQsAll calculates Qs at all positions for a given alignment and writes it to the outputcsv
+// calcQsMatesAll calculates Qs between the two sets of sequences at all positions and writes it to the outputcsv,
+// along with the profile of each genomic window (if any), returning the number of sequence pairs at each lag
+func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, genes []geneRegion, idx *siteIndex, codonOffset, codonPosition int, lags lagSet,
+	codingTable *taxonomy.GeneticCode, synonymous bool, outFile, jsonFile string, prov *provenance, numDigesters int) (pairs map[int]int) {
+	lagMap := calcLagResultsMates(seqMap1, seqMap2, idx, codonPosition, lags, codingTable, synonymous, numDigesters)
+	return writeLagResults(lagMap, genes, idx.windows, lags, outFile, jsonFile, prov)
+}
 
-func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, codonOffset, codonPosition, minCodonLen int, maxCodonLen int,
-	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, numDigesters int) {
+// calcLagResultsMates calculates Qs between the two sets of sequences at all positions for each lag,
+// keyed by the lag in codons.
+func calcLagResultsMates(seqMap1, seqMap2 map[string][]Codon, idx *siteIndex, codonPosition int, lags lagSet,
+	codingTable *taxonomy.GeneticCode, synonymous bool, numDigesters int) (lagMap map[int]lagResult) {
 	//get our two lists of codon sequences
 	var cs1 []CodonSequence
 	var cs2 []CodonSequence
@@ -38,40 +46,41 @@ func calcQsMatesAll(seqMap1, seqMap2 map[string][]Codon, codonOffset, codonPosit
 	}
 	done := make(chan struct{})
 
-	lagChan := startLagChan(done, minCodonLen, maxCodonLen, cs1)
+	lagChan := startLagChan(done, lags)
 	//start a fixed number of go routines
-	c := make(chan mcorr.CorrResult)
+	c := make(chan lagResult)
 	var wg sync.WaitGroup
 	fmt.Printf("starting probability calculations ...\n")
 	for i := 0; i < numDigesters; i++ {
 		wg.Add(1)
-		go calcQsMates(done, lagChan, c, cs1, cs2, synonymous, codingTable, codonPosition, i, &wg)
+		go calcQsMates(done, lagChan, c, cs1, cs2, idx, lags, synonymous, codingTable, codonPosition, i, &wg)
 	}
 
 	go func() {
 		wg.Wait()
 		close(c)
 	}()
-	//end of pipeline; make a map then write to file
+	//end of pipeline; collect the results by lag
 
-	resMap := make(map[int]mcorr.CorrResult)
+	lagMap = make(map[int]lagResult)
 	for res := range c {
-		resMap[res.Lag] = res
+		lagMap[res.lag] = res
 	}
-
-	WriteResults(resMap, maxCodonLen, outFile)
-
+	return lagMap
 }
 
 //calcQsMates calculates Qs for a given lag across all initial positions
-func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- mcorr.CorrResult, cs1, cs2 []CodonSequence, synonymous bool,
+func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- lagResult, cs1, cs2 []CodonSequence, idx *siteIndex, lags lagSet, synonymous bool,
 	codingTable *taxonomy.GeneticCode, codonPosition int, id int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	//fmt.Printf("Worker %d starting\n", id)
 	//var results []CorrResult
 	for l := range lagChan {
 		//fmt.Printf("lag %d starting \n", l)
-		corrRes := calcCorrResMates(cs1, cs2, synonymous, codingTable, codonPosition, l)
+		corrRes := calcCorrResMates(cs1, cs2, idx, synonymous, codingTable, codonPosition, l)
+		for _, pooled := range lags.pools[l][1:] {
+			corrRes.merge(calcCorrResMates(cs1, cs2, idx, synonymous, codingTable, codonPosition, pooled))
+		}
 		select {
 		case resChan <- corrRes:
 			lag := 3 * l
@@ -83,16 +92,20 @@ func calcQsMates(done <-chan struct{}, lagChan <-chan int, resChan chan<- mcorr.
 	//fmt.Printf("Worker %d done\n", id)
 }
 
-func calcCorrResMates(cs1, cs2 []CodonSequence, synonymous bool,
-	codingTable *taxonomy.GeneticCode, codonPosition int, l int) (corrRes mcorr.CorrResult) {
+//calcCorrResMates calculates Qs between the two sets of sequences for a given lag, summing it up both
+//across the genome and by the CDS regions (given for each codon by idx) holding the two sites and the genomic windows holding the first
+func calcCorrResMates(cs1, cs2 []CodonSequence, idx *siteIndex, synonymous bool,
+	codingTable *taxonomy.GeneticCode, codonPosition int, l int) (corrRes lagResult) {
+	corrRes = newLagResult(idx)
+	corrRes.lag = l
 	//corrResMap := make(map[pos_key]CorrResult)
 	//loop through initial positions for a given lag
 	//collect P2
 	totalP2 := 0.0
 	totaln := 0
-	for i := 0; i+l < len(cs1[0]); i++ {
+	for _, p := range idx.pairs(l, len(cs1[0])) {
 
-		j := i + l
+		i, j := p.i, p.j
 		//get codonPairs, which are two codons on the same sequence
 		//separated by a distance i+l
 		cpList1 := extractCodonPairs(cs1, i, j, codingTable, synonymous)
@@ -108,6 +121,7 @@ func calcCorrResMates(cs1, cs2 []CodonSequence, synonymous bool,
 						xy, n := nc1.MateP11(nc2, 0)
 						totalP2 += xy
 						totaln += n
+						corrRes.add(idx, i, j, xy, n)
 					}
 				} else {
 
@@ -115,7 +129,7 @@ func calcCorrResMates(cs1, cs2 []CodonSequence, synonymous bool,
 			}
 		}
 		if totaln > 0 {
-			corrRes = mcorr.CorrResult{
+			corrRes.all = mcorr.CorrResult{
 				Lag:  l * 3,
 				Mean: totalP2 / float64(totaln),
 				N:    totaln,
@@ -149,21 +163,12 @@ func translateCodonPair(cp CodonPair, codingTable *taxonomy.GeneticCode) string
 	return string([]byte{a, b})
 }
 
-//startLagChan returns a channel of lags
-func startLagChan(done <-chan struct{}, minCodonLen int, maxCodonLen int, codonSequences []CodonSequence) <-chan int {
+//startLagChan returns a channel of lags (the first lag of each pool)
+func startLagChan(done <-chan struct{}, lags lagSet) <-chan int {
 	lagChan := make(chan int)
-	var maxlag int
-	var minlag int
-	if maxCodonLen == 0 {
-		maxlag = len(codonSequences[0])
-		minlag = 0
-	} else {
-		maxlag = maxCodonLen
-		minlag = minCodonLen
-	}
 	go func() {
 		defer close(lagChan)
-		for l := minlag; l < maxlag; l++ {
+		for _, l := range lags.labels {
 			select {
 			case lagChan <- l:
 			case <-done:
@@ -0,0 +1,166 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// readMetadata reads the value of each strain in the column (such as its group or collection date) of
+// a metadata table (such as the output of Nextclade or pangolin) with a header row, tab-separated unless
+// the file ends in .csv. Strains are named by the column idColumn, or the first column if idColumn is empty.
+// Rows with an empty value are left out.
+func readMetadata(file, idColumn, column string) (values map[string]string) {
+	f := mustOpen(file)
+	defer f.Close()
+	r := csv.NewReader(f)
+	if !strings.HasSuffix(file, ".csv") {
+		r.Comma = '\t'
+	}
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		log.Fatalf("Error when reading the header of %s: %v", file, err)
+	}
+	idCol, col := 0, -1
+	for i, name := range header {
+		if name == idColumn {
+			idCol = i
+		}
+		if name == column {
+			col = i
+		}
+	}
+	if idColumn != "" && header[idCol] != idColumn {
+		log.Fatalf("%s has no column %s", file, idColumn)
+	}
+	if col < 0 {
+		log.Fatalf("%s has no column %s (columns: %s)", file, column, strings.Join(header, ", "))
+	}
+	values = make(map[string]string)
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Error when reading %s: %v", file, err)
+		}
+		if idCol >= len(row) || col >= len(row) {
+			log.Fatalf("line %d of %s has %d columns but the header has %d", line, file, len(row), len(header))
+		}
+		if row[col] != "" {
+			values[row[idCol]] = row[col]
+		}
+	}
+	return
+}
+
+// splitGroups splits the sequences into groups, returning the sorted group names;
+// strains without a group in the metadata are left out and reported. It fails if no strain has a group.
+func splitGroups(seqMap map[string][]Codon, groupOf map[string]string) (groups map[string]map[string][]Codon, names []string) {
+	groups = make(map[string]map[string][]Codon)
+	var missing []string
+	for strain, codons := range seqMap {
+		g, found := groupOf[strain]
+		if !found {
+			missing = append(missing, strain)
+			continue
+		}
+		if groups[g] == nil {
+			groups[g] = make(map[string][]Codon)
+			names = append(names, g)
+		}
+		groups[g][strain] = codons
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		log.Fatalf("none of the %d strains in the alignment has a group in the metadata: check --id-column and --group-by", len(seqMap))
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		fmt.Printf("leaving out %d strains without a group in the metadata: %s\n", len(missing), strings.Join(missing, ", "))
+	}
+	for _, g := range names {
+		fmt.Printf("group %s: %d strains\n", g, len(groups[g]))
+	}
+	return
+}
+
+// groupPair is a pair of groups to compare; a group paired with itself gives its within-group profile.
+type groupPair struct {
+	a, b string
+}
+
+// groupPairs returns the within-group profile of each group and the between-group profile of each
+// pair of groups, or, if picks are given as "<group>,<group>", just those pairs along with the
+// within-group profiles of the groups in them.
+func groupPairs(names []string, picks []string) (pairs []groupPair) {
+	if len(picks) == 0 {
+		for i, a := range names {
+			pairs = append(pairs, groupPair{a, a})
+			for _, b := range names[i+1:] {
+				pairs = append(pairs, groupPair{a, b})
+			}
+		}
+		return
+	}
+	known := make(map[string]bool)
+	for _, g := range names {
+		known[g] = true
+	}
+	within := make(map[string]bool)
+	var between []groupPair
+	for _, pick := range picks {
+		terms := strings.Split(pick, ",")
+		if len(terms) != 2 {
+			log.Fatalf("--group-pair %q should be two groups separated by a comma", pick)
+		}
+		for _, g := range terms {
+			if !known[g] {
+				log.Fatalf("--group-pair %q: no strains are in group %s", pick, g)
+			}
+			within[g] = true
+		}
+		if terms[0] != terms[1] {
+			between = append(between, groupPair{terms[0], terms[1]})
+		}
+	}
+	for _, g := range names {
+		if within[g] {
+			pairs = append(pairs, groupPair{g, g})
+		}
+	}
+	return append(pairs, between...)
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// prefix returns the output prefix of the profile of the pair:
+// <out>.within.<group> or <out>.between.<group>.<group>.
+func (p groupPair) prefix(outPrefix string) string {
+	a, b := unsafeName.ReplaceAllString(p.a, "_"), unsafeName.ReplaceAllString(p.b, "_")
+	if p.a == p.b {
+		return fmt.Sprintf("%s.within.%s", outPrefix, a)
+	}
+	return fmt.Sprintf("%s.between.%s.%s", outPrefix, a, b)
+}
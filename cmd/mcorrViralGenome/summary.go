@@ -0,0 +1,225 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kussell-lab/ncbiftp/taxonomy"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// runSummary holds the diagnostics of a run, which are written to <out>.summary.json
+// and <out>.summary.txt once the run is done.
+type runSummary struct {
+	Program    string            `json:"program"`
+	Genes      []geneSummary     `json:"genes"`
+	Strains    []strainSummary   `json:"strains"`
+	Duplicates []strainDuplicate `json:"duplicates"`
+	Lags       []lagSummary      `json:"lags"`
+	Phases     []phaseSummary    `json:"phases"`
+}
+
+type geneSummary struct {
+	ID          string  `json:"id"`
+	Codons      int     `json:"codons"`
+	GapFraction float64 `json:"gap_fraction"` // fraction of nucleotides which are gaps or ambiguous
+	SynSites    int     `json:"syn_informative_sites"`
+}
+
+type strainSummary struct {
+	Name         string  `json:"name"`
+	Completeness float64 `json:"completeness"` // fraction of the nucleotides of all CDS regions which are A, C, G or T
+}
+
+type lagSummary struct {
+	Lag   int `json:"lag"` // in base pairs
+	Pairs int `json:"pairs"`
+}
+
+type phaseSummary struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// phaseTimer records the wall time of each phase of a run.
+type phaseTimer struct {
+	start  time.Time
+	phases []phaseSummary
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{start: time.Now()}
+}
+
+// Done ends the current phase, naming it name, and starts the next one.
+func (t *phaseTimer) Done(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, phaseSummary{name, now.Sub(t.start).Seconds()})
+	t.start = now
+}
+
+func isBase(b byte) bool {
+	switch b {
+	case 'A', 'C', 'G', 'T', 'a', 'c', 'g', 't':
+		return true
+	}
+	return false
+}
+
+func isCompleteCodon(c Codon) bool {
+	return isBase(c[0]) && isBase(c[1]) && isBase(c[2])
+}
+
+// summarizeSequences fills in the genes, strains and duplicate strain names of the summary from the
+// concatenated sequences of one or more sets of strains. A codon is synonymous-informative if two strains coding for
+// the same amino acid there differ at codonPosition.
+func (s *runSummary) summarizeSequences(genes []geneRegion, seqMaps []map[string][]Codon,
+	codingTable *taxonomy.GeneticCode, codonPosition int) {
+	var names []string
+	var seqs [][]Codon
+	for _, seqMap := range seqMaps {
+		var mapNames []string
+		for name := range seqMap {
+			mapNames = append(mapNames, name)
+		}
+		sort.Strings(mapNames)
+		for _, name := range mapNames {
+			names = append(names, name)
+			seqs = append(seqs, seqMap[name])
+		}
+	}
+	numCodons := 0
+	for _, gene := range genes {
+		numCodons += gene.NumCodons
+	}
+	for k, seq := range seqs {
+		complete := 0
+		for _, c := range seq {
+			for _, b := range c {
+				if isBase(b) {
+					complete++
+				}
+			}
+		}
+		completeness := 0.0
+		if numCodons > 0 {
+			completeness = float64(complete) / float64(3*numCodons)
+		}
+		s.Strains = append(s.Strains, strainSummary{names[k], completeness})
+	}
+	for _, gene := range genes {
+		gs := geneSummary{ID: gene.ID, Codons: gene.NumCodons}
+		gaps, total := 0, 0
+		for i := gene.StartCodon; i < gene.StartCodon+gene.NumCodons; i++ {
+			bases := make(map[byte]byte)
+			informative := false
+			for _, seq := range seqs {
+				if i >= len(seq) {
+					continue
+				}
+				c := seq[i]
+				for _, b := range c {
+					total++
+					if !isBase(b) {
+						gaps++
+					}
+				}
+				if !isCompleteCodon(c) {
+					continue
+				}
+				aa := codingTable.Table[string(c)]
+				if b, found := bases[aa]; !found {
+					bases[aa] = c[codonPosition]
+				} else if b != c[codonPosition] {
+					informative = true
+				}
+			}
+			if informative {
+				gs.SynSites++
+			}
+		}
+		if total > 0 {
+			gs.GapFraction = float64(gaps) / float64(total)
+		}
+		s.Genes = append(s.Genes, gs)
+	}
+	s.addDuplicates(genes)
+}
+
+// addDuplicates records the strain names which appear more than once in the CDS regions.
+func (s *runSummary) addDuplicates(genes []geneRegion) {
+	for _, gene := range genes {
+		s.Duplicates = append(s.Duplicates, gene.Duplicates...)
+	}
+}
+
+// setLags records the number of sequence pairs used at each lag (in codons).
+func (s *runSummary) setLags(pairs map[int]int) {
+	var lags []int
+	for l := range pairs {
+		lags = append(lags, l)
+	}
+	sort.Ints(lags)
+	for _, l := range lags {
+		s.Lags = append(s.Lags, lagSummary{l * 3, pairs[l]})
+	}
+}
+
+// Write writes the summary to <prefix>.summary.json and <prefix>.summary.txt.
+func (s *runSummary) Write(prefix string, t *phaseTimer) {
+	s.Phases = t.phases
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Fatalf("failed encoding the run summary: %v", err)
+	}
+	if err := ioutil.WriteFile(prefix+".summary.json", append(b, '\n'), 0644); err != nil {
+		log.Fatalf("failed writing the run summary: %v", err)
+	}
+
+	w, err := os.Create(prefix + ".summary.txt")
+	if err != nil {
+		log.Fatalf("failed writing the run summary: %v", err)
+	}
+	defer w.Close()
+	fmt.Fprintf(w, "%s run summary\n\n", s.Program)
+	fmt.Fprintf(w, "CDS regions: %d\n", len(s.Genes))
+	fmt.Fprintf(w, "%-20s %8s %12s %12s\n", "gene", "codons", "gap/ambig", "syn-inform.")
+	for _, g := range s.Genes {
+		fmt.Fprintf(w, "%-20s %8d %11.2f%% %12d\n", g.ID, g.Codons, 100*g.GapFraction, g.SynSites)
+	}
+	fmt.Fprintf(w, "\nstrains: %d\n", len(s.Strains))
+	fmt.Fprintf(w, "%-30s %12s\n", "strain", "complete")
+	for _, st := range s.Strains {
+		fmt.Fprintf(w, "%-30s %11.2f%%\n", st.Name, 100*st.Completeness)
+	}
+	fmt.Fprintf(w, "\nduplicate strain names: %d\n", len(s.Duplicates))
+	for _, d := range s.Duplicates {
+		fmt.Fprintf(w, "  %s\n", d)
+	}
+	fmt.Fprintf(w, "\nsequence pairs per lag:\n")
+	fmt.Fprintf(w, "%8s %14s\n", "lag", "pairs")
+	for _, l := range s.Lags {
+		fmt.Fprintf(w, "%8d %14d\n", l.Lag, l.Pairs)
+	}
+	fmt.Fprintf(w, "\nwall time:\n")
+	for _, p := range s.Phases {
+		fmt.Fprintf(w, "  %-24s %10.3fs\n", p.Name, p.Seconds)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Asher Preska Steinberg
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/kussell-lab/ncbiftp/taxonomy"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// collectionDates returns the collection date of each strain: from the column dateColumn of the
+// metadata table if one is given, and otherwise the last match of datePattern in the strain name.
+// Strains without a readable date are left out and reported.
+func collectionDates(seqMap map[string][]Codon, metadata, idColumn, dateColumn, datePattern string) (dates map[string]time.Time) {
+	var fromMetadata map[string]string
+	if metadata != "" {
+		fromMetadata = readMetadata(metadata, idColumn, dateColumn)
+	}
+	re, err := regexp.Compile(datePattern)
+	if err != nil {
+		log.Fatalf("--date-pattern %q is not a valid regular expression: %v", datePattern, err)
+	}
+	dates = make(map[string]time.Time)
+	var missing []string
+	for strain := range seqMap {
+		var s string
+		if fromMetadata != nil {
+			s = fromMetadata[strain]
+		} else if m := re.FindAllString(strain, -1); len(m) > 0 {
+			s = m[len(m)-1]
+		}
+		date, err := time.Parse(dateLayout, s)
+		if err != nil {
+			missing = append(missing, strain)
+			continue
+		}
+		dates[strain] = date
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		fmt.Printf("leaving out %d strains without a collection date (YYYY-MM-DD): %s\n", len(missing), strings.Join(missing, ", "))
+	}
+	if len(dates) == 0 {
+		log.Fatalf("no strain has a collection date")
+	}
+	return
+}
+
+// timeWindow is a set of strains collected between the first and last day of the window.
+type timeWindow struct {
+	first, last time.Time
+	strains     map[string][]Codon
+}
+
+// makeTimeWindows splits the strains into time windows by their collection dates: fixed windows of
+// days days from the first date, sliding windows of days days every step days, or num windows
+// holding equal numbers of strains (in order of date). Empty windows are left out.
+func makeTimeWindows(seqMap map[string][]Codon, dates map[string]time.Time, mode string, days, step, num int) (windows []timeWindow) {
+	var strains []string
+	for strain := range dates {
+		strains = append(strains, strain)
+	}
+	sort.Slice(strains, func(a, b int) bool {
+		if !dates[strains[a]].Equal(dates[strains[b]]) {
+			return dates[strains[a]].Before(dates[strains[b]])
+		}
+		return strains[a] < strains[b]
+	})
+	first, last := dates[strains[0]], dates[strains[len(strains)-1]]
+	day := 24 * time.Hour
+
+	if mode == "equal-count" {
+		if num < 1 || num > len(strains) {
+			log.Fatalf("--num-windows must be between 1 and the number of dated strains (%d)", len(strains))
+		}
+		for k := 0; k < num; k++ {
+			from, to := k*len(strains)/num, (k+1)*len(strains)/num
+			w := timeWindow{dates[strains[from]], dates[strains[to-1]], make(map[string][]Codon)}
+			for _, strain := range strains[from:to] {
+				w.strains[strain] = seqMap[strain]
+			}
+			windows = append(windows, w)
+		}
+		return
+	}
+
+	if days < 1 {
+		log.Fatalf("--window-days must be at least 1")
+	}
+	if mode == "fixed" {
+		step = days
+	} else if step < 1 {
+		log.Fatalf("--window-step must be at least 1")
+	}
+	for from := first; !from.After(last); from = from.Add(time.Duration(step) * day) {
+		w := timeWindow{from, from.Add(time.Duration(days-1) * day), make(map[string][]Codon)}
+		for _, strain := range strains {
+			if d := dates[strain]; !d.Before(w.first) && !d.After(w.last) {
+				w.strains[strain] = seqMap[strain]
+			}
+		}
+		if len(w.strains) > 0 {
+			windows = append(windows, w)
+		}
+	}
+	return
+}
+
+// windowProfile is the profile of a window, or between two consecutive windows.
+type windowProfile struct {
+	label       string
+	first, last time.Time
+	strains     int
+	lagMap      map[int]lagResult
+}
+
+// calcWindowProfiles calculates the profile of each time window with at least two strains and,
+// if consecutive is set, the profile between each window and the next, and writes them all to
+// outFile, returning the number of sequence pairs at each lag.
+func calcWindowProfiles(windows []timeWindow, consecutive bool, idx *siteIndex, codonPosition int, lags lagSet,
+	codingTable *taxonomy.GeneticCode, synonymous bool, outFile string, prov *provenance, numDigesters int) (pairs map[int]int) {
+	var profiles []windowProfile
+	for k, w := range windows {
+		fmt.Printf("window %d: %s to %s, %d strains\n", k, w.first.Format(dateLayout), w.last.Format(dateLayout), len(w.strains))
+		if len(w.strains) < 2 {
+			fmt.Printf("skipping window %d: fewer than 2 strains\n", k)
+		} else {
+			lagMap := calcLagResults(w.strains, idx, codonPosition, lags, codingTable, synonymous, numDigesters)
+			profiles = append(profiles, windowProfile{fmt.Sprint(k), w.first, w.last, len(w.strains), lagMap})
+			fmt.Println()
+		}
+		if consecutive && k+1 < len(windows) {
+			next := windows[k+1]
+			lagMap := calcLagResultsMates(w.strains, next.strains, idx, codonPosition, lags,
+				codingTable, synonymous, numDigesters)
+			profiles = append(profiles, windowProfile{fmt.Sprintf("%d|%d", k, k+1), w.first, next.last,
+				len(w.strains) + len(next.strains), lagMap})
+			fmt.Println()
+		}
+	}
+
+	pairs = make(map[int]int)
+	for _, p := range profiles {
+		for l, res := range p.lagMap {
+			pairs[l] += res.all.N
+		}
+	}
+	writeWindowResults(profiles, lags, outFile, prov)
+	return pairs
+}
+
+// writeWindowResults writes the profiles of the time windows to a .csv file in the same form as
+// WriteResults, with columns giving the window and its dates in front; lags without any sequence pairs are left out.
+func writeWindowResults(profiles []windowProfile, lags lagSet, outFile string, prov *provenance) {
+	w, err := os.Create(outFile)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	prov.WriteHeader(w)
+	w.WriteString("# window: the time window, or <window>|<next window> between consecutive windows\n")
+	w.WriteString("# first, last: the first and last collection date of the window(s)\n")
+	w.WriteString("# strains: the number of strains in the window(s)\n")
+	w.WriteString("# l: the distance between two genomic positions\n")
+	w.WriteString("# m: the mean value of correlation profile\n")
+	w.WriteString("# v: the variance of correlation profile\n")
+	w.WriteString("# n: the total number of codon pairs used for calculation\n")
+	w.WriteString("# t: the type of result: Ks is for d_sample, and P2 is for correlation profile\n")
+	w.WriteString("# b: the bootstrap number (all means used all alignments).\n")
+	w.WriteString("window,first,last,strains,l,m,v,n,t,b\n")
+
+	for _, p := range profiles {
+		window := fmt.Sprintf("%s,%s,%s,%d", p.label, p.first.Format(dateLayout), p.last.Format(dateLayout), p.strains)
+		res := p.lagMap[0].all
+		ds := res.Mean
+		w.WriteString(fmt.Sprintf("%s,%d,%g,%g,%d,%s,%s\n", window, res.Lag, res.Mean, res.Variance, res.N, "Ks", "all"))
+		for _, l := range lags.labels {
+			res := p.lagMap[l].all
+			if l == 0 || res.N == 0 {
+				continue
+			}
+			w.WriteString(fmt.Sprintf("%s,%d,%g,%g,%d,%s,%s\n", window, res.Lag, res.Mean/ds, res.Variance, res.N, res.Type, "all"))
+		}
+	}
+}